@@ -0,0 +1,334 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+*/
+import "C"
+import (
+	"encoding/binary"
+)
+
+// Codec applied to the blocks stored by a block shim.
+type blockCodec interface {
+	// Overhead returns the number of bytes that encoding adds to a block.
+	Overhead() int
+
+	// Encode the given block with the given index into dst, which is
+	// Overhead() bytes longer than src.
+	Encode(dst, src []byte, index int64) C.int
+
+	// Decode the given encoded block with the given index into dst, which
+	// is Overhead() bytes shorter than src. It returns SQLITE_CORRUPT if
+	// the block is damaged.
+	Decode(dst, src []byte, index int64) C.int
+}
+
+// Size of the header stored before each encoded block, holding the length
+// of its content.
+const blockHeaderSize = 4
+
+// Implementation of shimHooks that splits the logical content of a file
+// into blocks of fixed size and stores each of them encoded on the
+// underlying file, in a slot of fixed size. The content of a block can be
+// shorter than the block size, in which case the missing bytes read as
+// zeros, and only the slot of the last block can be shorter than the
+// others. Writing past the end of the file never modifies existing blocks.
+//
+// Shims using it must set the data field of every file they open to the
+// blockCodec for that file.
+//
+// Since updating a part of a block rewrites it entirely, the shim reports
+// the block size as sector size and drops the device characteristics that
+// tell SQLite that writes can't damage neighboring data. SQLite then never
+// rewrites blocks holding data it relies on for recovery, and journals all
+// the pages of a block before modifying any of them.
+//
+// A damaged block of a journal or WAL file that gets partially overwritten
+// or truncated was torn by a crash, and is assumed to be empty. A damaged
+// block of a database file makes the write or truncate fail instead, so
+// damage is never masked by re-encoding the block. Since SQLite writes
+// whole pages to database files, this only happens when pages are smaller
+// than blocks, so blocks should be no larger than the smallest page size:
+// otherwise a crash tearing a database block couldn't be recovered from,
+// neither by rolling back a hot journal, which restores the pages of the
+// block one at a time, nor by a WAL checkpoint.
+type blockHooks struct {
+	shimPassthrough
+	size int64 // Size of the logical blocks.
+}
+
+func (h *blockHooks) Read(file *shimFile, buf []byte, offset int64) C.int {
+	// Damaged blocks of journal and WAL files were torn by a crash. Let
+	// them read as empty, so SQLite's own checksums detect them as the end
+	// of the valid content.
+	return h.read(file, buf, offset, file.flags&C.SQLITE_OPEN_MAIN_DB == 0)
+}
+
+// Read the given range of logical content, failing with SQLITE_CORRUPT if
+// a block is damaged, unless damaged blocks are to be read as empty.
+func (h *blockHooks) read(file *shimFile, buf []byte, offset int64, damaged bool) C.int {
+	codec := file.data.(blockCodec)
+
+	physical, rc := file.Size()
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_READ
+	}
+	size := h.logicalSize(codec, physical)
+	end := min64(offset+int64(len(buf)), size)
+
+	read := h.readBlock
+	if damaged {
+		read = h.readDamagedBlock
+	}
+
+	n := int64(0)
+	for offset+n < end {
+		index := (offset + n) / h.size
+		block, rc := read(file, codec, index, physical)
+		if rc != C.SQLITE_OK {
+			return rc
+		}
+
+		// Copy the content of the block and zero-fill the rest of it.
+		from := offset + n - index*h.size
+		chunk := buf[n : n+min64(end-offset-n, h.size-from)]
+		copied := 0
+		if from < int64(len(block)) {
+			copied = copy(chunk, block[from:])
+		}
+		for i := copied; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		n += int64(len(chunk))
+	}
+
+	if n < int64(len(buf)) {
+		for i := n; i < int64(len(buf)); i++ {
+			buf[i] = 0
+		}
+		return C.SQLITE_IOERR_SHORT_READ
+	}
+
+	return C.SQLITE_OK
+}
+
+func (h *blockHooks) Write(file *shimFile, buf []byte, offset int64) C.int {
+	codec := file.data.(blockCodec)
+	if len(buf) == 0 {
+		return C.SQLITE_OK
+	}
+	slot := h.slotSize(codec)
+
+	physical, rc := file.Size()
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_WRITE
+	}
+	size := h.logicalSize(codec, physical)
+	end := offset + int64(len(buf))
+
+	// Any block missing between the end of the file and the offset is
+	// stored empty.
+	first := min64(offset/h.size, (physical+slot-1)/slot)
+	last := (end - 1) / h.size
+	encoded := make([]byte, 0, (last-first+1)*slot)
+
+	for index := first; index <= last; index++ {
+		start := index * h.size
+
+		var block []byte
+		if start+h.size <= offset {
+			block = []byte{}
+		} else {
+			// Range of the block covered by the write.
+			from := max64(offset, start) - start
+			to := min64(end, start+h.size) - start
+
+			if from == 0 && (to == h.size || start+to >= size) {
+				block = buf[start-offset : start-offset+to]
+			} else {
+				block, rc = h.readPartialBlock(file, codec, index, physical)
+				if rc != C.SQLITE_OK {
+					return rc
+				}
+				if int64(len(block)) < to {
+					block = append(block, make([]byte, to-int64(len(block)))...)
+				}
+				copy(block[from:to], buf[start+from-offset:])
+			}
+		}
+
+		// Fill the whole slot of all blocks but the last one.
+		n := len(encoded)
+		if index < last {
+			encoded = encoded[:int64(n)+slot]
+		} else {
+			encoded = encoded[:n+blockHeaderSize+len(block)+codec.Overhead()]
+		}
+		if rc := h.encodeBlock(encoded[n:], codec, block, index); rc != C.SQLITE_OK {
+			return rc
+		}
+	}
+
+	return file.Write(encoded, first*slot)
+}
+
+func (h *blockHooks) Truncate(file *shimFile, size int64) C.int {
+	codec := file.data.(blockCodec)
+	slot := h.slotSize(codec)
+
+	physical, rc := file.Size()
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_TRUNCATE
+	}
+	if size >= h.logicalSize(codec, physical) {
+		return C.SQLITE_OK
+	}
+
+	index := size / h.size
+	rest := size % h.size
+	if rest == 0 {
+		return file.Truncate(index * slot)
+	}
+
+	// Re-encode the block that becomes the last one.
+	block, rc := h.readPartialBlock(file, codec, index, physical)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+	if int64(len(block)) < rest {
+		block = append(block, make([]byte, rest-int64(len(block)))...)
+	}
+	encoded := make([]byte, blockHeaderSize+rest+int64(codec.Overhead()))
+	if rc := h.encodeBlock(encoded, codec, block[:rest], index); rc != C.SQLITE_OK {
+		return rc
+	}
+	if rc := file.Write(encoded, index*slot); rc != C.SQLITE_OK {
+		return rc
+	}
+
+	return file.Truncate(index*slot + int64(len(encoded)))
+}
+
+func (h *blockHooks) FileSize(file *shimFile) (int64, C.int) {
+	physical, rc := file.Size()
+	if rc != C.SQLITE_OK {
+		return 0, rc
+	}
+
+	return h.logicalSize(file.data.(blockCodec), physical), C.SQLITE_OK
+}
+
+func (h *blockHooks) SectorSize(file *shimFile, size C.int) C.int {
+	if int64(size) < h.size {
+		return C.int(h.size)
+	}
+	return size
+}
+
+func (h *blockHooks) DeviceCharacteristics(file *shimFile, flags C.int) C.int {
+	return flags &^ (C.SQLITE_IOCAP_ATOMIC |
+		C.SQLITE_IOCAP_ATOMIC512 |
+		C.SQLITE_IOCAP_ATOMIC1K |
+		C.SQLITE_IOCAP_ATOMIC2K |
+		C.SQLITE_IOCAP_ATOMIC4K |
+		C.SQLITE_IOCAP_ATOMIC8K |
+		C.SQLITE_IOCAP_ATOMIC16K |
+		C.SQLITE_IOCAP_ATOMIC32K |
+		C.SQLITE_IOCAP_ATOMIC64K |
+		C.SQLITE_IOCAP_SAFE_APPEND |
+		C.SQLITE_IOCAP_POWERSAFE_OVERWRITE)
+}
+
+// Return the size of the slot holding an encoded block.
+func (h *blockHooks) slotSize(codec blockCodec) int64 {
+	return blockHeaderSize + h.size + int64(codec.Overhead())
+}
+
+// Return the logical size of a file with the given physical size. All
+// blocks but the last one count as full, and a trailing fragment too short
+// to hold an encoded block is ignored.
+func (h *blockHooks) logicalSize(codec blockCodec, physical int64) int64 {
+	slot := h.slotSize(codec)
+	overhead := slot - h.size
+
+	size := physical / slot * h.size
+	if rest := physical % slot; rest > overhead {
+		size += rest - overhead
+	}
+
+	return size
+}
+
+// Encode the given block into dst, preceded by its length.
+func (h *blockHooks) encodeBlock(dst []byte, codec blockCodec, block []byte, index int64) C.int {
+	binary.BigEndian.PutUint32(dst, uint32(len(block)))
+	n := blockHeaderSize + len(block) + codec.Overhead()
+	return codec.Encode(dst[blockHeaderSize:n], block, index)
+}
+
+// Read and decode the content of the block with the given index.
+func (h *blockHooks) readBlock(file *shimFile, codec blockCodec, index int64, physical int64) ([]byte, C.int) {
+	slot := h.slotSize(codec)
+	overhead := int64(codec.Overhead())
+	offset := index * slot
+
+	n := min64(physical-offset, slot)
+	if n <= blockHeaderSize+overhead {
+		return []byte{}, C.SQLITE_OK
+	}
+
+	encoded := make([]byte, n)
+	if rc := file.Read(encoded, offset); rc != C.SQLITE_OK {
+		return nil, rc
+	}
+
+	length := int64(binary.BigEndian.Uint32(encoded))
+	if blockHeaderSize+length+overhead > n {
+		return nil, C.SQLITE_CORRUPT
+	}
+
+	block := make([]byte, length)
+	encoded = encoded[blockHeaderSize : blockHeaderSize+length+overhead]
+	if rc := codec.Decode(block, encoded, index); rc != C.SQLITE_OK {
+		return nil, rc
+	}
+
+	return block, C.SQLITE_OK
+}
+
+// Read the content of a block that is going to be partially rewritten. If
+// the block is damaged, fail with SQLITE_CORRUPT for database files, and
+// return an empty block for journal and WAL files.
+func (h *blockHooks) readPartialBlock(file *shimFile, codec blockCodec, index int64, physical int64) ([]byte, C.int) {
+	if file.flags&C.SQLITE_OPEN_MAIN_DB != 0 {
+		return h.readBlock(file, codec, index, physical)
+	}
+	return h.readDamagedBlock(file, codec, index, physical)
+}
+
+// Like readBlock, but return an empty block if it's damaged.
+func (h *blockHooks) readDamagedBlock(file *shimFile, codec blockCodec, index int64, physical int64) ([]byte, C.int) {
+	block, rc := h.readBlock(file, codec, index, physical)
+	if rc == C.SQLITE_CORRUPT {
+		return []byte{}, C.SQLITE_OK
+	}
+	return block, rc
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -65,6 +65,11 @@ func commitHookTrampoline(handle uintptr) int {
 	return callback()
 }
 
+//export progressHandlerTrampoline
+func progressHandlerTrampoline(handle uintptr) int {
+	return lookupProgressHandle(handle).tick()
+}
+
 //export rollbackHookTrampoline
 func rollbackHookTrampoline(handle uintptr) {
 	callback := lookupHandle(handle).(func())
@@ -0,0 +1,241 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+
+// Extended result code returned when a block fails verification. Upstream
+// SQLite uses 32 for SQLITE_IOERR_DATA, which is taken by
+// SQLITE_IOERR_NOT_LEADER here.
+#define SQLITE_IOERR_CHECKSUM (SQLITE_IOERR | (34<<8))
+*/
+import "C"
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Size of the blocks that checksums are computed for. It's the smallest page
+// size, so every database page has checksums of its own.
+const checksumBlockSize = 512
+
+// Size of the checksum stored with each block.
+const checksumSize = 4
+
+// RegisterChecksumFileSystem registers a new VFS under the given name, which
+// wraps the VFS with the given base name (or the default VFS if base is
+// empty) and stores a CRC-32C checksum along with every 512 bytes of
+// database, WAL, journal and temporary files.
+//
+// Checksums are verified when SQLite reads database pages, either from the
+// database file or from the WAL, and a mismatch makes the read fail with
+// ErrIoErrChecksum. Since pages are never smaller than 512 bytes, damage
+// is confined to the pages it hits: the other ones can still be read and
+// written. Other reads of journal and WAL files are not verified,
+// since SQLite detects their torn tails after a crash with its own
+// checksums. Shared memory files hold no database content and are not
+// checksummed.
+//
+// The checksum of a block covers its index too, so blocks moved around are
+// detected. Checksums are not a protection against deliberate tampering:
+// use RegisterEncryptedFileSystem for that.
+func RegisterChecksumFileSystem(name string, base string) (*ChecksumFileSystem, error) {
+	hooks := &checksumHooks{
+		blockHooks: blockHooks{size: checksumBlockSize},
+	}
+	shim, err := registerShimVFS(name, base, hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChecksumFileSystem{shim: shim, hooks: hooks}, nil
+}
+
+// UnregisterChecksumFileSystem unregisters the given checksum VFS.
+func UnregisterChecksumFileSystem(fs *ChecksumFileSystem) {
+	unregisterShimVFS(fs.shim)
+}
+
+// ChecksumFileSystem is a VFS verifying the integrity of the files it
+// stores.
+type ChecksumFileSystem struct {
+	shim  *shimVFS
+	hooks *checksumHooks
+}
+
+// Name returns the VFS name this checksum file system was registered with.
+func (fs *ChecksumFileSystem) Name() string {
+	return fs.shim.Name()
+}
+
+// ChecksumScrubReport holds the result of scrubbing a file.
+type ChecksumScrubReport struct {
+	Size    int64   // Size of the content of the file.
+	Blocks  int64   // Number of blocks verified.
+	Damaged []int64 // Offsets of the blocks that failed verification.
+}
+
+// Scrub verifies the checksums of all blocks of the file with the given
+// name, without going through SQLite.
+//
+// A shared lock is held on the file while scrubbing it, so a database can
+// be scrubbed while connections to it are open, although in WAL mode
+// blocks being written by a concurrent checkpoint might be reported as
+// damaged. The last block of a journal or WAL file can legitimately be
+// damaged after a crash.
+func (fs *ChecksumFileSystem) Scrub(name string) (*ChecksumScrubReport, error) {
+	flags := C.int(C.SQLITE_OPEN_READONLY | C.SQLITE_OPEN_MAIN_DB)
+	file, rc := fs.shim.OpenDirect(name, flags)
+	if rc != C.SQLITE_OK {
+		return nil, newError(rc)
+	}
+	defer file.CloseDirect()
+	file.data = checksumCodec{}
+
+	if rc := file.Lock(C.SQLITE_LOCK_SHARED); rc != C.SQLITE_OK {
+		return nil, newError(rc)
+	}
+	defer file.Unlock(C.SQLITE_LOCK_NONE)
+
+	physical, rc := file.Size()
+	if rc != C.SQLITE_OK {
+		return nil, newError(rc)
+	}
+
+	h := &fs.hooks.blockHooks
+	report := &ChecksumScrubReport{
+		Size: h.logicalSize(checksumCodec{}, physical),
+	}
+	for offset := int64(0); offset < report.Size; offset += h.size {
+		index := offset / h.size
+		_, rc := h.readBlock(file, checksumCodec{}, index, physical)
+		switch rc {
+		case C.SQLITE_OK:
+		case C.SQLITE_CORRUPT:
+			report.Damaged = append(report.Damaged, offset)
+		default:
+			return nil, newError(rc)
+		}
+		report.Blocks++
+	}
+
+	return report, nil
+}
+
+// Implementation of shimHooks checksumming files.
+type checksumHooks struct {
+	blockHooks
+}
+
+func (h *checksumHooks) Open(file *shimFile) C.int {
+	file.data = checksumCodec{}
+	return C.SQLITE_OK
+}
+
+func (h *checksumHooks) Read(file *shimFile, buf []byte, offset int64) C.int {
+	// SQLite reads database pages from the WAL one at a time, while
+	// recovering the WAL reads whole frames, including their header.
+	verify := file.flags&C.SQLITE_OPEN_MAIN_DB != 0 ||
+		file.flags&C.SQLITE_OPEN_WAL != 0 && checksumIsPageSize(len(buf))
+
+	rc := h.read(file, buf, offset, !verify)
+	if rc != C.SQLITE_CORRUPT {
+		return rc
+	}
+
+	// SQLite reads the 100 bytes of the database header as soon as the
+	// database is opened, before rolling back a hot journal that might
+	// restore the first block. Let it see an empty database: it will read
+	// the header again along with the first page.
+	if file.flags&C.SQLITE_OPEN_MAIN_DB != 0 && offset == 0 && len(buf) == 100 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return C.SQLITE_IOERR_SHORT_READ
+	}
+
+	return C.SQLITE_IOERR_CHECKSUM
+}
+
+func (h *checksumHooks) Write(file *shimFile, buf []byte, offset int64) C.int {
+	return checksumError(h.blockHooks.Write(file, buf, offset))
+}
+
+func (h *checksumHooks) Truncate(file *shimFile, size int64) C.int {
+	return checksumError(h.blockHooks.Truncate(file, size))
+}
+
+// Report a damaged block met while rewriting part of it as a checksum
+// mismatch.
+func checksumError(rc C.int) C.int {
+	if rc == C.SQLITE_CORRUPT {
+		return C.SQLITE_IOERR_CHECKSUM
+	}
+	return rc
+}
+
+// Whether n is a valid SQLite page size.
+func checksumIsPageSize(n int) bool {
+	return n >= 512 && n <= 65536 && n&(n-1) == 0
+}
+
+// Checksum the blocks of a file.
+type checksumCodec struct{}
+
+func (checksumCodec) Overhead() int {
+	return checksumSize
+}
+
+func (checksumCodec) Encode(dst, src []byte, index int64) C.int {
+	copy(dst, src)
+	binary.BigEndian.PutUint32(dst[len(src):], checksumBlock(src, index))
+	return C.SQLITE_OK
+}
+
+func (checksumCodec) Decode(dst, src []byte, index int64) C.int {
+	n := len(src) - checksumSize
+	if binary.BigEndian.Uint32(src[n:]) != checksumBlock(src[:n], index) {
+		return C.SQLITE_CORRUPT
+	}
+	copy(dst, src[:n])
+	return C.SQLITE_OK
+}
+
+// Return the checksum of the block with the given index.
+func checksumBlock(block []byte, index int64) uint32 {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(index))
+	crc := crc32.Update(0, checksumTable, data)
+	return crc32.Update(crc, checksumTable, block)
+}
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Write the given data at the given offset of the database file with the
+// given name, or truncate the file to the given offset if data is nil,
+// without going through SQLite.
+//
+// This is only here so that tests can refer to it.
+func checksumWriteDirect(fs *ChecksumFileSystem, name string, data []byte, offset int64) error {
+	flags := C.int(C.SQLITE_OPEN_READWRITE | C.SQLITE_OPEN_MAIN_DB)
+	file, rc := fs.shim.OpenDirect(name, flags)
+	if rc != C.SQLITE_OK {
+		return newError(rc)
+	}
+	defer file.CloseDirect()
+	file.data = checksumCodec{}
+
+	if data == nil {
+		rc = fs.hooks.Truncate(file, offset)
+	} else {
+		rc = fs.hooks.Write(file, data, offset)
+	}
+	if rc != C.SQLITE_OK {
+		return newError(rc)
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"io"
+	"os"
+	"testing"
+)
+
+// Data written through the checksum VFS can be read back and scrubbed.
+func TestChecksumVFS(t *testing.T) {
+	fs, err := RegisterChecksumFileSystem("checksum", "")
+	if err != nil {
+		t.Fatal("failed to register checksum VFS", err)
+	}
+	defer UnregisterChecksumFileSystem(fs)
+
+	filename := TempFilename(t)
+	defer os.Remove(filename)
+	defer os.Remove(filename + "-wal")
+	defer os.Remove(filename + "-shm")
+
+	conn := openTestConn(t, "file:"+filename+"?vfs=checksum")
+	pragmaWAL(t, conn)
+	insertTestTableRows(t, conn, 100)
+	assertTestTableRows(t, conn, 100)
+
+	// Scrubbing works with open connections.
+	for _, name := range []string{filename, filename + "-wal"} {
+		report, err := fs.Scrub(name)
+		if err != nil {
+			t.Fatal("failed to scrub file", err)
+		}
+		if report.Blocks == 0 {
+			t.Errorf("expected %s to have blocks", name)
+		}
+		if len(report.Damaged) != 0 {
+			t.Errorf("expected no damaged blocks in %s, got %v", name, report.Damaged)
+		}
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	conn = openTestConn(t, "file:"+filename+"?vfs=checksum")
+	defer conn.Close()
+	assertTestTableRows(t, conn, 100)
+	assertIntegrity(t, conn)
+}
+
+// Damaged database pages are detected on read and by scrubbing.
+func TestChecksumVFS_Damaged(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterChecksumFileSystem("checksum", "volatile")
+	if err != nil {
+		t.Fatal("failed to register checksum VFS", err)
+	}
+	defer UnregisterChecksumFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=checksum")
+	insertTestTableRows(t, conn, 100)
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	// Flip a bit of the last block of the database.
+	data, err := volatile.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	damageChecksumTestFile(t, volatile, len(data)-100)
+
+	report, err := fs.Scrub("test.db")
+	if err != nil {
+		t.Fatal("failed to scrub database", err)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0] != (report.Blocks-1)*checksumBlockSize {
+		t.Fatalf("expected the last of %d blocks to be damaged, got %v", report.Blocks, report.Damaged)
+	}
+
+	conn = openTestConn(t, "file:test.db?vfs=checksum")
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT n, s FROM test", nil)
+	if err == nil {
+		values := make([]driver.Value, 2)
+		for err == nil {
+			err = rows.Next(values)
+		}
+		rows.Close()
+	}
+	if err == nil {
+		t.Fatal("expected query of damaged database to fail")
+	}
+	if code := err.(Error).ExtendedCode; code != ErrIoErrChecksum {
+		t.Fatalf("expected checksum error, got %d", code)
+	}
+}
+
+// A damaged page doesn't prevent writing the pages next to it, and reading
+// it keeps failing.
+func TestChecksumVFS_DamagedSibling(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterChecksumFileSystem("checksum", "volatile")
+	if err != nil {
+		t.Fatal("failed to register checksum VFS", err)
+	}
+	defer UnregisterChecksumFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=checksum")
+	if _, err := conn.Exec("PRAGMA page_size=1024; CREATE TABLE other (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	insertTestTableRows(t, conn, 100)
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	// Page 2 is the root of the test table, page 3 the one of the other
+	// table, and page 4 holds test rows. Damage page 4.
+	slot := blockHeaderSize + checksumBlockSize + checksumSize
+	damageChecksumTestFile(t, volatile, 3*1024/checksumBlockSize*slot+100)
+
+	conn = openTestConn(t, "file:test.db?vfs=checksum")
+	defer conn.Close()
+
+	if _, err := conn.Exec("INSERT INTO other(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to insert value next to damaged page", err)
+	}
+
+	rows, err := conn.Query("SELECT n, s FROM test", nil)
+	if err == nil {
+		values := make([]driver.Value, 2)
+		for err == nil {
+			err = rows.Next(values)
+		}
+		rows.Close()
+	}
+	if err == nil || err == io.EOF {
+		t.Fatal("expected query of damaged page to fail")
+	}
+	if code := err.(Error).ExtendedCode; code != ErrIoErrChecksum {
+		t.Fatalf("expected checksum error, got %d", code)
+	}
+}
+
+// Partially rewriting or truncating a damaged block of a database file
+// fails instead of discarding the damage.
+func TestChecksumVFS_DamagedWrite(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterChecksumFileSystem("checksum", "volatile")
+	if err != nil {
+		t.Fatal("failed to register checksum VFS", err)
+	}
+	defer UnregisterChecksumFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=checksum")
+	insertTestTableRows(t, conn, 100)
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	slot := blockHeaderSize + checksumBlockSize + checksumSize
+	damageChecksumTestFile(t, volatile, 2*slot+100)
+
+	err = checksumWriteDirect(fs, "test.db", make([]byte, 100), 2*checksumBlockSize+200)
+	if err == nil {
+		t.Fatal("expected write to damaged block to fail")
+	}
+	if code := err.(Error).ExtendedCode; code != ErrIoErrChecksum {
+		t.Fatalf("expected checksum error, got %d", code)
+	}
+
+	err = checksumWriteDirect(fs, "test.db", nil, 2*checksumBlockSize+200)
+	if err == nil {
+		t.Fatal("expected truncate of damaged block to fail")
+	}
+	if code := err.(Error).ExtendedCode; code != ErrIoErrChecksum {
+		t.Fatalf("expected checksum error, got %d", code)
+	}
+
+	report, err := fs.Scrub("test.db")
+	if err != nil {
+		t.Fatal("failed to scrub database", err)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0] != 2*checksumBlockSize {
+		t.Fatalf("expected the third block to stay damaged, got %v", report.Damaged)
+	}
+}
+
+// Scrubbing a file that does not exist fails.
+func TestChecksumVFS_ScrubNoSuchFile(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterChecksumFileSystem("checksum", "volatile")
+	if err != nil {
+		t.Fatal("failed to register checksum VFS", err)
+	}
+	defer UnregisterChecksumFileSystem(fs)
+
+	if _, err := fs.Scrub("test.db"); err == nil {
+		t.Fatal("expected scrub of missing file to fail")
+	}
+}
+
+// A crash in the middle of a transaction tearing checksummed blocks leaves
+// the database consistent.
+func TestChecksumVFS_Crash(t *testing.T) {
+	for _, mode := range []string{"DELETE", "WAL"} {
+		for seed := int64(0); seed < 20; seed++ {
+			volatile := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+			fs, err := RegisterChecksumFileSystem("checksum", "volatile")
+			if err != nil {
+				t.Fatal("failed to register checksum VFS", err)
+			}
+
+			conn := openTestConn(t, "file:test.db?vfs=checksum")
+			pragmas := "PRAGMA journal_mode=" + mode + "; PRAGMA synchronous=FULL; PRAGMA cache_size=2"
+			if _, err := conn.Exec(pragmas, nil); err != nil {
+				t.Fatal("failed to set pragmas", err)
+			}
+			insertTestTableRows(t, conn, 20)
+
+			if _, err := conn.Exec("BEGIN; UPDATE test SET s = s || 'y'", nil); err != nil {
+				t.Fatal("failed to update values", err)
+			}
+
+			if err := volatile.CrashRandom(seed); err != nil {
+				t.Fatal("failed to crash volatile VFS", err)
+			}
+			conn.Close()
+
+			conn = openTestConn(t, "file:test.db?vfs=checksum")
+			assertIntegrity(t, conn)
+			assertTestTableCount(t, conn, 20)
+			conn.Close()
+
+			UnregisterChecksumFileSystem(fs)
+			UnregisterVolatileFileSystem(volatile)
+		}
+	}
+}
+
+// Flip a bit of the test database file stored in the given volatile VFS.
+func damageChecksumTestFile(t *testing.T, volatile *VolatileFileSystem, offset int) {
+	data, err := volatile.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	damaged := make([]byte, len(data))
+	copy(damaged, data)
+	damaged[offset] ^= 1
+	if err := volatile.Remove("test.db"); err != nil {
+		t.Fatal("failed to remove database file", err)
+	}
+	if err := volatile.CreateFile("test.db", damaged); err != nil {
+		t.Fatal("failed to create database file", err)
+	}
+}
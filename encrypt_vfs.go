@@ -0,0 +1,371 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+
+// Return a copy of the given string allocated with sqlite3_malloc(), as
+// required for the error message of SQLITE_FCNTL_PRAGMA.
+static char *encryptStrdup(const char *z){
+  return sqlite3_mprintf("%s", z);
+}
+*/
+import "C"
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Size of the blocks that files are encrypted in. It's the smallest page
+// size, so database pages are always made of whole blocks.
+const encryptBlockSize = 512
+
+// Sizes of the AES-GCM nonce and authentication tag stored with each block.
+const (
+	encryptNonceSize = 12
+	encryptTagSize   = 16
+)
+
+// RegisterEncryptedFileSystem registers a new VFS under the given name,
+// which wraps the VFS with the given base name (or the default VFS if base
+// is empty) and encrypts the content of database, WAL, journal and
+// temporary files with AES-GCM.
+//
+// Files are split into blocks of 512 bytes, and each block is stored
+// together with a random nonce, generated every time the block is written,
+// and an authentication tag. The index of the block is authenticated too,
+// so blocks can't be moved around. Shared memory files are not encrypted,
+// since they only hold the WAL index and no database content.
+//
+// The key of a database is given as hex-encoded AES-128, AES-192 or
+// AES-256 key, either with the hexkey URI parameter:
+//
+//   file:test.db?vfs=encrypted&hexkey=2dd29ca851e7b56e4697b0e1f08507293d761a05ce4d1b628663f411a8086d99
+//
+// or with a "PRAGMA hexkey" statement, which must be executed before the
+// database is accessed, for example in SQLiteDriver.ConnectHook:
+//
+//   PRAGMA hexkey='2dd29ca851e7b56e4697b0e1f08507293d761a05ce4d1b628663f411a8086d99'
+//
+// All connections to the same database must use the same key. Accessing a
+// database without a key fails with SQLITE_AUTH, and reading it with the
+// wrong key fails with SQLITE_NOTADB. Temporary files are encrypted with
+// random keys.
+//
+// To change the key of a database, open a connection to a new database
+// with the new key and copy the content of the old one with Backup, then
+// replace the old database file with the new one.
+func RegisterEncryptedFileSystem(name string, base string) (*EncryptedFileSystem, error) {
+	fs := &EncryptedFileSystem{
+		keys: make(map[string]*encryptKey),
+	}
+
+	hooks := &encryptHooks{
+		blockHooks: blockHooks{size: encryptBlockSize},
+		fs:         fs,
+	}
+	shim, err := registerShimVFS(name, base, hooks)
+	if err != nil {
+		return nil, err
+	}
+	fs.shim = shim
+
+	return fs, nil
+}
+
+// UnregisterEncryptedFileSystem unregisters the given encryption VFS.
+func UnregisterEncryptedFileSystem(fs *EncryptedFileSystem) {
+	unregisterShimVFS(fs.shim)
+}
+
+// EncryptedFileSystem is a VFS encrypting the files it stores.
+type EncryptedFileSystem struct {
+	shim *shimVFS
+	mu   sync.Mutex
+	keys map[string]*encryptKey // Keys of the open databases, by file name.
+}
+
+// Name returns the VFS name this encryption file system was registered
+// with.
+func (fs *EncryptedFileSystem) Name() string {
+	return fs.shim.Name()
+}
+
+// Set the key of the database with the given name, or add a reference to
+// it if it was already set by another connection.
+func (fs *EncryptedFileSystem) acquire(name string, key []byte) (cipher.AEAD, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if k, ok := fs.keys[name]; ok {
+		if !bytes.Equal(k.key, key) {
+			return nil, fmt.Errorf("hexkey does not match the key used by other connections")
+		}
+		k.refs++
+		return k.aead, nil
+	}
+
+	aead, err := newEncryptAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	fs.keys[name] = &encryptKey{key: key, aead: aead, refs: 1}
+
+	return aead, nil
+}
+
+// Drop a reference to the key of the database with the given name.
+func (fs *EncryptedFileSystem) release(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	k := fs.keys[name]
+	k.refs--
+	if k.refs == 0 {
+		delete(fs.keys, name)
+	}
+}
+
+// Return the key of the database with the given name, if set.
+func (fs *EncryptedFileSystem) lookup(name string) cipher.AEAD {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if k, ok := fs.keys[name]; ok {
+		return k.aead
+	}
+	return nil
+}
+
+// Key of a database, shared by all connections to it.
+type encryptKey struct {
+	key  []byte
+	aead cipher.AEAD
+	refs int // Number of open database files using the key.
+}
+
+func newEncryptAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Parse a hex-encoded AES key.
+func parseEncryptKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hexkey: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid hexkey: must be 16, 24 or 32 bytes long")
+	}
+	return key, nil
+}
+
+// Implementation of shimHooks encrypting files.
+type encryptHooks struct {
+	blockHooks
+	fs *EncryptedFileSystem
+}
+
+func (h *encryptHooks) Open(file *shimFile) C.int {
+	codec := &encryptCodec{fs: h.fs}
+
+	switch {
+	case file.flags&C.SQLITE_OPEN_MAIN_DB != 0:
+		codec.name = file.name
+		codec.database = true
+		if value := file.URIParameter("hexkey"); value != "" {
+			key, err := parseEncryptKey(value)
+			if err == nil {
+				err = codec.SetKey(key)
+			}
+			if err != nil {
+				return C.SQLITE_AUTH
+			}
+		}
+	case file.flags&C.SQLITE_OPEN_MAIN_JOURNAL != 0:
+		codec.name = strings.TrimSuffix(file.name, "-journal")
+	case file.flags&C.SQLITE_OPEN_WAL != 0:
+		codec.name = strings.TrimSuffix(file.name, "-wal")
+	default:
+		// Temporary files are never reopened, so they get a random key.
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return C.SQLITE_IOERR
+		}
+		aead, err := newEncryptAEAD(key)
+		if err != nil {
+			return C.SQLITE_IOERR
+		}
+		codec.aead = aead
+	}
+
+	file.data = codec
+
+	return C.SQLITE_OK
+}
+
+func (h *encryptHooks) Read(file *shimFile, buf []byte, offset int64) C.int {
+	codec := file.data.(*encryptCodec)
+	rc := h.blockHooks.Read(file, buf, offset)
+	if !codec.database || (rc != C.SQLITE_AUTH && rc != C.SQLITE_CORRUPT) {
+		return rc
+	}
+
+	// SQLite reads the 100 bytes of the database header as soon as the
+	// database is opened, before a key can be set with PRAGMA hexkey and
+	// before rolling back a hot journal that might restore the first
+	// block. Let it see an empty database: it will read the header again
+	// along with the first page.
+	if offset == 0 && len(buf) == 100 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return C.SQLITE_IOERR_SHORT_READ
+	}
+
+	// If the first block can't be decrypted, the key is most likely
+	// wrong.
+	if rc == C.SQLITE_CORRUPT && offset < encryptBlockSize {
+		return C.SQLITE_NOTADB
+	}
+
+	return rc
+}
+
+func (h *encryptHooks) Close(file *shimFile) C.int {
+	codec := file.data.(*encryptCodec)
+	if codec.acquired {
+		h.fs.release(codec.name)
+	}
+	return C.SQLITE_OK
+}
+
+func (h *encryptHooks) FileControl(file *shimFile, op C.int, pArg unsafe.Pointer) C.int {
+	if op != C.SQLITE_FCNTL_PRAGMA {
+		return C.SQLITE_NOTFOUND
+	}
+
+	azArg := (*[3]*C.char)(pArg)
+	if !strings.EqualFold(C.GoString(azArg[1]), "hexkey") {
+		return C.SQLITE_NOTFOUND
+	}
+	if azArg[2] == nil {
+		// Never reveal the key.
+		return C.SQLITE_OK
+	}
+
+	codec := file.data.(*encryptCodec)
+
+	key, err := parseEncryptKey(C.GoString(azArg[2]))
+	if err == nil {
+		err = codec.SetKey(key)
+	}
+	if err != nil {
+		zMsg := C.CString(err.Error())
+		defer C.free(unsafe.Pointer(zMsg))
+		azArg[0] = C.encryptStrdup(zMsg)
+		return C.SQLITE_ERROR
+	}
+
+	return C.SQLITE_OK
+}
+
+// Encrypt the blocks of a single file.
+type encryptCodec struct {
+	fs       *EncryptedFileSystem
+	name     string      // Name of the database the file belongs to.
+	database bool        // Whether this is the database file itself.
+	acquired bool        // Whether the file holds a reference to the key.
+	aead     cipher.AEAD // Cipher, or nil if the key is not known yet.
+	key      []byte      // Key set for the database file.
+}
+
+// SetKey sets the key of a database file, failing if a different key was
+// already set.
+func (c *encryptCodec) SetKey(key []byte) error {
+	if c.acquired {
+		if !bytes.Equal(c.key, key) {
+			return fmt.Errorf("hexkey is already set")
+		}
+		return nil
+	}
+
+	aead, err := c.fs.acquire(c.name, key)
+	if err != nil {
+		return err
+	}
+	c.aead = aead
+	c.key = key
+	c.acquired = true
+
+	return nil
+}
+
+func (c *encryptCodec) Overhead() int {
+	return encryptNonceSize + encryptTagSize
+}
+
+func (c *encryptCodec) Encode(dst, src []byte, index int64) C.int {
+	aead := c.cipher()
+	if aead == nil {
+		return C.SQLITE_AUTH
+	}
+
+	nonce := dst[:encryptNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return C.SQLITE_IOERR_WRITE
+	}
+	aead.Seal(dst[encryptNonceSize:encryptNonceSize], nonce, src, encryptAdditionalData(index))
+
+	return C.SQLITE_OK
+}
+
+func (c *encryptCodec) Decode(dst, src []byte, index int64) C.int {
+	aead := c.cipher()
+	if aead == nil {
+		return C.SQLITE_AUTH
+	}
+
+	nonce := src[:encryptNonceSize]
+	_, err := aead.Open(dst[:0], nonce, src[encryptNonceSize:], encryptAdditionalData(index))
+	if err != nil {
+		return C.SQLITE_CORRUPT
+	}
+
+	return C.SQLITE_OK
+}
+
+// Return the cipher of the file, looking up the key of the database for
+// journal and WAL files.
+func (c *encryptCodec) cipher() cipher.AEAD {
+	if c.aead == nil && !c.database && c.name != "" {
+		c.aead = c.fs.lookup(c.name)
+	}
+	return c.aead
+}
+
+// Return the additional data authenticated with the block with the given
+// index.
+func encryptAdditionalData(index int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(index))
+	return data
+}
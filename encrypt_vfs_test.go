@@ -0,0 +1,287 @@
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	encryptTestKey1 = "2dd29ca851e7b56e4697b0e1f08507293d761a05ce4d1b628663f411a8086d99"
+	encryptTestKey2 = "9e6d2e1c7dbb6d6a0e1a9b5c38c4b2d1"
+)
+
+// Data written through the encryption VFS can be read back only with the
+// right key.
+func TestEncryptedVFS(t *testing.T) {
+	fs, err := RegisterEncryptedFileSystem("encrypted", "")
+	if err != nil {
+		t.Fatal("failed to register encryption VFS", err)
+	}
+	defer UnregisterEncryptedFileSystem(fs)
+
+	filename := TempFilename(t)
+	defer os.Remove(filename)
+	defer os.Remove(filename + "-wal")
+	defer os.Remove(filename + "-shm")
+
+	dsn := "file:" + filename + "?vfs=encrypted&hexkey="
+	conn := openTestConn(t, dsn+encryptTestKey1)
+	pragmaWAL(t, conn)
+	insertTestTableRows(t, conn, 100)
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	// Nothing is stored in plain text.
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	if bytes.Contains(data, []byte("SQLite format 3")) {
+		t.Error("database header is stored in plain text")
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("database content is stored in plain text")
+	}
+
+	conn = openTestConn(t, dsn+encryptTestKey1)
+	assertTestTableRows(t, conn, 100)
+	conn.Close()
+
+	conn = openTestConn(t, dsn+strings.Repeat("0", 64))
+	_, err = conn.Query("SELECT n FROM test", nil)
+	if err == nil {
+		t.Fatal("expected query with wrong key to fail")
+	}
+	if code := err.(Error).Code; code != ErrNotADB {
+		t.Fatalf("expected error code %d, got %d", ErrNotADB, code)
+	}
+	conn.Close()
+
+	conn = openTestConn(t, "file:"+filename+"?vfs=encrypted")
+	_, err = conn.Query("SELECT n FROM test", nil)
+	if err == nil {
+		t.Fatal("expected query without key to fail")
+	}
+	if code := err.(Error).Code; code != ErrAuth {
+		t.Fatalf("expected error code %d, got %d", ErrAuth, code)
+	}
+	conn.Close()
+}
+
+// The key can be set with a pragma in the connect hook, and the encryption
+// VFS can be stacked on top of a volatile VFS.
+func TestEncryptedVFS_VolatilePragma(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterEncryptedFileSystem("encrypted", "volatile")
+	if err != nil {
+		t.Fatal("failed to register encryption VFS", err)
+	}
+	defer UnregisterEncryptedFileSystem(fs)
+
+	drv := &SQLiteDriver{
+		ConnectHook: func(conn *SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA hexkey='"+encryptTestKey2+"'", nil)
+			return err
+		},
+	}
+	conni, err := drv.Open("file:test.db?vfs=encrypted")
+	if err != nil {
+		t.Fatal("failed to open connection", err)
+	}
+	conn := conni.(*SQLiteConn)
+
+	// Use a small cache, so the transaction spills to the database before
+	// being committed and needs the rollback journal.
+	if _, err := conn.Exec("PRAGMA cache_size=2", nil); err != nil {
+		t.Fatal("failed to set cache size", err)
+	}
+	insertTestTableRows(t, conn, 500)
+	if _, err := conn.Exec("BEGIN; DELETE FROM test WHERE n >= 100; ROLLBACK", nil); err != nil {
+		t.Fatal("failed to roll back transaction", err)
+	}
+
+	if _, err := conn.Exec("PRAGMA hexkey='"+encryptTestKey1+"'", nil); err == nil {
+		t.Fatal("expected changing the key to fail")
+	}
+	conn.Close()
+
+	data, err := volatile.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("failed to read volatile database file", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("database content is stored in plain text")
+	}
+
+	conni, err = drv.Open("file:test.db?vfs=encrypted")
+	if err != nil {
+		t.Fatal("failed to reopen connection", err)
+	}
+	conn = conni.(*SQLiteConn)
+	defer conn.Close()
+
+	assertTestTableRows(t, conn, 500)
+	assertIntegrity(t, conn)
+}
+
+// The key can be changed by copying the database with the backup API.
+func TestEncryptedVFS_Rekey(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterEncryptedFileSystem("encrypted", "volatile")
+	if err != nil {
+		t.Fatal("failed to register encryption VFS", err)
+	}
+	defer UnregisterEncryptedFileSystem(fs)
+
+	src := openTestConn(t, "file:old.db?vfs=encrypted&hexkey="+encryptTestKey1)
+	defer src.Close()
+	insertTestTableRows(t, src, 100)
+
+	dst := openTestConn(t, "file:new.db?vfs=encrypted&hexkey="+encryptTestKey2)
+	defer dst.Close()
+
+	backup, err := dst.Backup("main", src, "main")
+	if err != nil {
+		t.Fatal("failed to start backup", err)
+	}
+	if _, err := backup.Step(-1); err != nil {
+		t.Fatal("failed to copy database", err)
+	}
+	if err := backup.Finish(); err != nil {
+		t.Fatal("failed to finish backup", err)
+	}
+
+	assertTestTableRows(t, dst, 100)
+
+	// The copy can't be read with the old key.
+	data, err := volatile.ReadFile("new.db")
+	if err != nil {
+		t.Fatal("failed to read new database file", err)
+	}
+	if err := volatile.CreateFile("check.db", data); err != nil {
+		t.Fatal("failed to copy new database file", err)
+	}
+	conn := openTestConn(t, "file:check.db?vfs=encrypted&hexkey="+encryptTestKey1)
+	defer conn.Close()
+	if _, err := conn.Query("SELECT n FROM test", nil); err == nil {
+		t.Fatal("expected query with the old key to fail")
+	}
+}
+
+// A damaged page doesn't prevent writing the pages next to it, and reading
+// it keeps failing.
+func TestEncryptedVFS_DamagedPage(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterEncryptedFileSystem("encrypted", "volatile")
+	if err != nil {
+		t.Fatal("failed to register encryption VFS", err)
+	}
+	defer UnregisterEncryptedFileSystem(fs)
+
+	dsn := "file:test.db?vfs=encrypted&hexkey=" + encryptTestKey1
+	conn := openTestConn(t, dsn)
+	if _, err := conn.Exec("PRAGMA page_size=1024; CREATE TABLE other (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	insertTestTableRows(t, conn, 100)
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	// Page 2 is the root of the test table, page 3 the one of the other
+	// table, and page 4 holds test rows. Damage page 4.
+	data, err := volatile.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	slot := 4 + encryptBlockSize + encryptNonceSize + encryptTagSize
+	damaged := make([]byte, len(data))
+	copy(damaged, data)
+	damaged[3*1024/encryptBlockSize*slot+100] ^= 1
+	if err := volatile.Remove("test.db"); err != nil {
+		t.Fatal("failed to remove database file", err)
+	}
+	if err := volatile.CreateFile("test.db", damaged); err != nil {
+		t.Fatal("failed to create database file", err)
+	}
+
+	conn = openTestConn(t, dsn)
+	defer conn.Close()
+
+	if _, err := conn.Exec("INSERT INTO other(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to insert value next to damaged page", err)
+	}
+
+	rows, err := conn.Query("SELECT n, s FROM test", nil)
+	if err == nil {
+		values := make([]driver.Value, 2)
+		for err == nil {
+			err = rows.Next(values)
+		}
+		rows.Close()
+	}
+	if err == nil || err == io.EOF {
+		t.Fatal("expected query of damaged page to fail")
+	}
+	if code := err.(Error).Code; code != ErrCorrupt {
+		t.Fatalf("expected corrupt error, got %d", code)
+	}
+}
+
+// A crash in the middle of a transaction tearing encrypted blocks leaves
+// the database consistent.
+func TestEncryptedVFS_Crash(t *testing.T) {
+	for _, mode := range []string{"DELETE", "WAL"} {
+		for seed := int64(0); seed < 20; seed++ {
+			volatile := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+			fs, err := RegisterEncryptedFileSystem("encrypted", "volatile")
+			if err != nil {
+				t.Fatal("failed to register encryption VFS", err)
+			}
+
+			dsn := "file:test.db?vfs=encrypted&hexkey=" + encryptTestKey1
+			conn := openTestConn(t, dsn)
+			pragmas := "PRAGMA page_size=1024; PRAGMA journal_mode=" + mode +
+				"; PRAGMA synchronous=FULL; PRAGMA cache_size=2"
+			if _, err := conn.Exec(pragmas, nil); err != nil {
+				t.Fatal("failed to set pragmas", err)
+			}
+			insertTestTableRows(t, conn, 20)
+
+			if _, err := conn.Exec("BEGIN; UPDATE test SET s = s || 'y'", nil); err != nil {
+				t.Fatal("failed to update values", err)
+			}
+			for i := 20; i < 40; i++ {
+				values := []driver.Value{int64(i), strings.Repeat("secret", 50)}
+				if _, err := conn.Exec("INSERT INTO test(n, s) VALUES(?, ?)", values); err != nil {
+					t.Fatal("failed to insert uncommitted value", err)
+				}
+			}
+
+			if err := volatile.CrashRandom(seed); err != nil {
+				t.Fatal("failed to crash volatile VFS", err)
+			}
+			conn.Close()
+
+			conn = openTestConn(t, dsn)
+			assertIntegrity(t, conn)
+			assertTestTableCount(t, conn, 20)
+			conn.Close()
+
+			UnregisterEncryptedFileSystem(fs)
+			UnregisterVolatileFileSystem(volatile)
+		}
+	}
+}
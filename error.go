@@ -29,6 +29,8 @@ type Error struct {
 	ExtendedCode ErrNoExtended /* The extended error code returned by SQLite */
 	err          string        /* The error string returned by sqlite3_errmsg(),
 	this usually contains more specific details. */
+	cause error /* The error that made SQLite fail, if any, such as the
+	error of a canceled context for interrupted statements. */
 }
 
 // result codes from http://www.sqlite.org/c3ref/c_abort.html
@@ -85,6 +87,13 @@ func (err Error) Error() string {
 	return errorString(err)
 }
 
+// Unwrap returns the error that made SQLite fail, if any. For statements
+// interrupted because their context was done, it's the error of the
+// context.
+func (err Error) Unwrap() error {
+	return err.cause
+}
+
 // result codes from http://www.sqlite.org/c3ref/c_abort_rollback.html
 var (
 	ErrIoErrRead              = ErrIoErr.Extend(1)
@@ -115,6 +124,7 @@ var (
 	ErrIoErrConvPath          = ErrIoErr.Extend(26)
 	ErrIoErrNotLeader         = ErrIoErr.Extend(32)
 	ErrIoErrLeadershipLost    = ErrIoErr.Extend(33)
+	ErrIoErrChecksum          = ErrIoErr.Extend(34)
 	ErrLockedSharedCache      = ErrLocked.Extend(1)
 	ErrBusyRecovery           = ErrBusy.Extend(1)
 	ErrBusySnapshot           = ErrBusy.Extend(2)
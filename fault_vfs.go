@@ -0,0 +1,520 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+*/
+import "C"
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// RegisterFaultFileSystem registers a new VFS under the given name, which
+// wraps the VFS with the given base name (or the default VFS if base is
+// empty) and injects I/O failures on demand.
+//
+// No failure is injected until a script is set with Script or random
+// injection is enabled with Random.
+func RegisterFaultFileSystem(name string, base string) (*FaultFileSystem, error) {
+	fs := &FaultFileSystem{
+		counts: make(map[faultCountKey]int),
+	}
+
+	shim, err := registerShimVFS(name, base, &faultHooks{fs: fs})
+	if err != nil {
+		return nil, err
+	}
+	fs.shim = shim
+
+	return fs, nil
+}
+
+// UnregisterFaultFileSystem unregisters the given fault-injection VFS.
+func UnregisterFaultFileSystem(fs *FaultFileSystem) {
+	unregisterShimVFS(fs.shim)
+}
+
+// FaultOp identifies a file operation performed through a FaultFileSystem.
+type FaultOp int
+
+// Operations performed through a FaultFileSystem. Failures can be injected
+// only in reads, writes, syncs and truncates.
+const (
+	FaultOpOpen FaultOp = iota
+	FaultOpClose
+	FaultOpRead
+	FaultOpWrite
+	FaultOpSync
+	FaultOpTruncate
+	FaultOpDelete
+)
+
+func (op FaultOp) String() string {
+	switch op {
+	case FaultOpOpen:
+		return "open"
+	case FaultOpClose:
+		return "close"
+	case FaultOpRead:
+		return "read"
+	case FaultOpWrite:
+		return "write"
+	case FaultOpSync:
+		return "sync"
+	case FaultOpTruncate:
+		return "truncate"
+	case FaultOpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// FaultKind identifies a kind of failure.
+type FaultKind int
+
+// Kinds of failures that can be injected.
+const (
+	// No failure, the operation is performed normally.
+	FaultNone FaultKind = iota
+
+	// The operation is not performed and fails with an I/O error code,
+	// by default the one matching the operation (e.g. SQLITE_IOERR_WRITE
+	// for writes).
+	FaultIOErr
+
+	// Only the first part of the requested data is read, the rest of the
+	// buffer is zero-filled and the read fails with
+	// SQLITE_IOERR_SHORT_READ.
+	FaultShortRead
+
+	// The write or truncate is not performed and fails with SQLITE_FULL.
+	FaultFull
+
+	// Only the leading sectors of the data are written and the write
+	// fails with SQLITE_IOERR_WRITE.
+	FaultTornWrite
+)
+
+func (kind FaultKind) String() string {
+	switch kind {
+	case FaultNone:
+		return "none"
+	case FaultIOErr:
+		return "ioerr"
+	case FaultShortRead:
+		return "short-read"
+	case FaultFull:
+		return "full"
+	case FaultTornWrite:
+		return "torn-write"
+	}
+	return fmt.Sprintf("kind(%d)", int(kind))
+}
+
+// FaultRule describes a failure to inject in a FaultFileSystem.
+type FaultRule struct {
+	Op   FaultOp   // Operation the rule applies to.
+	File string    // Suffix of the names of the files the rule applies to, or "" for all files.
+	Nth  int       // Fail only the nth matching operation (starting from 1), or all of them if 0.
+	Kind FaultKind // Kind of failure to inject.
+
+	// Extended error code returned by FaultIOErr failures. If zero, the
+	// I/O error code matching the operation is used.
+	Code ErrNoExtended
+
+	// For FaultShortRead, the number of bytes actually read. For
+	// FaultTornWrite, the number of leading sectors actually written.
+	Partial int
+}
+
+// FaultLogEntry records an operation performed through a FaultFileSystem.
+type FaultLogEntry struct {
+	Seq     int           // Sequence number of the operation, starting from 1.
+	Op      FaultOp       // Operation performed.
+	File    string        // Name of the file involved, see FaultFileSystem.
+	N       int           // Number of operations of this type on this file since Script or Random was last called, including this one.
+	Offset  int64         // Offset of reads and writes, or size of truncates.
+	Amount  int           // Number of bytes of reads and writes.
+	Kind    FaultKind     // Kind of failure injected, if any.
+	Partial int           // Same as FaultRule.Partial, for short reads and torn writes.
+	Code    ErrNoExtended // Result code of the operation.
+}
+
+func (e FaultLogEntry) String() string {
+	return fmt.Sprintf(
+		"#%d %s %s (n=%d offset=%d amount=%d) fault=%s/%d rc=%d",
+		e.Seq, e.Op, e.File, e.N, e.Offset, e.Amount, e.Kind, e.Partial, e.Code)
+}
+
+// FaultReplay returns a script that injects again the same failures that
+// were injected in the operations recorded by the given log.
+//
+// Replaying is deterministic as long as the returned script is set at the
+// same point where the original script or random mode was set, and the
+// same operations are performed in the same order.
+func FaultReplay(log []FaultLogEntry) []FaultRule {
+	rules := []FaultRule{}
+	for _, entry := range log {
+		if entry.Kind == FaultNone {
+			continue
+		}
+		rule := FaultRule{
+			Op:   entry.Op,
+			File: entry.File,
+			Nth:  entry.N,
+			Kind: entry.Kind,
+		}
+		switch entry.Kind {
+		case FaultIOErr:
+			rule.Code = entry.Code
+		case FaultShortRead, FaultTornWrite:
+			rule.Partial = entry.Partial
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// FaultFileSystem is a VFS wrapping another VFS and injecting I/O failures
+// according to a script or a seeded probability, logging every operation.
+//
+// Temporary files that SQLite opens without a name are named "<temp N>" in
+// the log and in rules, where N numbers them in the order they are opened,
+// starting from 1 for the first one opened after Script or Random was last
+// called.
+type FaultFileSystem struct {
+	shim *shimVFS
+
+	mu          sync.Mutex
+	rules       []FaultRule
+	matches     []int                 // Number of operations matched by each rule.
+	random      *rand.Rand            // Source for random failures, if enabled.
+	probability float64               // Probability of a random failure.
+	randomOps   map[FaultOp]bool      // Operations subject to random failures.
+	counts      map[faultCountKey]int // Number of operations by type and file.
+	temps       int                   // Number of temporary files opened without a name.
+	tempsBase   int                   // Value of temps when Script or Random was last called.
+	log         []FaultLogEntry
+}
+
+type faultCountKey struct {
+	op   FaultOp
+	file string
+}
+
+// Name returns the VFS name this file system was registered with.
+func (fs *FaultFileSystem) Name() string {
+	return fs.shim.Name()
+}
+
+// Script sets the rules that decide which operations should fail,
+// replacing any previous script. When more than one rule matches an
+// operation, the first one wins.
+func (fs *FaultFileSystem) Script(rules ...FaultRule) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.rules = rules
+	fs.matches = make([]int, len(rules))
+	fs.counts = make(map[faultCountKey]int)
+	fs.tempsBase = fs.temps
+}
+
+// Random makes every read, write, sync or truncate fail with the given
+// probability, picking the kind of failure at random. If ops are given,
+// only those operations are subject to failures.
+//
+// Random failures are applied only to operations that no scripted rule
+// makes fail. Using the same seed with the same sequence of operations
+// injects the same failures.
+func (fs *FaultFileSystem) Random(seed int64, probability float64, ops ...FaultOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.random = rand.New(rand.NewSource(seed))
+	fs.probability = probability
+	fs.counts = make(map[faultCountKey]int)
+	fs.tempsBase = fs.temps
+	fs.randomOps = nil
+	if len(ops) > 0 {
+		fs.randomOps = make(map[FaultOp]bool)
+		for _, op := range ops {
+			fs.randomOps[op] = true
+		}
+	}
+}
+
+// Reset removes the script, disables random failures and clears the log.
+func (fs *FaultFileSystem) Reset() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.rules = nil
+	fs.matches = nil
+	fs.random = nil
+	fs.counts = make(map[faultCountKey]int)
+	fs.log = nil
+}
+
+// Log returns a copy of the log of all operations performed so far.
+func (fs *FaultFileSystem) Log() []FaultLogEntry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	log := make([]FaultLogEntry, len(fs.log))
+	copy(log, fs.log)
+
+	return log
+}
+
+// Decide which failure to inject in the given operation. For reads and
+// writes, partial is the maximum number of bytes or sectors that a random
+// short read or torn write should keep. Must be called with the lock held.
+func (fs *FaultFileSystem) decide(entry *FaultLogEntry, partial int) FaultRule {
+	key := faultCountKey{op: entry.Op, file: entry.File}
+	fs.counts[key]++
+	entry.Seq = len(fs.log) + 1
+	entry.N = fs.counts[key]
+
+	switch entry.Op {
+	case FaultOpRead, FaultOpWrite, FaultOpSync, FaultOpTruncate:
+	default:
+		return FaultRule{}
+	}
+
+	fired := -1
+	for i, rule := range fs.rules {
+		if rule.Op != entry.Op || !strings.HasSuffix(entry.File, rule.File) {
+			continue
+		}
+		fs.matches[i]++
+		if fired == -1 && (rule.Nth == 0 || rule.Nth == fs.matches[i]) {
+			fired = i
+		}
+	}
+	if fired != -1 {
+		return fs.rules[fired]
+	}
+
+	if fs.random == nil || (fs.randomOps != nil && !fs.randomOps[entry.Op]) {
+		return FaultRule{}
+	}
+	if fs.random.Float64() >= fs.probability {
+		return FaultRule{}
+	}
+
+	rule := FaultRule{Op: entry.Op, Kind: FaultIOErr}
+	switch entry.Op {
+	case FaultOpRead:
+		if fs.random.Intn(2) == 1 {
+			rule.Kind = FaultShortRead
+			rule.Partial = fs.random.Intn(partial + 1)
+		}
+	case FaultOpWrite:
+		switch fs.random.Intn(3) {
+		case 1:
+			rule.Kind = FaultFull
+		case 2:
+			rule.Kind = FaultTornWrite
+			rule.Partial = fs.random.Intn(partial + 1)
+		}
+	case FaultOpTruncate:
+		if fs.random.Intn(2) == 1 {
+			rule.Kind = FaultFull
+		}
+	}
+
+	return rule
+}
+
+// Record a completed operation. Must be called with the lock held.
+func (fs *FaultFileSystem) record(entry FaultLogEntry, kind FaultKind, rc C.int) {
+	entry.Kind = kind
+	entry.Code = ErrNoExtended(rc)
+	if kind != FaultShortRead && kind != FaultTornWrite {
+		entry.Partial = 0
+	}
+	fs.log = append(fs.log, entry)
+}
+
+// Implementation of shimHooks injecting failures.
+type faultHooks struct {
+	shimPassthrough
+	fs *FaultFileSystem
+}
+
+func (h *faultHooks) Open(file *shimFile) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	// Files are logged under their name, which is saved as file data.
+	name := file.name
+	if name == "" {
+		h.fs.temps++
+		name = fmt.Sprintf("<temp %d>", h.fs.temps-h.fs.tempsBase)
+	}
+	file.data = name
+
+	entry := FaultLogEntry{Op: FaultOpOpen, File: name}
+	h.fs.decide(&entry, 0)
+	h.fs.record(entry, FaultNone, C.SQLITE_OK)
+
+	return C.SQLITE_OK
+}
+
+func (h *faultHooks) Close(file *shimFile) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	entry := FaultLogEntry{Op: FaultOpClose, File: file.data.(string)}
+	h.fs.decide(&entry, 0)
+	h.fs.record(entry, FaultNone, C.SQLITE_OK)
+
+	return C.SQLITE_OK
+}
+
+func (h *faultHooks) Read(file *shimFile, buf []byte, offset int64) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	entry := FaultLogEntry{Op: FaultOpRead, File: file.data.(string), Offset: offset, Amount: len(buf)}
+	rule := h.fs.decide(&entry, len(buf))
+
+	var rc C.int
+	switch rule.Kind {
+	case FaultIOErr:
+		rc = faultCode(rule, C.SQLITE_IOERR_READ)
+	case FaultShortRead:
+		n := rule.Partial
+		if n > len(buf) {
+			n = len(buf)
+		}
+		rc = file.Read(buf[:n], offset)
+		if rc == C.SQLITE_OK {
+			rc = C.SQLITE_IOERR_SHORT_READ
+		}
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		entry.Partial = n
+	default:
+		rule.Kind = FaultNone
+		rc = file.Read(buf, offset)
+	}
+
+	h.fs.record(entry, rule.Kind, rc)
+
+	return rc
+}
+
+func (h *faultHooks) Write(file *shimFile, buf []byte, offset int64) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	sector := int64(file.SectorSize())
+	sectors := int((offset%sector + int64(len(buf)) + sector - 1) / sector)
+
+	entry := FaultLogEntry{Op: FaultOpWrite, File: file.data.(string), Offset: offset, Amount: len(buf)}
+	rule := h.fs.decide(&entry, sectors)
+
+	var rc C.int
+	switch rule.Kind {
+	case FaultIOErr:
+		rc = faultCode(rule, C.SQLITE_IOERR_WRITE)
+	case FaultFull:
+		rc = C.SQLITE_FULL
+	case FaultTornWrite:
+		// Write only the given number of leading sectors, where the
+		// first sector ends at the first sector boundary after the
+		// offset.
+		n := int64(0)
+		if rule.Partial > 0 {
+			n = sector - offset%sector + int64(rule.Partial-1)*sector
+		}
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		rc = file.Write(buf[:n], offset)
+		if rc == C.SQLITE_OK {
+			rc = C.SQLITE_IOERR_WRITE
+		}
+		entry.Partial = rule.Partial
+	default:
+		rule.Kind = FaultNone
+		rc = file.Write(buf, offset)
+	}
+
+	h.fs.record(entry, rule.Kind, rc)
+
+	return rc
+}
+
+func (h *faultHooks) Truncate(file *shimFile, size int64) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	entry := FaultLogEntry{Op: FaultOpTruncate, File: file.data.(string), Offset: size}
+	rule := h.fs.decide(&entry, 0)
+
+	var rc C.int
+	switch rule.Kind {
+	case FaultIOErr:
+		rc = faultCode(rule, C.SQLITE_IOERR_TRUNCATE)
+	case FaultFull:
+		rc = C.SQLITE_FULL
+	default:
+		rule.Kind = FaultNone
+		rc = file.Truncate(size)
+	}
+
+	h.fs.record(entry, rule.Kind, rc)
+
+	return rc
+}
+
+func (h *faultHooks) Sync(file *shimFile, flags C.int) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	entry := FaultLogEntry{Op: FaultOpSync, File: file.data.(string)}
+	rule := h.fs.decide(&entry, 0)
+
+	var rc C.int
+	switch rule.Kind {
+	case FaultIOErr:
+		rc = faultCode(rule, C.SQLITE_IOERR_FSYNC)
+	default:
+		rule.Kind = FaultNone
+		rc = file.Sync(flags)
+	}
+
+	h.fs.record(entry, rule.Kind, rc)
+
+	return rc
+}
+
+func (h *faultHooks) Delete(vfs *shimVFS, name string, dirSync C.int) C.int {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	entry := FaultLogEntry{Op: FaultOpDelete, File: name}
+	h.fs.decide(&entry, 0)
+	rc := vfs.Delete(name, dirSync)
+	h.fs.record(entry, FaultNone, rc)
+
+	return rc
+}
+
+// Return the error code of the given rule, or the given default.
+func faultCode(rule FaultRule, code C.int) C.int {
+	if rule.Code != 0 {
+		return C.int(rule.Code)
+	}
+	return code
+}
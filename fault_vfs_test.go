@@ -0,0 +1,238 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Scripted failures are injected in operations on files of the wrapped
+// volatile VFS.
+func TestFaultVFS_Script(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	fs, err := RegisterFaultFileSystem("fault", "volatile")
+	if err != nil {
+		t.Fatal("failed to register fault VFS", err)
+	}
+	defer UnregisterFaultFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=fault")
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	cases := []struct {
+		rule FaultRule
+		code ErrNoExtended
+	}{
+		{FaultRule{Op: FaultOpWrite, File: "test.db", Kind: FaultIOErr}, ErrIoErrWrite},
+		{FaultRule{Op: FaultOpSync, File: "-journal", Kind: FaultIOErr}, ErrIoErrFsync},
+		{FaultRule{Op: FaultOpWrite, Nth: 2, Kind: FaultFull}, ErrNoExtended(ErrFull)},
+		{FaultRule{Op: FaultOpWrite, File: "test.db", Kind: FaultTornWrite, Partial: 1}, ErrIoErrWrite},
+		{FaultRule{Op: FaultOpWrite, Kind: FaultIOErr, Code: ErrIoErrAccess}, ErrIoErrAccess},
+	}
+	for _, c := range cases {
+		fs.Script(c.rule)
+		_, err := conn.Exec("INSERT INTO test(n) VALUES(1)", nil)
+		if err == nil {
+			t.Fatalf("expected insert to fail with rule %+v", c.rule)
+		}
+		if code := err.(Error).ExtendedCode; code != c.code {
+			t.Errorf("expected extended code %d with rule %+v, got %d", c.code, c.rule, code)
+		}
+	}
+
+	// Once the script is reset the database is usable again.
+	fs.Reset()
+	if _, err := conn.Exec("INSERT INTO test(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to insert after reset", err)
+	}
+
+	log := fs.Log()
+	if len(log) == 0 {
+		t.Fatal("expected operations to be logged")
+	}
+	for i, entry := range log {
+		if entry.Seq != i+1 {
+			t.Errorf("expected log entry %d to have sequence %d, got %d", i, i+1, entry.Seq)
+		}
+		if entry.Kind != FaultNone {
+			t.Errorf("expected no fault to be injected after reset, got %s", entry)
+		}
+	}
+}
+
+// Random failures are reproducible given the same seed, and can be
+// replayed from the log.
+func TestFaultVFS_RandomAndReplay(t *testing.T) {
+	run := func(setup func(*FaultFileSystem)) []FaultLogEntry {
+		volatile := RegisterVolatileFileSystem("volatile")
+		defer UnregisterVolatileFileSystem(volatile)
+
+		fs, err := RegisterFaultFileSystem("fault", "volatile")
+		if err != nil {
+			t.Fatal("failed to register fault VFS", err)
+		}
+		defer UnregisterFaultFileSystem(fs)
+
+		conn := openTestConn(t, "file:test.db?vfs=fault")
+		defer conn.Close()
+
+		setup(fs)
+		conn.Exec("CREATE TABLE test (n INT)", nil)
+		for i := 0; i < 20; i++ {
+			conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)})
+		}
+
+		return fs.Log()
+	}
+
+	random := func(fs *FaultFileSystem) { fs.Random(123, 0.2) }
+
+	log1 := run(random)
+	log2 := run(random)
+	if !reflect.DeepEqual(log1, log2) {
+		t.Fatal("expected random runs with the same seed to produce the same log")
+	}
+
+	faults := 0
+	for _, entry := range log1 {
+		if entry.Kind != FaultNone {
+			faults++
+		}
+	}
+	if faults == 0 {
+		t.Fatal("expected some fault to be injected")
+	}
+
+	rules := FaultReplay(log1)
+	if len(rules) != faults {
+		t.Fatalf("expected %d replay rules, got %d", faults, len(rules))
+	}
+	log3 := run(func(fs *FaultFileSystem) { fs.Script(rules...) })
+	if !reflect.DeepEqual(log1, log3) {
+		t.Fatal("expected replay to produce the same log")
+	}
+}
+
+// Failures injected in temporary files without a name can be replayed.
+func TestFaultVFS_ReplayTempFile(t *testing.T) {
+	run := func(rules ...FaultRule) ([]FaultLogEntry, error) {
+		volatile := RegisterVolatileFileSystem("volatile")
+		defer UnregisterVolatileFileSystem(volatile)
+
+		fs, err := RegisterFaultFileSystem("fault", "volatile")
+		if err != nil {
+			t.Fatal("failed to register fault VFS", err)
+		}
+		defer UnregisterFaultFileSystem(fs)
+
+		conn := openTestConn(t, "file:test.db?vfs=fault")
+		defer conn.Close()
+
+		if _, err := conn.Exec("PRAGMA temp_store=FILE; PRAGMA cache_size=10; CREATE TABLE test (n INT, s TEXT)", nil); err != nil {
+			t.Fatal("failed to create table", err)
+		}
+		values := []driver.Value{strings.Repeat("x", 1000)}
+		if _, err := conn.Exec("WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 5000) INSERT INTO test SELECT n, ? FROM c", values); err != nil {
+			t.Fatal("failed to insert values", err)
+		}
+
+		// Sorting spills to temporary files.
+		fs.Reset()
+		fs.Script(rules...)
+		rows, err := conn.Query("SELECT n, s FROM test ORDER BY n DESC", nil)
+		if err == nil {
+			values := make([]driver.Value, 2)
+			for err == nil {
+				err = rows.Next(values)
+			}
+			rows.Close()
+		}
+		if err == io.EOF {
+			err = nil
+		}
+
+		return fs.Log(), err
+	}
+
+	log, err := run()
+	if err != nil {
+		t.Fatal("failed to sort values", err)
+	}
+	temp := false
+	for _, entry := range log {
+		if entry.Op == FaultOpOpen && entry.File == "<temp 1>" {
+			temp = true
+		}
+	}
+	if !temp {
+		t.Fatal("expected sorting to open a temporary file")
+	}
+
+	// Fail a read of the temporary file, which comes after reads of the
+	// database file.
+	rule := FaultRule{Op: FaultOpRead, File: "<temp 1>", Nth: 2, Kind: FaultIOErr}
+	log1, err := run(rule)
+	if err == nil {
+		t.Fatal("expected sorting to fail")
+	}
+
+	rules := FaultReplay(log1)
+	if len(rules) != 1 || rules[0].File != "<temp 1>" || rules[0].Nth != 2 {
+		t.Fatalf("expected one replay rule for the temporary file, got %v", rules)
+	}
+	log2, err := run(rules...)
+	if err == nil {
+		t.Fatal("expected replayed sorting to fail")
+	}
+	if !reflect.DeepEqual(log1, log2) {
+		t.Fatal("expected replay to produce the same log")
+	}
+}
+
+// The fault VFS can wrap the default VFS.
+func TestFaultVFS_DefaultVFS(t *testing.T) {
+	fs, err := RegisterFaultFileSystem("fault", "")
+	if err != nil {
+		t.Fatal("failed to register fault VFS", err)
+	}
+	defer UnregisterFaultFileSystem(fs)
+
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+
+	conn := openTestConn(t, "file:"+tempFilename+"?vfs=fault")
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	fs.Script(FaultRule{Op: FaultOpRead, File: "-wal", Kind: FaultShortRead, Partial: 10})
+	if _, err := conn.WalCheckpoint("main", WalCheckpointTruncate); err == nil {
+		t.Fatal("expected checkpoint to fail")
+	} else if code := err.(Error).Code; code != ErrIoErr {
+		t.Fatalf("expected error code %d, got %d", ErrIoErr, code)
+	}
+	fs.Script()
+	if _, err := conn.WalCheckpoint("main", WalCheckpointTruncate); err != nil {
+		t.Fatal("failed to checkpoint", err)
+	}
+}
+
+// Registering a fault VFS on top of an unknown VFS fails.
+func TestFaultVFS_UnknownBase(t *testing.T) {
+	if _, err := RegisterFaultFileSystem("fault", "does-not-exist"); err == nil {
+		t.Fatal("expected registration to fail")
+	}
+}
@@ -0,0 +1,580 @@
+package sqlite3
+
+/*
+#include <string.h>
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+
+// SQLite read-only VFS Go implementation.
+int readOnlyOpen(int iVfs, char *zName, int flags, int *piFd);
+int readOnlyAccess(int iVfs, char *zName, int flags, int *pResOut);
+
+// SQLite read-only file Go implementation.
+int readOnlyClose(int iVfs, int iFd);
+int readOnlyRead(int iVfs, int iFd, void *zBuf, int iAmt, sqlite_int64 iOfst);
+int readOnlyFileSize(int iVfs, int iFd, sqlite_int64 *pSize);
+
+// Data attached to a read-only VFS.
+typedef struct sqlite3ReadOnlyVfsData sqlite3ReadOnlyVfsData;
+struct sqlite3ReadOnlyVfsData {
+  int iVfs;            // Handle to a readOnlyVFS instance.
+  sqlite3_vfs *pRoot;  // VFS used for temporary files.
+};
+
+#define READONLY_DATA(pVfs) ((sqlite3ReadOnlyVfsData*)((pVfs)->pAppData))
+#define READONLY_ROOT(pVfs) (READONLY_DATA(pVfs)->pRoot)
+
+typedef struct sqlite3ReadOnlyFile sqlite3ReadOnlyFile;
+struct sqlite3ReadOnlyFile {
+  sqlite3_file base; // Base class. Must be first.
+  int iVfs;          // Handle to a readOnlyVFS instance.
+  int iFd;           // Handle to an open readOnlyFile instance.
+};
+
+static int sqlite3ReadOnlyClose(sqlite3_file *pFile){
+  sqlite3ReadOnlyFile *p = (sqlite3ReadOnlyFile*)pFile;
+  return readOnlyClose(p->iVfs, p->iFd);
+}
+
+static int sqlite3ReadOnlyRead(
+  sqlite3_file *pFile,
+  void *zBuf,
+  int iAmt,
+  sqlite_int64 iOfst
+){
+  sqlite3ReadOnlyFile *p = (sqlite3ReadOnlyFile*)pFile;
+  return readOnlyRead(p->iVfs, p->iFd, zBuf, iAmt, iOfst);
+}
+
+static int sqlite3ReadOnlyWrite(
+  sqlite3_file *pFile,
+  const void *zBuf,
+  int iAmt,
+  sqlite_int64 iOfst
+){
+  return SQLITE_READONLY;
+}
+
+static int sqlite3ReadOnlyTruncate(sqlite3_file *pFile, sqlite_int64 size){
+  return SQLITE_READONLY;
+}
+
+static int sqlite3ReadOnlySync(sqlite3_file *pFile, int flags){
+  return SQLITE_OK;
+}
+
+static int sqlite3ReadOnlyFileSize(sqlite3_file *pFile, sqlite_int64 *pSize){
+  sqlite3ReadOnlyFile *p = (sqlite3ReadOnlyFile*)pFile;
+  return readOnlyFileSize(p->iVfs, p->iFd, pSize);
+}
+
+static int sqlite3ReadOnlyLock(sqlite3_file *pFile, int eLock){
+  // Files never change, so there's nothing to protect.
+  return SQLITE_OK;
+}
+
+static int sqlite3ReadOnlyUnlock(sqlite3_file *pFile, int eLock){
+  return SQLITE_OK;
+}
+
+static int sqlite3ReadOnlyCheckReservedLock(sqlite3_file *pFile, int *pResOut){
+  *pResOut = 0;
+  return SQLITE_OK;
+}
+
+static int sqlite3ReadOnlyFileControl(sqlite3_file *pFile, int op, void *pArg){
+  return SQLITE_NOTFOUND;
+}
+
+static int sqlite3ReadOnlySectorSize(sqlite3_file *pFile){
+  return 0;
+}
+
+static int sqlite3ReadOnlyDeviceCharacteristics(sqlite3_file *pFile){
+  // Tell SQLite that the file can't change, so it won't look for hot
+  // journals or WAL files, and won't take any lock.
+  return SQLITE_IOCAP_IMMUTABLE;
+}
+
+static const sqlite3_io_methods sqlite3ReadOnlyIoMethods = {
+  1,                                       // iVersion
+  sqlite3ReadOnlyClose,                    // xClose
+  sqlite3ReadOnlyRead,                     // xRead
+  sqlite3ReadOnlyWrite,                    // xWrite
+  sqlite3ReadOnlyTruncate,                 // xTruncate
+  sqlite3ReadOnlySync,                     // xSync
+  sqlite3ReadOnlyFileSize,                 // xFileSize
+  sqlite3ReadOnlyLock,                     // xLock
+  sqlite3ReadOnlyUnlock,                   // xUnlock
+  sqlite3ReadOnlyCheckReservedLock,        // xCheckReservedLock
+  sqlite3ReadOnlyFileControl,              // xFileControl
+  sqlite3ReadOnlySectorSize,               // xSectorSize
+  sqlite3ReadOnlyDeviceCharacteristics     // xDeviceCharacteristics
+};
+
+static int sqlite3ReadOnlyOpen(
+  sqlite3_vfs *pVfs,              // VFS
+  const char *zName,              // File to open, or 0 for a temp file
+  sqlite3_file *pFile,            // Pointer to sqlite3ReadOnlyFile struct to populate
+  int flags,                      // Input SQLITE_OPEN_XXX flags
+  int *pOutFlags                  // Output SQLITE_OPEN_XXX flags (or NULL)
+){
+  sqlite3ReadOnlyFile *p = (sqlite3ReadOnlyFile*)pFile;
+  sqlite3_vfs *pRoot = READONLY_ROOT(pVfs);
+  int rc;
+
+  // Temporary files used for sorting, temp tables and the like are
+  // delegated to the root VFS.
+  if( zName==0 || (flags & SQLITE_OPEN_DELETEONCLOSE) ){
+    return pRoot->xOpen(pRoot, zName, pFile, flags, pOutFlags);
+  }
+
+  p->iVfs = READONLY_DATA(pVfs)->iVfs;
+
+  rc = readOnlyOpen(p->iVfs, (char*)zName, flags, &p->iFd);
+  if( rc!=SQLITE_OK ){
+    p->base.pMethods = 0; // This signal SQLite to not call Close().
+    return rc;
+  }
+
+  if( pOutFlags ){
+    *pOutFlags = (flags & ~(SQLITE_OPEN_READWRITE|SQLITE_OPEN_CREATE)) | SQLITE_OPEN_READONLY;
+  }
+  p->base.pMethods = &sqlite3ReadOnlyIoMethods;
+
+  return SQLITE_OK;
+}
+
+static int sqlite3ReadOnlyDelete(sqlite3_vfs *pVfs, const char *zPath, int dirSync){
+  return SQLITE_IOERR_DELETE;
+}
+
+static int sqlite3ReadOnlyAccess(
+  sqlite3_vfs *pVfs,
+  const char *zPath,
+  int flags,
+  int *pResOut
+){
+  return readOnlyAccess(READONLY_DATA(pVfs)->iVfs, (char*)zPath, flags, pResOut);
+}
+
+static int sqlite3ReadOnlyFullPathname(
+  sqlite3_vfs *pVfs,
+  const char *zPath,
+  int nPathOut,
+  char *zPathOut
+){
+  // Just return the path unchanged.
+  sqlite3_snprintf(nPathOut, zPathOut, "%s", zPath);
+  return SQLITE_OK;
+}
+
+static void* sqlite3ReadOnlyDlOpen(sqlite3_vfs *pVfs, const char *zPath){
+  return READONLY_ROOT(pVfs)->xDlOpen(READONLY_ROOT(pVfs), zPath);
+}
+
+static void sqlite3ReadOnlyDlError(sqlite3_vfs *pVfs, int nByte, char *zErrMsg){
+  READONLY_ROOT(pVfs)->xDlError(READONLY_ROOT(pVfs), nByte, zErrMsg);
+}
+
+static void (*sqlite3ReadOnlyDlSym(sqlite3_vfs *pVfs, void *pH, const char *z))(void){
+  return READONLY_ROOT(pVfs)->xDlSym(READONLY_ROOT(pVfs), pH, z);
+}
+
+static void sqlite3ReadOnlyDlClose(sqlite3_vfs *pVfs, void *pHandle){
+  READONLY_ROOT(pVfs)->xDlClose(READONLY_ROOT(pVfs), pHandle);
+}
+
+static int sqlite3ReadOnlyRandomness(sqlite3_vfs *pVfs, int nByte, char *zByte){
+  return READONLY_ROOT(pVfs)->xRandomness(READONLY_ROOT(pVfs), nByte, zByte);
+}
+
+static int sqlite3ReadOnlySleep(sqlite3_vfs *pVfs, int microseconds){
+  return READONLY_ROOT(pVfs)->xSleep(READONLY_ROOT(pVfs), microseconds);
+}
+
+static int sqlite3ReadOnlyCurrentTime(sqlite3_vfs *pVfs, double *piNow){
+  return READONLY_ROOT(pVfs)->xCurrentTime(READONLY_ROOT(pVfs), piNow);
+}
+
+static int sqlite3ReadOnlyCurrentTimeInt64(sqlite3_vfs *pVfs, sqlite3_int64 *piNow){
+  sqlite3_vfs *pRoot = READONLY_ROOT(pVfs);
+  double rNow;
+  int rc;
+  if( pRoot->iVersion>=2 && pRoot->xCurrentTimeInt64 ){
+    return pRoot->xCurrentTimeInt64(pRoot, piNow);
+  }
+  rc = pRoot->xCurrentTime(pRoot, &rNow);
+  *piNow = (sqlite3_int64)(rNow*86400000.0);
+  return rc;
+}
+
+static int sqlite3ReadOnlyGetLastError(sqlite3_vfs *pVfs, int nBuf, char *zBuf){
+  return 0;
+}
+
+static int sqlite3ReadOnlyRegister(char *zName, int iVfs, sqlite3_vfs **ppVfs) {
+  sqlite3_vfs* pRet;
+  sqlite3_vfs* pRoot;
+  sqlite3ReadOnlyVfsData *pAppData;
+  int szOsFile;
+
+  pRoot = sqlite3_vfs_find(0);
+  if( !pRoot ){
+    return SQLITE_NOTFOUND;
+  }
+
+  pRet = (sqlite3_vfs*)sqlite3_malloc(sizeof(sqlite3_vfs));
+  if( !pRet ){
+    return SQLITE_NOMEM;
+  }
+  pAppData = (sqlite3ReadOnlyVfsData*)sqlite3_malloc(sizeof(sqlite3ReadOnlyVfsData));
+  if( !pAppData ){
+    sqlite3_free(pRet);
+    return SQLITE_NOMEM;
+  }
+  pAppData->iVfs = iVfs;
+  pAppData->pRoot = pRoot;
+
+  // Temporary files are opened by the root VFS in the same slot.
+  szOsFile = sizeof(sqlite3ReadOnlyFile);
+  if( pRoot->szOsFile>szOsFile ){
+    szOsFile = pRoot->szOsFile;
+  }
+
+  memset(pRet, 0, sizeof(sqlite3_vfs));
+  pRet->iVersion =          2;
+  pRet->szOsFile =          szOsFile;
+  pRet->mxPathname =        pRoot->mxPathname;
+  pRet->zName =             (const char*)zName;
+  pRet->pAppData =          pAppData;
+  pRet->xOpen =             sqlite3ReadOnlyOpen;
+  pRet->xDelete =           sqlite3ReadOnlyDelete;
+  pRet->xAccess =           sqlite3ReadOnlyAccess;
+  pRet->xFullPathname =     sqlite3ReadOnlyFullPathname;
+  pRet->xDlOpen =           sqlite3ReadOnlyDlOpen;
+  pRet->xDlError =          sqlite3ReadOnlyDlError;
+  pRet->xDlSym =            sqlite3ReadOnlyDlSym;
+  pRet->xDlClose =          sqlite3ReadOnlyDlClose;
+  pRet->xRandomness =       sqlite3ReadOnlyRandomness;
+  pRet->xSleep =            sqlite3ReadOnlySleep;
+  pRet->xCurrentTime =      sqlite3ReadOnlyCurrentTime;
+  pRet->xGetLastError =     sqlite3ReadOnlyGetLastError;
+  pRet->xCurrentTimeInt64 = sqlite3ReadOnlyCurrentTimeInt64;
+
+  sqlite3_vfs_register(pRet, 0);
+
+  *ppVfs = pRet;
+
+  return SQLITE_OK;
+}
+
+static void sqlite3ReadOnlyUnregister(sqlite3_vfs* pVfs) {
+  sqlite3_vfs_unregister(pVfs);
+  sqlite3_free(pVfs->pAppData);
+  sqlite3_free(pVfs);
+}
+*/
+import "C"
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// RegisterReadOnlyFileSystem registers a new read-only VFS under the given
+// name. Database files are served straight from the io.ReaderAt sources
+// added with ReadOnlyFileSystem.AddFile, without copying them.
+//
+// Connections using the VFS can be opened with the regular vfs URI
+// parameter, for example "file:ref.db?vfs=<name>". They are always
+// read-only: opening a file that doesn't exist fails with SQLITE_CANTOPEN
+// and statements that modify the database fail with SQLITE_READONLY.
+// Temporary files needed by queries are delegated to the default VFS.
+func RegisterReadOnlyFileSystem(name string) *ReadOnlyFileSystem {
+	return registerReadOnlyFileSystem(name, nil)
+}
+
+// UnregisterReadOnlyFileSystem unregisters the given read-only VFS.
+func UnregisterReadOnlyFileSystem(fs *ReadOnlyFileSystem) {
+	readOnlyVFSLock.Lock()
+	defer readOnlyVFSLock.Unlock()
+
+	for iVfs := range readOnlyVFSs {
+		if readOnlyVFSs[iVfs] == fs.vfs {
+			C.sqlite3ReadOnlyUnregister(fs.vfs.pVfs)
+			C.free(unsafe.Pointer(fs.zName))
+			delete(readOnlyVFSs, iVfs)
+			return
+		}
+	}
+
+	panic("unknown read-only file system")
+}
+
+func registerReadOnlyFileSystem(name string, source readOnlySource) *ReadOnlyFileSystem {
+	readOnlyVFSLock.Lock()
+	defer readOnlyVFSLock.Unlock()
+
+	iVfs := readOnlyVFSHandles
+	readOnlyVFSHandles++
+
+	vfs := &readOnlyVFS{
+		files:  make(map[string]*readOnlyFile),
+		fds:    make(map[C.int]*readOnlyFile),
+		source: source,
+	}
+	readOnlyVFSs[iVfs] = vfs
+
+	zName := C.CString(name)
+	rc := C.sqlite3ReadOnlyRegister(zName, iVfs, &vfs.pVfs)
+	if rc != C.SQLITE_OK {
+		panic("out of memory")
+	}
+
+	return &ReadOnlyFileSystem{
+		zName: zName,
+		vfs:   vfs,
+	}
+}
+
+// Global registry of readOnlyVFS instances.
+var readOnlyVFSLock sync.RWMutex
+var readOnlyVFSs = make(map[C.int]*readOnlyVFS)
+var readOnlyVFSHandles C.int
+
+// ReadOnlyFileSystem exports APIs to manage the files served by a read-only
+// VFS.
+type ReadOnlyFileSystem struct {
+	zName *C.char      // C string used for registration.
+	vfs   *readOnlyVFS // VFS implementation.
+}
+
+// Name returns the VFS name this read-only file system was registered with.
+func (fs *ReadOnlyFileSystem) Name() string {
+	return C.GoString(fs.zName)
+}
+
+// AddFile makes the given source of size bytes available as the file with
+// the given name, replacing any file previously added with the same name.
+//
+// The source must stay valid and unchanged as long as connections to the
+// file are open. Since it's shared by all connections, it must be safe for
+// concurrent use, as required by the io.ReaderAt contract.
+func (fs *ReadOnlyFileSystem) AddFile(name string, r io.ReaderAt, size int64) {
+	fs.vfs.mu.Lock()
+	defer fs.vfs.mu.Unlock()
+
+	fs.vfs.files[name] = &readOnlyFile{r: r, size: size}
+}
+
+// RemoveFile removes the file with the given name. Connections that have
+// the file already open keep using it.
+func (fs *ReadOnlyFileSystem) RemoveFile(name string) {
+	fs.vfs.mu.Lock()
+	defer fs.vfs.mu.Unlock()
+
+	delete(fs.vfs.files, name)
+}
+
+// Additional source of files for a read-only VFS, looked up when a file was
+// not added explicitly.
+type readOnlySource interface {
+	Open(name string) (*readOnlyFile, bool)
+	Exists(name string) bool
+}
+
+// Implements the SQLite VFS API serving read-only files.
+type readOnlyVFS struct {
+	mu     sync.RWMutex
+	pVfs   *C.sqlite3_vfs
+	files  map[string]*readOnlyFile // Files added explicitly.
+	source readOnlySource           // Fallback source, or nil.
+	fds    map[C.int]*readOnlyFile  // Map C-land open file numbers to files.
+	serial C.int                    // Serial number for file numbers.
+}
+
+// Open the file with the given name.
+func (vfs *readOnlyVFS) Open(name string) (C.int, C.int) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	file, ok := vfs.files[name]
+	if !ok && vfs.source != nil {
+		file, ok = vfs.source.Open(name)
+	}
+	if !ok {
+		return -1, C.SQLITE_CANTOPEN
+	}
+
+	iFd := vfs.serial
+	vfs.fds[iFd] = file
+	vfs.serial++
+
+	return iFd, C.SQLITE_OK
+}
+
+// Close the file with the given file number.
+func (vfs *readOnlyVFS) Close(iFd C.int) C.int {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	file, ok := vfs.fds[iFd]
+	if !ok {
+		return C.SQLITE_IOERR_CLOSE
+	}
+	delete(vfs.fds, iFd)
+
+	if file.closer != nil {
+		if err := file.closer.Close(); err != nil {
+			return C.SQLITE_IOERR_CLOSE
+		}
+	}
+
+	return C.SQLITE_OK
+}
+
+// Exists returns true if a file with the given name can be opened.
+func (vfs *readOnlyVFS) Exists(name string) bool {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	if _, ok := vfs.files[name]; ok {
+		return true
+	}
+
+	return vfs.source != nil && vfs.source.Exists(name)
+}
+
+// FileByFD returns the open file with the given fd number.
+func (vfs *readOnlyVFS) FileByFD(iFd C.int) (*readOnlyFile, C.int) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	file, ok := vfs.fds[iFd]
+	if !ok {
+		return nil, C.SQLITE_IOERR
+	}
+
+	return file, C.SQLITE_OK
+}
+
+// Content of a read-only file.
+type readOnlyFile struct {
+	r      io.ReaderAt // Source of the file content.
+	size   int64       // Size of the file.
+	closer io.Closer   // Closes the source when the file is closed, or nil.
+}
+
+// Read fills buf with data starting at the given offset.
+func (f *readOnlyFile) Read(buf []byte, offset int64) C.int {
+	n, err := f.r.ReadAt(buf, offset)
+	if n == len(buf) {
+		return C.SQLITE_OK
+	}
+
+	// From SQLite docs:
+	//
+	//   If xRead() returns SQLITE_IOERR_SHORT_READ it must also fill
+	//   in the unread portions of the buffer with zeros.  A VFS that
+	//   fails to zero-fill short reads might seem to work.  However,
+	//   failure to zero-fill short reads will eventually lead to
+	//   database corruption.
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	if err != nil && err != io.EOF {
+		return C.SQLITE_IOERR_READ
+	}
+
+	return C.SQLITE_IOERR_SHORT_READ
+}
+
+//export readOnlyOpen
+func readOnlyOpen(iVfs C.int, zName *C.char, flags C.int, piFd *C.int) C.int {
+	vfs, ok := readOnlyFindVFS(iVfs)
+	if !ok {
+		return C.SQLITE_CANTOPEN
+	}
+
+	// Only database files are served, any journal or WAL can't be opened.
+	if flags&C.SQLITE_OPEN_MAIN_DB == 0 {
+		return C.SQLITE_CANTOPEN
+	}
+
+	iFd, rc := vfs.Open(C.GoString(zName))
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+	*piFd = iFd
+
+	return C.SQLITE_OK
+}
+
+//export readOnlyAccess
+func readOnlyAccess(iVfs C.int, zName *C.char, flags C.int, pResOut *C.int) C.int {
+	vfs, ok := readOnlyFindVFS(iVfs)
+	if !ok {
+		return C.SQLITE_IOERR_ACCESS
+	}
+
+	*pResOut = 0
+	if flags != C.SQLITE_ACCESS_READWRITE && vfs.Exists(C.GoString(zName)) {
+		*pResOut = 1
+	}
+
+	return C.SQLITE_OK
+}
+
+//export readOnlyClose
+func readOnlyClose(iVfs C.int, iFd C.int) C.int {
+	vfs, ok := readOnlyFindVFS(iVfs)
+	if !ok {
+		return C.SQLITE_IOERR_CLOSE
+	}
+
+	return vfs.Close(iFd)
+}
+
+//export readOnlyRead
+func readOnlyRead(iVfs C.int, iFd C.int, zBuf unsafe.Pointer, iAmt C.int, iOfst C.sqlite_int64) C.int {
+	file, rc := readOnlyFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_READ
+	}
+
+	return file.Read(shimBuffer(zBuf, iAmt), int64(iOfst))
+}
+
+//export readOnlyFileSize
+func readOnlyFileSize(iVfs C.int, iFd C.int, pSize *C.sqlite_int64) C.int {
+	file, rc := readOnlyFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_FSTAT
+	}
+
+	*pSize = C.sqlite_int64(file.size)
+
+	return C.SQLITE_OK
+}
+
+func readOnlyFindVFS(iVfs C.int) (*readOnlyVFS, bool) {
+	readOnlyVFSLock.RLock()
+	defer readOnlyVFSLock.RUnlock()
+
+	vfs, ok := readOnlyVFSs[iVfs]
+	return vfs, ok
+}
+
+func readOnlyFindFile(iVfs C.int, iFd C.int) (*readOnlyFile, C.int) {
+	vfs, ok := readOnlyFindVFS(iVfs)
+	if !ok {
+		return nil, C.SQLITE_IOERR
+	}
+
+	return vfs.FileByFD(iFd)
+}
@@ -0,0 +1,87 @@
+// +build go1.16
+
+package sqlite3
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// RegisterReadOnlyFS registers a new read-only VFS under the given name,
+// serving database files from the given file system, for example an
+// embed.FS. Files added with ReadOnlyFileSystem.AddFile take precedence.
+//
+// File names are passed to the file system unchanged, so they must be
+// valid fs.FS paths. Files are read in place if they implement io.ReaderAt,
+// as embed.FS files do, or through Seek and Read if they implement
+// io.Seeker. Other files can't be opened.
+func RegisterReadOnlyFS(name string, fsys fs.FS) *ReadOnlyFileSystem {
+	return registerReadOnlyFileSystem(name, readOnlyFS{fsys: fsys})
+}
+
+// Serve read-only files from an fs.FS.
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+func (s readOnlyFS) Open(name string) (*readOnlyFile, bool) {
+	if !fs.ValidPath(name) {
+		return nil, false
+	}
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, false
+	}
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, false
+	}
+
+	var r io.ReaderAt
+	switch f := f.(type) {
+	case io.ReaderAt:
+		r = f
+	case io.ReadSeeker:
+		r = &readSeekerAt{r: f}
+	default:
+		f.Close()
+		return nil, false
+	}
+
+	return &readOnlyFile{r: r, size: info.Size(), closer: f}, true
+}
+
+func (s readOnlyFS) Exists(name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+
+	info, err := fs.Stat(s.fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Adapt an io.ReadSeeker to io.ReaderAt, serializing access.
+type readSeekerAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, offset int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,36 @@
+// +build go1.16
+
+package sqlite3
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+// Serve a database from an fs.FS.
+func Test_ReadOnlyFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"testdata/ref.db": &fstest.MapFile{Data: readOnlyTestDatabase(t)},
+	}
+
+	fs := RegisterReadOnlyFS("readonly", fsys)
+	defer UnregisterReadOnlyFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:testdata/ref.db?vfs=readonly")
+	if err != nil {
+		t.Fatal("failed to open connection with read-only VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	assertTestTableRows(t, conn, 100)
+
+	if _, err := conn.Exec("DELETE FROM test", nil); err == nil {
+		t.Fatal("expected delete on read-only VFS to fail")
+	}
+
+	if _, err := drv.Open("file:testdata/missing.db?vfs=readonly"); err == nil {
+		t.Fatal("expected opening a missing file to fail")
+	}
+}
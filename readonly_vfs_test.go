@@ -0,0 +1,91 @@
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"testing"
+)
+
+// Serve a database from an io.ReaderAt.
+func Test_ReadOnlyVFS(t *testing.T) {
+	data := readOnlyTestDatabase(t)
+
+	fs := RegisterReadOnlyFileSystem("readonly")
+	defer UnregisterReadOnlyFileSystem(fs)
+	fs.AddFile("ref.db", bytes.NewReader(data), int64(len(data)))
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:ref.db?vfs=readonly")
+	if err != nil {
+		t.Fatal("failed to open connection with read-only VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	assertTestTableRows(t, conn, 100)
+
+	// Writes fail.
+	_, err = conn.Exec("INSERT INTO test(n) VALUES(100)", nil)
+	if err == nil {
+		t.Fatal("expected insert on read-only VFS to fail")
+	}
+	if code := err.(Error).Code; code != ErrReadonly {
+		t.Fatalf("expected error code %d, got %d", ErrReadonly, code)
+	}
+
+	// Temporary tables work, since they are delegated to the default VFS.
+	if _, err := conn.Exec("CREATE TEMP TABLE temp_test (n INT)", nil); err != nil {
+		t.Fatal("failed to create temporary table", err)
+	}
+	if _, err := conn.Exec("INSERT INTO temp_test SELECT n FROM test", nil); err != nil {
+		t.Fatal("failed to insert into temporary table", err)
+	}
+}
+
+// Opening a file that was not added fails.
+func Test_ReadOnlyVFSNoSuchFile(t *testing.T) {
+	fs := RegisterReadOnlyFileSystem("readonly")
+	defer UnregisterReadOnlyFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	_, err := drv.Open("file:missing.db?vfs=readonly")
+	if err == nil {
+		t.Fatal("expected opening a missing file to fail")
+	}
+	if code := err.(Error).Code; code != ErrCantOpen {
+		t.Fatalf("expected error code %d, got %d", ErrCantOpen, code)
+	}
+}
+
+// Return the content of a database with a test table with 100 rows.
+func readOnlyTestDatabase(t *testing.T) []byte {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)})
+		if err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	data, err := fs.ReadFile("test.db")
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+
+	return data
+}
@@ -0,0 +1,869 @@
+package sqlite3
+
+/*
+#include <string.h>
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+
+// SQLite VFS shim Go implementation.
+int shimOpen(int iVfs, char *zName, sqlite3_file *pReal, int flags, int *piFd);
+int shimDelete(int iVfs, char *zName, int dirSync);
+
+// SQLite file shim Go implementation.
+int shimClose(int iVfs, int iFd);
+int shimRead(int iVfs, int iFd, void *zBuf, int iAmt, sqlite_int64 iOfst);
+int shimWrite(int iVfs, int iFd, void *zBuf, int iAmt, sqlite_int64 iOfst);
+int shimTruncate(int iVfs, int iFd, sqlite_int64 size);
+int shimSync(int iVfs, int iFd, int flags);
+int shimFileSize(int iVfs, int iFd, sqlite_int64 *pSize);
+int shimFileControl(int iVfs, int iFd, int op, void *pArg);
+int shimSectorSize(int iVfs, int iFd, int size);
+int shimDeviceCharacteristics(int iVfs, int iFd, int flags);
+
+// Data attached to a shim VFS.
+typedef struct sqlite3ShimVfsData sqlite3ShimVfsData;
+struct sqlite3ShimVfsData {
+  int iVfs;            // Handle to a shimVFS instance.
+  sqlite3_vfs *pRoot;  // Underlying VFS.
+};
+
+#define SHIM_DATA(pVfs) ((sqlite3ShimVfsData*)((pVfs)->pAppData))
+#define SHIM_ROOT(pVfs) (SHIM_DATA(pVfs)->pRoot)
+
+typedef struct sqlite3ShimFile sqlite3ShimFile;
+struct sqlite3ShimFile {
+  sqlite3_file base;    // Base class. Must be first.
+  int iVfs;             // Handle to a shimVFS instance.
+  int iFd;              // Handle to an open shimFile instance.
+  sqlite3_file *pReal;  // Underlying file, allocated right after this struct.
+};
+
+#define SHIM_REAL(pFile) (((sqlite3ShimFile*)(pFile))->pReal)
+
+static int sqlite3ShimClose(sqlite3_file *pFile){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  int rc = shimClose(p->iVfs, p->iFd);
+  int rc2 = p->pReal->pMethods->xClose(p->pReal);
+  return rc!=SQLITE_OK ? rc : rc2;
+}
+
+static int sqlite3ShimRead(
+  sqlite3_file *pFile,
+  void *zBuf,
+  int iAmt,
+  sqlite_int64 iOfst
+){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  return shimRead(p->iVfs, p->iFd, zBuf, iAmt, iOfst);
+}
+
+static int sqlite3ShimWrite(
+  sqlite3_file *pFile,
+  const void *zBuf,
+  int iAmt,
+  sqlite_int64 iOfst
+){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  return shimWrite(p->iVfs, p->iFd, (void*)zBuf, iAmt, iOfst);
+}
+
+static int sqlite3ShimTruncate(sqlite3_file *pFile, sqlite_int64 size){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  return shimTruncate(p->iVfs, p->iFd, size);
+}
+
+static int sqlite3ShimSync(sqlite3_file *pFile, int flags){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  return shimSync(p->iVfs, p->iFd, flags);
+}
+
+static int sqlite3ShimFileSize(sqlite3_file *pFile, sqlite_int64 *pSize){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  return shimFileSize(p->iVfs, p->iFd, pSize);
+}
+
+static int sqlite3ShimLock(sqlite3_file *pFile, int eLock){
+  return SHIM_REAL(pFile)->pMethods->xLock(SHIM_REAL(pFile), eLock);
+}
+
+static int sqlite3ShimUnlock(sqlite3_file *pFile, int eLock){
+  return SHIM_REAL(pFile)->pMethods->xUnlock(SHIM_REAL(pFile), eLock);
+}
+
+static int sqlite3ShimCheckReservedLock(sqlite3_file *pFile, int *pResOut){
+  return SHIM_REAL(pFile)->pMethods->xCheckReservedLock(SHIM_REAL(pFile), pResOut);
+}
+
+static int sqlite3ShimFileControl(sqlite3_file *pFile, int op, void *pArg){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  int rc = shimFileControl(p->iVfs, p->iFd, op, pArg);
+  if( rc==SQLITE_NOTFOUND ){
+    rc = p->pReal->pMethods->xFileControl(p->pReal, op, pArg);
+  }
+  return rc;
+}
+
+static int sqlite3ShimSectorSize(sqlite3_file *pFile){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  int size = p->pReal->pMethods->xSectorSize(p->pReal);
+  return shimSectorSize(p->iVfs, p->iFd, size);
+}
+
+static int sqlite3ShimDeviceCharacteristics(sqlite3_file *pFile){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  int flags = p->pReal->pMethods->xDeviceCharacteristics(p->pReal);
+  return shimDeviceCharacteristics(p->iVfs, p->iFd, flags);
+}
+
+static int sqlite3ShimShmMap(
+  sqlite3_file *pFile,
+  int iRegion,
+  int szRegion,
+  int bExtend,
+  void volatile **pp
+){
+  return SHIM_REAL(pFile)->pMethods->xShmMap(SHIM_REAL(pFile), iRegion, szRegion, bExtend, pp);
+}
+
+static int sqlite3ShimShmLock(sqlite3_file *pFile, int ofst, int n, int flags){
+  return SHIM_REAL(pFile)->pMethods->xShmLock(SHIM_REAL(pFile), ofst, n, flags);
+}
+
+static void sqlite3ShimShmBarrier(sqlite3_file *pFile){
+  SHIM_REAL(pFile)->pMethods->xShmBarrier(SHIM_REAL(pFile));
+}
+
+static int sqlite3ShimShmUnmap(sqlite3_file *pFile, int deleteFlag){
+  return SHIM_REAL(pFile)->pMethods->xShmUnmap(SHIM_REAL(pFile), deleteFlag);
+}
+
+// Methods used when the underlying file does not support shared memory.
+static const sqlite3_io_methods sqlite3ShimIoMethodsV1 = {
+  1,                                       // iVersion
+  sqlite3ShimClose,                        // xClose
+  sqlite3ShimRead,                         // xRead
+  sqlite3ShimWrite,                        // xWrite
+  sqlite3ShimTruncate,                     // xTruncate
+  sqlite3ShimSync,                         // xSync
+  sqlite3ShimFileSize,                     // xFileSize
+  sqlite3ShimLock,                         // xLock
+  sqlite3ShimUnlock,                       // xUnlock
+  sqlite3ShimCheckReservedLock,            // xCheckReservedLock
+  sqlite3ShimFileControl,                  // xFileControl
+  sqlite3ShimSectorSize,                   // xSectorSize
+  sqlite3ShimDeviceCharacteristics,        // xDeviceCharacteristics
+  0,                                       // xShmMap
+  0,                                       // xShmLock
+  0,                                       // xShmBarrier
+  0                                        // xShmUnmap
+};
+
+// Methods used when the underlying file supports shared memory.
+static const sqlite3_io_methods sqlite3ShimIoMethodsV2 = {
+  2,                                       // iVersion
+  sqlite3ShimClose,                        // xClose
+  sqlite3ShimRead,                         // xRead
+  sqlite3ShimWrite,                        // xWrite
+  sqlite3ShimTruncate,                     // xTruncate
+  sqlite3ShimSync,                         // xSync
+  sqlite3ShimFileSize,                     // xFileSize
+  sqlite3ShimLock,                         // xLock
+  sqlite3ShimUnlock,                       // xUnlock
+  sqlite3ShimCheckReservedLock,            // xCheckReservedLock
+  sqlite3ShimFileControl,                  // xFileControl
+  sqlite3ShimSectorSize,                   // xSectorSize
+  sqlite3ShimDeviceCharacteristics,        // xDeviceCharacteristics
+  sqlite3ShimShmMap,                       // xShmMap
+  sqlite3ShimShmLock,                      // xShmLock
+  sqlite3ShimShmBarrier,                   // xShmBarrier
+  sqlite3ShimShmUnmap                      // xShmUnmap
+};
+
+static int sqlite3ShimOpen(
+  sqlite3_vfs *pVfs,              // VFS
+  const char *zName,              // File to open, or 0 for a temp file
+  sqlite3_file *pFile,            // Pointer to sqlite3ShimFile struct to populate
+  int flags,                      // Input SQLITE_OPEN_XXX flags
+  int *pOutFlags                  // Output SQLITE_OPEN_XXX flags (or NULL)
+){
+  sqlite3ShimFile *p = (sqlite3ShimFile*)pFile;
+  sqlite3_vfs *pRoot = SHIM_ROOT(pVfs);
+  int rc;
+
+  p->iVfs = SHIM_DATA(pVfs)->iVfs;
+  p->pReal = (sqlite3_file*)&p[1];
+
+  rc = pRoot->xOpen(pRoot, zName, p->pReal, flags, pOutFlags);
+  if( rc!=SQLITE_OK ){
+    p->base.pMethods = 0; // This signal SQLite to not call Close().
+    return rc;
+  }
+
+  rc = shimOpen(p->iVfs, (char*)zName, p->pReal, flags, &p->iFd);
+  if( rc!=SQLITE_OK ){
+    p->pReal->pMethods->xClose(p->pReal);
+    p->base.pMethods = 0;
+    return rc;
+  }
+
+  if( p->pReal->pMethods->iVersion>=2 && p->pReal->pMethods->xShmMap ){
+    p->base.pMethods = &sqlite3ShimIoMethodsV2;
+  }else{
+    p->base.pMethods = &sqlite3ShimIoMethodsV1;
+  }
+
+  return SQLITE_OK;
+}
+
+static int sqlite3ShimDelete(sqlite3_vfs *pVfs, const char *zPath, int dirSync){
+  return shimDelete(SHIM_DATA(pVfs)->iVfs, (char*)zPath, dirSync);
+}
+
+static int sqlite3ShimAccess(
+  sqlite3_vfs *pVfs,
+  const char *zPath,
+  int flags,
+  int *pResOut
+){
+  return SHIM_ROOT(pVfs)->xAccess(SHIM_ROOT(pVfs), zPath, flags, pResOut);
+}
+
+static int sqlite3ShimFullPathname(
+  sqlite3_vfs *pVfs,
+  const char *zPath,
+  int nPathOut,
+  char *zPathOut
+){
+  return SHIM_ROOT(pVfs)->xFullPathname(SHIM_ROOT(pVfs), zPath, nPathOut, zPathOut);
+}
+
+static void* sqlite3ShimDlOpen(sqlite3_vfs *pVfs, const char *zPath){
+  return SHIM_ROOT(pVfs)->xDlOpen(SHIM_ROOT(pVfs), zPath);
+}
+
+static void sqlite3ShimDlError(sqlite3_vfs *pVfs, int nByte, char *zErrMsg){
+  SHIM_ROOT(pVfs)->xDlError(SHIM_ROOT(pVfs), nByte, zErrMsg);
+}
+
+static void (*sqlite3ShimDlSym(sqlite3_vfs *pVfs, void *pH, const char *z))(void){
+  return SHIM_ROOT(pVfs)->xDlSym(SHIM_ROOT(pVfs), pH, z);
+}
+
+static void sqlite3ShimDlClose(sqlite3_vfs *pVfs, void *pHandle){
+  SHIM_ROOT(pVfs)->xDlClose(SHIM_ROOT(pVfs), pHandle);
+}
+
+static int sqlite3ShimRandomness(sqlite3_vfs *pVfs, int nByte, char *zByte){
+  return SHIM_ROOT(pVfs)->xRandomness(SHIM_ROOT(pVfs), nByte, zByte);
+}
+
+static int sqlite3ShimSleep(sqlite3_vfs *pVfs, int microseconds){
+  return SHIM_ROOT(pVfs)->xSleep(SHIM_ROOT(pVfs), microseconds);
+}
+
+static int sqlite3ShimCurrentTime(sqlite3_vfs *pVfs, double *piNow){
+  return SHIM_ROOT(pVfs)->xCurrentTime(SHIM_ROOT(pVfs), piNow);
+}
+
+static int sqlite3ShimCurrentTimeInt64(sqlite3_vfs *pVfs, sqlite3_int64 *piNow){
+  sqlite3_vfs *pRoot = SHIM_ROOT(pVfs);
+  double rNow;
+  int rc;
+  if( pRoot->iVersion>=2 && pRoot->xCurrentTimeInt64 ){
+    return pRoot->xCurrentTimeInt64(pRoot, piNow);
+  }
+  rc = pRoot->xCurrentTime(pRoot, &rNow);
+  *piNow = (sqlite3_int64)(rNow*86400000.0);
+  return rc;
+}
+
+static int sqlite3ShimGetLastError(sqlite3_vfs *pVfs, int nBuf, char *zBuf){
+  return SHIM_ROOT(pVfs)->xGetLastError(SHIM_ROOT(pVfs), nBuf, zBuf);
+}
+
+static int sqlite3ShimRegister(char *zName, char *zRoot, int iVfs, sqlite3_vfs **ppVfs) {
+  sqlite3_vfs* pRet;
+  sqlite3_vfs* pRoot;
+  sqlite3ShimVfsData *pAppData;
+
+  pRoot = sqlite3_vfs_find(zRoot);
+  if( !pRoot ){
+    return SQLITE_NOTFOUND;
+  }
+
+  pRet = (sqlite3_vfs*)sqlite3_malloc(sizeof(sqlite3_vfs));
+  if( !pRet ){
+    return SQLITE_NOMEM;
+  }
+  pAppData = (sqlite3ShimVfsData*)sqlite3_malloc(sizeof(sqlite3ShimVfsData));
+  if( !pAppData ){
+    sqlite3_free(pRet);
+    return SQLITE_NOMEM;
+  }
+  pAppData->iVfs = iVfs;
+  pAppData->pRoot = pRoot;
+
+  pRet->iVersion =          2;
+  pRet->szOsFile =          sizeof(sqlite3ShimFile) + pRoot->szOsFile;
+  pRet->mxPathname =        pRoot->mxPathname;
+  pRet->pNext =             0;
+  pRet->zName =             (const char*)zName;
+  pRet->pAppData =          pAppData;
+  pRet->xOpen =             sqlite3ShimOpen;
+  pRet->xDelete =           sqlite3ShimDelete;
+  pRet->xAccess =           sqlite3ShimAccess;
+  pRet->xFullPathname =     sqlite3ShimFullPathname;
+  pRet->xDlOpen =           sqlite3ShimDlOpen;
+  pRet->xDlError =          sqlite3ShimDlError;
+  pRet->xDlSym =            sqlite3ShimDlSym;
+  pRet->xDlClose =          sqlite3ShimDlClose;
+  pRet->xRandomness =       sqlite3ShimRandomness;
+  pRet->xSleep =            sqlite3ShimSleep;
+  pRet->xCurrentTime =      sqlite3ShimCurrentTime;
+  pRet->xGetLastError =     sqlite3ShimGetLastError;
+  pRet->xCurrentTimeInt64 = sqlite3ShimCurrentTimeInt64;
+
+  sqlite3_vfs_register(pRet, 0);
+
+  *ppVfs = pRet;
+
+  return SQLITE_OK;
+}
+
+static void sqlite3ShimUnregister(sqlite3_vfs* pVfs) {
+  sqlite3_vfs_unregister(pVfs);
+  sqlite3_free(pVfs->pAppData);
+  sqlite3_free(pVfs);
+}
+
+// Helpers for invoking the methods of the underlying VFS and files from Go.
+
+static int shimRootDelete(sqlite3_vfs *pVfs, char *zName, int dirSync){
+  return SHIM_ROOT(pVfs)->xDelete(SHIM_ROOT(pVfs), zName, dirSync);
+}
+
+static int shimRootOpen(sqlite3_vfs *pVfs, char *zName, int flags, sqlite3_file **ppReal){
+  sqlite3_vfs *pRoot = SHIM_ROOT(pVfs);
+  sqlite3_file *pReal;
+  int rc;
+
+  pReal = (sqlite3_file*)sqlite3_malloc(pRoot->szOsFile);
+  if( !pReal ){
+    return SQLITE_NOMEM;
+  }
+  memset(pReal, 0, pRoot->szOsFile);
+
+  rc = pRoot->xOpen(pRoot, zName, pReal, flags, 0);
+  if( rc!=SQLITE_OK ){
+    if( pReal->pMethods ){
+      pReal->pMethods->xClose(pReal);
+    }
+    sqlite3_free(pReal);
+    return rc;
+  }
+
+  *ppReal = pReal;
+
+  return SQLITE_OK;
+}
+
+static void shimRealClose(sqlite3_file *pReal){
+  pReal->pMethods->xClose(pReal);
+  sqlite3_free(pReal);
+}
+
+static int shimRealLock(sqlite3_file *pReal, int eLock){
+  return pReal->pMethods->xLock(pReal, eLock);
+}
+
+static int shimRealUnlock(sqlite3_file *pReal, int eLock){
+  return pReal->pMethods->xUnlock(pReal, eLock);
+}
+
+static int shimRealRead(sqlite3_file *pReal, void *zBuf, int iAmt, sqlite_int64 iOfst){
+  return pReal->pMethods->xRead(pReal, zBuf, iAmt, iOfst);
+}
+
+static int shimRealWrite(sqlite3_file *pReal, void *zBuf, int iAmt, sqlite_int64 iOfst){
+  return pReal->pMethods->xWrite(pReal, zBuf, iAmt, iOfst);
+}
+
+static int shimRealTruncate(sqlite3_file *pReal, sqlite_int64 size){
+  return pReal->pMethods->xTruncate(pReal, size);
+}
+
+static int shimRealSync(sqlite3_file *pReal, int flags){
+  return pReal->pMethods->xSync(pReal, flags);
+}
+
+static int shimRealFileSize(sqlite3_file *pReal, sqlite_int64 *pSize){
+  return pReal->pMethods->xFileSize(pReal, pSize);
+}
+
+static int shimRealSectorSize(sqlite3_file *pReal){
+  return pReal->pMethods->xSectorSize(pReal);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// Hooks that a shim VFS uses to intercept the I/O performed through its
+// underlying VFS.
+//
+// Operations not covered by these hooks (locking, shared memory, etc) are
+// always passed through to the underlying VFS as they are.
+type shimHooks interface {
+	Open(file *shimFile) C.int
+	Close(file *shimFile) C.int
+	Read(file *shimFile, buf []byte, offset int64) C.int
+	Write(file *shimFile, buf []byte, offset int64) C.int
+	Truncate(file *shimFile, size int64) C.int
+	Sync(file *shimFile, flags C.int) C.int
+	FileSize(file *shimFile) (int64, C.int)
+	FileControl(file *shimFile, op C.int, pArg unsafe.Pointer) C.int
+	SectorSize(file *shimFile, size C.int) C.int
+	DeviceCharacteristics(file *shimFile, flags C.int) C.int
+	Delete(vfs *shimVFS, name string, dirSync C.int) C.int
+}
+
+// Implementation of shimHooks that passes everything through to the
+// underlying VFS. Shims can embed it and override only the hooks they need.
+type shimPassthrough struct{}
+
+func (shimPassthrough) Open(file *shimFile) C.int {
+	return C.SQLITE_OK
+}
+
+func (shimPassthrough) Close(file *shimFile) C.int {
+	return C.SQLITE_OK
+}
+
+func (shimPassthrough) Read(file *shimFile, buf []byte, offset int64) C.int {
+	return file.Read(buf, offset)
+}
+
+func (shimPassthrough) Write(file *shimFile, buf []byte, offset int64) C.int {
+	return file.Write(buf, offset)
+}
+
+func (shimPassthrough) Truncate(file *shimFile, size int64) C.int {
+	return file.Truncate(size)
+}
+
+func (shimPassthrough) Sync(file *shimFile, flags C.int) C.int {
+	return file.Sync(flags)
+}
+
+func (shimPassthrough) FileSize(file *shimFile) (int64, C.int) {
+	return file.Size()
+}
+
+func (shimPassthrough) FileControl(file *shimFile, op C.int, pArg unsafe.Pointer) C.int {
+	return C.SQLITE_NOTFOUND
+}
+
+func (shimPassthrough) SectorSize(file *shimFile, size C.int) C.int {
+	return size
+}
+
+func (shimPassthrough) DeviceCharacteristics(file *shimFile, flags C.int) C.int {
+	return flags
+}
+
+func (shimPassthrough) Delete(vfs *shimVFS, name string, dirSync C.int) C.int {
+	return vfs.Delete(name, dirSync)
+}
+
+// Register a new shim VFS under the given name, stacked on top of the VFS
+// with the given base name (or the default VFS if base is empty).
+func registerShimVFS(name string, base string, hooks shimHooks) (*shimVFS, error) {
+	shimVFSLock.Lock()
+	defer shimVFSLock.Unlock()
+
+	iVfs := shimVFSHandles
+	shimVFSHandles++
+
+	vfs := &shimVFS{
+		zName: C.CString(name),
+		hooks: hooks,
+		files: make(map[C.int]*shimFile),
+	}
+
+	var zBase *C.char
+	if base != "" {
+		zBase = C.CString(base)
+		defer C.free(unsafe.Pointer(zBase))
+	}
+
+	rc := C.sqlite3ShimRegister(vfs.zName, zBase, iVfs, &vfs.pVfs)
+	switch rc {
+	case C.SQLITE_OK:
+	case C.SQLITE_NOTFOUND:
+		C.free(unsafe.Pointer(vfs.zName))
+		return nil, fmt.Errorf("no such VFS: %s", base)
+	default:
+		panic("out of memory")
+	}
+
+	shimVFSs[iVfs] = vfs
+
+	return vfs, nil
+}
+
+// Unregister the given shim VFS.
+func unregisterShimVFS(vfs *shimVFS) {
+	shimVFSLock.Lock()
+	defer shimVFSLock.Unlock()
+
+	for iVfs := range shimVFSs {
+		if shimVFSs[iVfs] == vfs {
+			C.sqlite3ShimUnregister(vfs.pVfs)
+			C.free(unsafe.Pointer(vfs.zName))
+			delete(shimVFSs, iVfs)
+			return
+		}
+	}
+
+	panic("unknown shim file system")
+}
+
+// Global registry of shimVFS instances.
+var shimVFSLock sync.RWMutex
+var shimVFSs = make(map[C.int]*shimVFS)
+var shimVFSHandles C.int
+
+// A VFS stacked on top of another VFS.
+type shimVFS struct {
+	mu     sync.RWMutex
+	zName  *C.char             // C string used for registration.
+	pVfs   *C.sqlite3_vfs      // Registered VFS object.
+	hooks  shimHooks           // Shim implementation.
+	files  map[C.int]*shimFile // Map C-land open file numbers to files objects.
+	serial C.int               // Serial number for file numbers, increasing monotonically.
+}
+
+// Name returns the name the shim was registered with.
+func (vfs *shimVFS) Name() string {
+	return C.GoString(vfs.zName)
+}
+
+// Delete the file with the given name using the underlying VFS.
+func (vfs *shimVFS) Delete(name string, dirSync C.int) C.int {
+	zName := C.CString(name)
+	defer C.free(unsafe.Pointer(zName))
+
+	return C.shimRootDelete(vfs.pVfs, zName, dirSync)
+}
+
+// OpenDirect opens the file with the given name using the underlying VFS,
+// bypassing the shim, so it can be accessed outside of SQLite. The file must
+// be released with CloseDirect.
+func (vfs *shimVFS) OpenDirect(name string, flags C.int) (*shimFile, C.int) {
+	// The name must stay valid until the file is closed and, like the names
+	// passed by SQLite, end with an empty list of URI parameters.
+	zName := C.CString(name + "\x00")
+
+	var pReal *C.sqlite3_file
+	if rc := C.shimRootOpen(vfs.pVfs, zName, flags, &pReal); rc != C.SQLITE_OK {
+		C.free(unsafe.Pointer(zName))
+		return nil, rc
+	}
+
+	file := &shimFile{
+		name:  name,
+		zName: zName,
+		flags: flags,
+		pReal: pReal,
+	}
+
+	return file, C.SQLITE_OK
+}
+
+// Track a new open file.
+func (vfs *shimVFS) add(file *shimFile) C.int {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	iFd := vfs.serial
+	vfs.files[iFd] = file
+	vfs.serial++
+
+	return iFd
+}
+
+// Stop tracking an open file.
+func (vfs *shimVFS) remove(iFd C.int) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	delete(vfs.files, iFd)
+}
+
+// File returns the open file with the given number.
+func (vfs *shimVFS) File(iFd C.int) (*shimFile, bool) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	file, ok := vfs.files[iFd]
+	return file, ok
+}
+
+// A file opened through a shim VFS.
+type shimFile struct {
+	name  string          // Name of the file, empty for temporary files.
+	zName *C.char         // Name of the file as passed by SQLite, valid until close.
+	flags C.int           // Flags the file was opened with.
+	pReal *C.sqlite3_file // Underlying file.
+	data  interface{}     // Shim-specific state.
+}
+
+// URIParameter returns the value of the URI parameter with the given key
+// that the database was opened with, or "" if it's not set. Only database
+// files carry URI parameters.
+func (f *shimFile) URIParameter(key string) string {
+	if f.zName == nil || f.flags&C.SQLITE_OPEN_MAIN_DB == 0 {
+		return ""
+	}
+
+	zKey := C.CString(key)
+	defer C.free(unsafe.Pointer(zKey))
+
+	zValue := C.sqlite3_uri_parameter(f.zName, zKey)
+	if zValue == nil {
+		return ""
+	}
+
+	return C.GoString(zValue)
+}
+
+// Read data from the underlying file.
+func (f *shimFile) Read(buf []byte, offset int64) C.int {
+	if len(buf) == 0 {
+		return C.SQLITE_OK
+	}
+	return C.shimRealRead(f.pReal, unsafe.Pointer(&buf[0]), C.int(len(buf)), C.sqlite_int64(offset))
+}
+
+// Write data to the underlying file.
+func (f *shimFile) Write(buf []byte, offset int64) C.int {
+	if len(buf) == 0 {
+		return C.SQLITE_OK
+	}
+	return C.shimRealWrite(f.pReal, unsafe.Pointer(&buf[0]), C.int(len(buf)), C.sqlite_int64(offset))
+}
+
+// Truncate the underlying file.
+func (f *shimFile) Truncate(size int64) C.int {
+	return C.shimRealTruncate(f.pReal, C.sqlite_int64(size))
+}
+
+// Sync the underlying file.
+func (f *shimFile) Sync(flags C.int) C.int {
+	return C.shimRealSync(f.pReal, flags)
+}
+
+// Size returns the size of the underlying file.
+func (f *shimFile) Size() (int64, C.int) {
+	var size C.sqlite_int64
+	rc := C.shimRealFileSize(f.pReal, &size)
+	return int64(size), rc
+}
+
+// SectorSize returns the sector size of the underlying file.
+func (f *shimFile) SectorSize() int {
+	size := int(C.shimRealSectorSize(f.pReal))
+	if size < 32 {
+		// Same default as sqlite3SectorSize() in os.c.
+		size = 512
+	}
+	return size
+}
+
+// Lock the underlying file.
+func (f *shimFile) Lock(lock C.int) C.int {
+	return C.shimRealLock(f.pReal, lock)
+}
+
+// Unlock the underlying file.
+func (f *shimFile) Unlock(lock C.int) C.int {
+	return C.shimRealUnlock(f.pReal, lock)
+}
+
+// CloseDirect closes a file opened with shimVFS.OpenDirect.
+func (f *shimFile) CloseDirect() {
+	C.shimRealClose(f.pReal)
+	C.free(unsafe.Pointer(f.zName))
+}
+
+// Return a byte slice backed by the given C buffer.
+func shimBuffer(zBuf unsafe.Pointer, n C.int) []byte {
+	if n == 0 {
+		return nil
+	}
+	return (*[1 << 30]byte)(zBuf)[:n:n]
+}
+
+func shimFindVFS(iVfs C.int) (*shimVFS, bool) {
+	shimVFSLock.RLock()
+	defer shimVFSLock.RUnlock()
+
+	vfs, ok := shimVFSs[iVfs]
+	return vfs, ok
+}
+
+func shimFindFile(iVfs C.int, iFd C.int) (*shimVFS, *shimFile, C.int) {
+	vfs, ok := shimFindVFS(iVfs)
+	if !ok {
+		return nil, nil, C.SQLITE_IOERR
+	}
+
+	file, ok := vfs.File(iFd)
+	if !ok {
+		return nil, nil, C.SQLITE_IOERR
+	}
+
+	return vfs, file, C.SQLITE_OK
+}
+
+//export shimOpen
+func shimOpen(iVfs C.int, zName *C.char, pReal *C.sqlite3_file, flags C.int, piFd *C.int) C.int {
+	vfs, ok := shimFindVFS(iVfs)
+	if !ok {
+		return C.SQLITE_CANTOPEN
+	}
+
+	file := &shimFile{
+		zName: zName,
+		flags: flags,
+		pReal: pReal,
+	}
+	if zName != nil {
+		file.name = C.GoString(zName)
+	}
+
+	if rc := vfs.hooks.Open(file); rc != C.SQLITE_OK {
+		return rc
+	}
+
+	*piFd = vfs.add(file)
+
+	return C.SQLITE_OK
+}
+
+//export shimDelete
+func shimDelete(iVfs C.int, zName *C.char, dirSync C.int) C.int {
+	vfs, ok := shimFindVFS(iVfs)
+	if !ok {
+		return C.SQLITE_IOERR_DELETE
+	}
+
+	return vfs.hooks.Delete(vfs, C.GoString(zName), dirSync)
+}
+
+//export shimClose
+func shimClose(iVfs C.int, iFd C.int) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_CLOSE
+	}
+
+	rc = vfs.hooks.Close(file)
+	vfs.remove(iFd)
+
+	return rc
+}
+
+//export shimRead
+func shimRead(iVfs C.int, iFd C.int, zBuf unsafe.Pointer, iAmt C.int, iOfst C.sqlite_int64) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_READ
+	}
+
+	return vfs.hooks.Read(file, shimBuffer(zBuf, iAmt), int64(iOfst))
+}
+
+//export shimWrite
+func shimWrite(iVfs C.int, iFd C.int, zBuf unsafe.Pointer, iAmt C.int, iOfst C.sqlite_int64) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_WRITE
+	}
+
+	return vfs.hooks.Write(file, shimBuffer(zBuf, iAmt), int64(iOfst))
+}
+
+//export shimTruncate
+func shimTruncate(iVfs C.int, iFd C.int, size C.sqlite_int64) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_TRUNCATE
+	}
+
+	return vfs.hooks.Truncate(file, int64(size))
+}
+
+//export shimSync
+func shimSync(iVfs C.int, iFd C.int, flags C.int) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_FSYNC
+	}
+
+	return vfs.hooks.Sync(file, flags)
+}
+
+//export shimFileSize
+func shimFileSize(iVfs C.int, iFd C.int, pSize *C.sqlite_int64) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return C.SQLITE_IOERR_FSTAT
+	}
+
+	size, rc := vfs.hooks.FileSize(file)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	*pSize = C.sqlite_int64(size)
+
+	return C.SQLITE_OK
+}
+
+//export shimFileControl
+func shimFileControl(iVfs C.int, iFd C.int, op C.int, pArg unsafe.Pointer) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	return vfs.hooks.FileControl(file, op, pArg)
+}
+
+//export shimSectorSize
+func shimSectorSize(iVfs C.int, iFd C.int, size C.int) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return size
+	}
+
+	return vfs.hooks.SectorSize(file, size)
+}
+
+//export shimDeviceCharacteristics
+func shimDeviceCharacteristics(iVfs C.int, iFd C.int, flags C.int) C.int {
+	vfs, file, rc := shimFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return flags
+	}
+
+	return vfs.hooks.DeviceCharacteristics(file, flags)
+}
@@ -142,10 +142,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
 	"reflect"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -200,13 +198,22 @@ type SQLiteConn struct {
 	db          *C.sqlite3
 	loc         *time.Location
 	txlock      string
+	busyTimeout int
 	funcs       []*functionInfo
 	aggregators []*aggInfo
+
+	savepointRollbackHook func(string)
+
+	budget   StatementBudget // Default budget of statements.
+	progress *progressState  // State of the progress handler.
 }
 
 // SQLiteTx implemen sql.Tx.
 type SQLiteTx struct {
-	c *SQLiteConn
+	c          *SQLiteConn
+	pragmas    []Pragma           // Pragmas to restore when the transaction ends.
+	savepoints []*SQLiteSavepoint // Active savepoints, innermost last.
+	done       bool               // Whether the transaction was committed or rolled back.
 }
 
 // SQLiteStmt implement sql.Stmt.
@@ -233,7 +240,7 @@ type SQLiteRows struct {
 	decltype []string
 	cls      bool
 	closed   bool
-	done     chan struct{}
+	run      *statementRun
 }
 
 type functionInfo struct {
@@ -339,19 +346,53 @@ func (ai *aggInfo) Done(ctx *C.sqlite3_context) {
 
 // Commit transaction.
 func (tx *SQLiteTx) Commit() error {
-	_, err := tx.c.exec(context.Background(), "COMMIT", nil)
+	_, err := tx.c.exec(internalContext, "COMMIT", nil)
 	if err != nil && err.(Error).Code == C.SQLITE_BUSY {
 		// sqlite3 will leave the transaction open in this scenario.
 		// However, database/sql considers the transaction complete once we
 		// return from Commit() - we must clean up to honour its semantics.
-		tx.c.exec(context.Background(), "ROLLBACK", nil)
+		tx.c.exec(internalContext, "ROLLBACK", nil)
 	}
+	tx.done = true
+	// The outcome of the commit doesn't depend on restoring the pragmas. If
+	// that fails the connection is closed, and ResetSession reports it as
+	// bad to database/sql.
+	tx.restore()
 	return err
 }
 
 // Rollback transaction.
 func (tx *SQLiteTx) Rollback() error {
-	_, err := tx.c.exec(context.Background(), "ROLLBACK", nil)
+	_, err := tx.c.exec(internalContext, "ROLLBACK", nil)
+	tx.done = true
+	if restoreErr := tx.restore(); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// Restore the pragmas changed for the duration of the transaction, and
+// deactivate its savepoints.
+//
+// If a pragma can't be restored the connection is closed, since it would
+// otherwise keep the settings of the transaction, for example staying
+// read-only forever.
+func (tx *SQLiteTx) restore() error {
+	tx.popSavepoints(0)
+
+	var err error
+	for i := len(tx.pragmas) - 1; i >= 0; i-- {
+		pragma := tx.pragmas[i]
+		query := fmt.Sprintf("PRAGMA %s = %s", pragma.Name, pragma.Value)
+		if _, e := tx.c.exec(internalContext, query, nil); e != nil && err == nil {
+			err = fmt.Errorf("failed to restore pragma %s: %v: connection closed", pragma.Name, e)
+		}
+	}
+	tx.pragmas = nil
+
+	if err != nil {
+		tx.c.Close()
+	}
 	return err
 }
 
@@ -752,10 +793,48 @@ func (c *SQLiteConn) Begin() (driver.Tx, error) {
 }
 
 func (c *SQLiteConn) begin(ctx context.Context) (driver.Tx, error) {
-	if _, err := c.exec(ctx, c.txlock, nil); err != nil {
+	return c.beginWith(ctx, c.txlock, nil)
+}
+
+// Begin a transaction with the given statement, after setting the given
+// pragmas. The pragmas are restored to their previous values when the
+// transaction ends.
+func (c *SQLiteConn) beginWith(ctx context.Context, begin string, pragmas []Pragma) (driver.Tx, error) {
+	// The statements run here are not subject to budgets, but they can
+	// still be canceled.
+	ctx = WithStatementBudget(ctx, StatementBudget{})
+
+	tx := &SQLiteTx{c: c}
+	for _, pragma := range pragmas {
+		value, err := c.pragma(pragma.Name)
+		if err != nil {
+			tx.restore()
+			return nil, err
+		}
+		if value == pragma.Value {
+			continue
+		}
+		query := fmt.Sprintf("PRAGMA %s = %s", pragma.Name, pragma.Value)
+		if _, err := c.exec(ctx, query, nil); err != nil {
+			tx.restore()
+			return nil, err
+		}
+		tx.pragmas = append(tx.pragmas, Pragma{Name: pragma.Name, Value: value})
+	}
+
+	if hasContextSnapshot(ctx) {
+		begin = "BEGIN"
+	}
+	if _, err := c.exec(ctx, begin, nil); err != nil {
+		tx.restore()
+		return nil, err
+	}
+	if err := c.openContextSnapshot(ctx); err != nil {
+		c.exec(internalContext, "ROLLBACK", nil)
+		tx.restore()
 		return nil, err
 	}
-	return &SQLiteTx{c}, nil
+	return tx, nil
 }
 
 func errorString(err Error) string {
@@ -780,151 +859,123 @@ func errorString(err Error) string {
 //     Enable or disable enforcement of foreign keys.  X can be 1 or 0.
 //   _recursive_triggers=X
 //     Enable or disable recursive triggers.  X can be 1 or 0.
+//   _vfs=XXX
+//     Name of the VFS used to open the database, which must be registered.
+//   _mode=XXX
+//     Open the database read-only with "ro", or without creating it with
+//     "rw". The default is "rwc".
+//   _mutex=XXX
+//     Specify threading mode of the connection.  XXX can be "full" or "no".
+//   _cache=XXX
+//     Enable or disable shared cache.  XXX can be "shared" or "private".
+//   _budget_steps=N, _budget_time=N
+//     Interrupt statements running more than N virtual machine
+//     instructions, or for more than N milliseconds. See StatementBudget.
+//   _journal_mode=XXX, _synchronous=XXX, _cache_size=N, _temp_store=XXX,
+//   _mmap_size=N, _secure_delete=XXX, _auto_vacuum=XXX,
+//   _case_sensitive_like=X, _query_only=X, _wal_autocheckpoint=N,
+//   _locking_mode=XXX
+//     Set the pragma with the same name. Pragmas are validated, run in an
+//     order that makes them effective, and verified. See Config.Pragmas.
+// See ParseDSN and Config for building connections without a DSN.
 func (d *SQLiteDriver) Open(dsn string) (driver.Conn, error) {
-	if C.sqlite3_threadsafe() == 0 {
-		return nil, errors.New("sqlite library was not compiled for thread-safe operation")
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
 	}
+	cfg.Extensions = d.Extensions
+	cfg.ConnectHook = d.ConnectHook
 
-	var loc *time.Location
-	txlock := "BEGIN"
-	busyTimeout := 5000
-	foreignKeys := -1
-	recursiveTriggers := -1
-	pos := strings.IndexRune(dsn, '?')
-	if pos >= 1 {
-		params, err := url.ParseQuery(dsn[pos+1:])
-		if err != nil {
-			return nil, err
-		}
-
-		// _loc
-		if val := params.Get("_loc"); val != "" {
-			if val == "auto" {
-				loc = time.Local
-			} else {
-				loc, err = time.LoadLocation(val)
-				if err != nil {
-					return nil, fmt.Errorf("Invalid _loc: %v: %v", val, err)
-				}
-			}
-		}
-
-		// _busy_timeout
-		if val := params.Get("_busy_timeout"); val != "" {
-			iv, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("Invalid _busy_timeout: %v: %v", val, err)
-			}
-			busyTimeout = int(iv)
-		}
+	conn, err := openConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
 
-		// _txlock
-		if val := params.Get("_txlock"); val != "" {
-			switch val {
-			case "immediate":
-				txlock = "BEGIN IMMEDIATE"
-			case "exclusive":
-				txlock = "BEGIN EXCLUSIVE"
-			case "deferred":
-				txlock = "BEGIN"
-			default:
-				return nil, fmt.Errorf("Invalid _txlock: %v", val)
-			}
-		}
+// Open a new connection with the given configuration.
+func openConfig(cfg *Config) (*SQLiteConn, error) {
+	if C.sqlite3_threadsafe() == 0 {
+		return nil, errors.New("sqlite library was not compiled for thread-safe operation")
+	}
 
-		// _foreign_keys
-		if val := params.Get("_foreign_keys"); val != "" {
-			switch val {
-			case "1":
-				foreignKeys = 1
-			case "0":
-				foreignKeys = 0
-			default:
-				return nil, fmt.Errorf("Invalid _foreign_keys: %v", val)
-			}
-		}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 
-		// _recursive_triggers
-		if val := params.Get("_recursive_triggers"); val != "" {
-			switch val {
-			case "1":
-				recursiveTriggers = 1
-			case "0":
-				recursiveTriggers = 0
-			default:
-				return nil, fmt.Errorf("Invalid _recursive_triggers: %v", val)
-			}
+	var vfs *C.char
+	if cfg.VFS != "" {
+		vfs = C.CString(cfg.VFS)
+		defer C.free(unsafe.Pointer(vfs))
+		if C.sqlite3_vfs_find(vfs) == nil {
+			return nil, fmt.Errorf("no such VFS: %s", cfg.VFS)
 		}
+	}
 
-		if !strings.HasPrefix(dsn, "file:") {
-			dsn = dsn[:pos]
-		}
+	flags := C.int(C.SQLITE_OPEN_FULLMUTEX)
+	if cfg.NoMutex {
+		flags = C.SQLITE_OPEN_NOMUTEX
+	}
+	switch {
+	case cfg.ReadOnly:
+		flags |= C.SQLITE_OPEN_READONLY
+	case cfg.NoCreate:
+		flags |= C.SQLITE_OPEN_READWRITE
+	default:
+		flags |= C.SQLITE_OPEN_READWRITE | C.SQLITE_OPEN_CREATE
+	}
+	switch cfg.Cache {
+	case "shared":
+		flags |= C.SQLITE_OPEN_SHAREDCACHE
+	case "private":
+		flags |= C.SQLITE_OPEN_PRIVATECACHE
 	}
 
 	var db *C.sqlite3
-	name := C.CString(dsn)
+	name := C.CString(cfg.Filename)
 	defer C.free(unsafe.Pointer(name))
-	rv := C._sqlite3_open_v2(name, &db,
-		C.SQLITE_OPEN_FULLMUTEX|
-			C.SQLITE_OPEN_READWRITE|
-			C.SQLITE_OPEN_CREATE,
-		nil)
+	rv := C._sqlite3_open_v2(name, &db, flags, vfs)
 	if rv != 0 {
+		// A handle is allocated even on failure, and must be released.
+		if db != nil {
+			C.sqlite3_close_v2(db)
+		}
 		return nil, Error{Code: ErrNo(rv)}
 	}
 	if db == nil {
 		return nil, errors.New("sqlite succeeded without returning a database")
 	}
 
+	busyTimeout := int(cfg.BusyTimeout / time.Millisecond)
 	rv = C.sqlite3_busy_timeout(db, C.int(busyTimeout))
 	if rv != C.SQLITE_OK {
 		C.sqlite3_close_v2(db)
 		return nil, Error{Code: ErrNo(rv)}
 	}
 
-	exec := func(s string) error {
-		cs := C.CString(s)
-		rv := C.sqlite3_exec(db, cs, nil, nil, nil)
-		C.free(unsafe.Pointer(cs))
-		if rv != C.SQLITE_OK {
-			return lastError(db)
-		}
-		return nil
-	}
-	if foreignKeys == 0 {
-		if err := exec("PRAGMA foreign_keys = OFF;"); err != nil {
-			C.sqlite3_close_v2(db)
-			return nil, err
-		}
-	} else if foreignKeys == 1 {
-		if err := exec("PRAGMA foreign_keys = ON;"); err != nil {
-			C.sqlite3_close_v2(db)
-			return nil, err
-		}
-	}
-	if recursiveTriggers == 0 {
-		if err := exec("PRAGMA recursive_triggers = OFF;"); err != nil {
-			C.sqlite3_close_v2(db)
-			return nil, err
-		}
-	} else if recursiveTriggers == 1 {
-		if err := exec("PRAGMA recursive_triggers = ON;"); err != nil {
-			C.sqlite3_close_v2(db)
-			return nil, err
-		}
+	conn := &SQLiteConn{
+		db:          db,
+		loc:         cfg.Location,
+		txlock:      cfg.beginStatement(),
+		busyTimeout: busyTimeout,
+		budget:      cfg.Budget,
+		progress:    &progressState{},
 	}
 
-	conn := &SQLiteConn{db: db, loc: loc, txlock: txlock}
+	if err := conn.setPragmas(cfg.Pragmas); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	if len(d.Extensions) > 0 {
-		if err := conn.loadExtensions(d.Extensions); err != nil {
+	if len(cfg.Extensions) > 0 {
+		if err := conn.loadExtensions(cfg.Extensions); err != nil {
 			conn.Close()
 			return nil, err
 		}
 	}
 
-	if d.ConnectHook != nil {
-		if err := d.ConnectHook(conn); err != nil {
+	if cfg.ConnectHook != nil {
+		if err := cfg.ConnectHook(conn); err != nil {
 			conn.Close()
 			return nil, err
 		}
@@ -940,6 +991,7 @@ func (c *SQLiteConn) Close() error {
 		return c.lastError()
 	}
 	deleteHandles(c)
+	deleteProgressHandle(c.progress)
 	c.mu.Lock()
 	c.db = nil
 	c.mu.Unlock()
@@ -1118,22 +1170,9 @@ func (s *SQLiteStmt) query(ctx context.Context, args []namedValue) (driver.Rows,
 		decltype: nil,
 		cls:      s.cls,
 		closed:   false,
-		done:     make(chan struct{}),
+		run:      s.c.newRun(ctx),
 	}
 
-	go func(db *C.sqlite3) {
-		select {
-		case <-ctx.Done():
-			select {
-			case <-rows.done:
-			default:
-				C.sqlite3_interrupt(db)
-				rows.Close()
-			}
-		case <-rows.done:
-		}
-	}(s.c.db)
-
 	return rows, nil
 }
 
@@ -1166,24 +1205,13 @@ func (s *SQLiteStmt) exec(ctx context.Context, args []namedValue) (driver.Result
 		return nil, err
 	}
 
-	done := make(chan struct{})
-	defer close(done)
-	go func(db *C.sqlite3) {
-		select {
-		case <-done:
-		case <-ctx.Done():
-			select {
-			case <-done:
-			default:
-				C.sqlite3_interrupt(db)
-			}
-		}
-	}(s.c.db)
-
 	var rowid, changes C.longlong
-	rv := C._sqlite3_step(s.s, &rowid, &changes)
+	run := s.c.newRun(ctx)
+	rv := s.c.step(run, func() C.int {
+		return C._sqlite3_step(s.s, &rowid, &changes)
+	})
 	if rv != C.SQLITE_ROW && rv != C.SQLITE_OK && rv != C.SQLITE_DONE {
-		err := s.c.lastError()
+		err := s.c.stepError(run, rv)
 		C.sqlite3_reset(s.s)
 		C.sqlite3_clear_bindings(s.s)
 		return nil, err
@@ -1200,9 +1228,6 @@ func (rc *SQLiteRows) Close() error {
 		return nil
 	}
 	rc.closed = true
-	if rc.done != nil {
-		close(rc.done)
-	}
 	if rc.cls {
 		rc.s.mu.Unlock()
 		return rc.s.Close()
@@ -1253,16 +1278,16 @@ func (rc *SQLiteRows) Next(dest []driver.Value) error {
 	}
 	rc.s.mu.Lock()
 	defer rc.s.mu.Unlock()
-	rv := C.sqlite3_step(rc.s.s)
+	rv := rc.s.c.step(rc.run, func() C.int {
+		return C.sqlite3_step(rc.s.s)
+	})
 	if rv == C.SQLITE_DONE {
 		return io.EOF
 	}
 	if rv != C.SQLITE_ROW {
-		rv = C.sqlite3_reset(rc.s.s)
-		if rv != C.SQLITE_OK {
-			return rc.s.c.lastError()
-		}
-		return nil
+		err := rc.s.c.stepError(rc.run, rv)
+		C.sqlite3_reset(rc.s.s)
+		return err
 	}
 
 	rc.declTypes()
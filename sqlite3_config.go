@@ -0,0 +1,481 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings used to open a connection. It can be built by
+// hand, starting from NewConfig, or parsed from a DSN with ParseDSN.
+type Config struct {
+	// Name of the database file, or a "file:" URI. Query parameters of the
+	// URI that are understood by SQLite itself, like "mode" or "cache",
+	// are kept here.
+	Filename string
+
+	// Time zone that timestamps read from the database are converted to.
+	// If nil, they keep the time zone they were stored with. DSN parameter
+	// _loc, where "auto" means time.Local.
+	Location *time.Location
+
+	// Time to wait for locks held by other connections, passed to
+	// sqlite3_busy_timeout. DSN parameter _busy_timeout, in milliseconds.
+	BusyTimeout time.Duration
+
+	// Locking behavior of transactions, either "deferred", "immediate" or
+	// "exclusive". Empty means "deferred". DSN parameter _txlock.
+	TxLock string
+
+	// Name of the VFS used to open the database, or empty for the default
+	// one. Opening fails if no VFS with this name is registered, for
+	// example with RegisterVolatileFileSystem. DSN parameter _vfs.
+	VFS string
+
+	// Open the database in read-only mode. DSN parameter _mode=ro.
+	ReadOnly bool
+
+	// Fail instead of creating the database if it doesn't exist. Implied
+	// by ReadOnly. DSN parameter _mode=rw.
+	NoCreate bool
+
+	// Open the connection in multi-thread mode instead of serialized mode,
+	// so SQLite doesn't lock its mutex around every call. The connection
+	// must then never be used by more than one goroutine at a time, which
+	// rules out for example WalCheckpointer. DSN parameter _mutex=no, the
+	// default being _mutex=full.
+	NoMutex bool
+
+	// Either "shared" or "private" to enable or disable shared cache mode,
+	// or empty to use the process default. DSN parameter _cache.
+	Cache string
+
+	// Budget of statements that don't have one attached to their context
+	// with WithStatementBudget. DSN parameters _budget_steps and
+	// _budget_time, in milliseconds.
+	Budget StatementBudget
+
+	// Pragmas run right after opening the connection. Each pragma has its
+	// own DSN parameter, named after it with a leading underscore, for
+	// example _journal_mode.
+	//
+	// Pragmas that must precede others run first, regardless of their
+	// position: locking_mode, then auto_vacuum, then journal_mode. The
+	// query_only pragma runs last. All others run in the given order.
+	// Each pragma is read back after being set, and opening fails if it
+	// didn't take effect. The busy timeout is set before any pragma, see
+	// BusyTimeout.
+	Pragmas []Pragma
+
+	// Extensions loaded after the pragmas are run. Not part of the DSN.
+	Extensions []string
+
+	// Invoked last, with the fully configured connection. Not part of the
+	// DSN.
+	ConnectHook func(*SQLiteConn) error
+}
+
+// Pragma is a pragma run when opening a connection.
+type Pragma struct {
+	Name  string
+	Value string
+}
+
+// Describe a pragma that can be set with Config.Pragmas.
+type configPragma struct {
+	// Pragmas run in increasing phase order, and in the given order within
+	// the same phase.
+	phase int
+
+	// Accepted values, mapped to the value returned when reading the
+	// pragma back. Nil for integer pragmas.
+	values map[string]string
+
+	// For integer pragmas, whether negative values are accepted.
+	negative bool
+
+	// Whether the pragma can't be read back, so it's not verified.
+	writeOnly bool
+}
+
+// Phases of configPragma. The locking mode must be set before switching to
+// WAL, for WAL databases in exclusive mode to work without shared memory.
+// Auto-vacuum can only be changed before the database is first written,
+// which switching the journal mode does. Query-only goes last, since it
+// prevents writes.
+const (
+	pragmaPhaseLockingMode = iota
+	pragmaPhaseAutoVacuum
+	pragmaPhaseJournalMode
+	pragmaPhaseDefault
+	pragmaPhaseQueryOnly
+)
+
+var boolPragmaValues = map[string]string{"0": "0", "1": "1"}
+
+// Pragmas that can be set with Config.Pragmas.
+var configPragmas = map[string]configPragma{
+	"auto_vacuum": {phase: pragmaPhaseAutoVacuum, values: map[string]string{
+		"none": "0", "full": "1", "incremental": "2", "0": "0", "1": "1", "2": "2",
+	}},
+	"cache_size":          {phase: pragmaPhaseDefault, negative: true},
+	"case_sensitive_like": {phase: pragmaPhaseDefault, values: boolPragmaValues, writeOnly: true},
+	"foreign_keys":        {phase: pragmaPhaseDefault, values: boolPragmaValues},
+	"journal_mode": {phase: pragmaPhaseJournalMode, values: map[string]string{
+		"delete": "delete", "truncate": "truncate", "persist": "persist",
+		"memory": "memory", "wal": "wal", "off": "off",
+	}},
+	"locking_mode": {phase: pragmaPhaseLockingMode, values: map[string]string{
+		"normal": "normal", "exclusive": "exclusive",
+	}},
+	"mmap_size":          {phase: pragmaPhaseDefault},
+	"query_only":         {phase: pragmaPhaseQueryOnly, values: boolPragmaValues},
+	"recursive_triggers": {phase: pragmaPhaseDefault, values: boolPragmaValues},
+	"secure_delete": {phase: pragmaPhaseDefault, values: map[string]string{
+		"0": "0", "1": "1", "fast": "2",
+	}},
+	"synchronous": {phase: pragmaPhaseDefault, values: map[string]string{
+		"off": "0", "normal": "1", "full": "2", "extra": "3", "0": "0", "1": "1", "2": "2", "3": "3",
+	}},
+	"temp_store": {phase: pragmaPhaseDefault, values: map[string]string{
+		"default": "0", "file": "1", "memory": "2", "0": "0", "1": "1", "2": "2",
+	}},
+	"wal_autocheckpoint": {phase: pragmaPhaseDefault},
+}
+
+// Return the value that reading the pragma back returns once the given
+// value is set, or an error if the value is not valid.
+func (p configPragma) expected(value string) (string, error) {
+	if p.values == nil {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("expected an integer")
+		}
+		if n < 0 && !p.negative {
+			return "", fmt.Errorf("expected a non-negative integer")
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+
+	expected, ok := p.values[strings.ToLower(value)]
+	if !ok {
+		accepted := make([]string, 0, len(p.values))
+		for value := range p.values {
+			accepted = append(accepted, value)
+		}
+		sort.Strings(accepted)
+		return "", fmt.Errorf("expected one of %s", strings.Join(accepted, ", "))
+	}
+	return expected, nil
+}
+
+// NewConfig returns a configuration for the given database file, with the
+// default settings used by SQLiteDriver.Open.
+func NewConfig(filename string) *Config {
+	return &Config{
+		Filename:    filename,
+		BusyTimeout: 5 * time.Second,
+		TxLock:      "deferred",
+	}
+}
+
+// ParseDSN parses a DSN accepted by SQLiteDriver.Open into a configuration.
+//
+// For "file:" URIs the query parameters not starting with an underscore are
+// kept in Config.Filename, so they are honored by SQLite. For plain file
+// names they are dropped.
+func ParseDSN(dsn string) (*Config, error) {
+	cfg := NewConfig(dsn)
+
+	pos := strings.IndexRune(dsn, '?')
+	if pos < 1 {
+		return cfg, nil
+	}
+
+	query := dsn[pos+1:]
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// _loc
+	if val := params.Get("_loc"); val != "" {
+		if val == "auto" {
+			cfg.Location = time.Local
+		} else {
+			cfg.Location, err = time.LoadLocation(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid _loc: %v: %v", val, err)
+			}
+		}
+	}
+
+	// _busy_timeout
+	if val := params.Get("_busy_timeout"); val != "" {
+		iv, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid _busy_timeout: %v: %v", val, err)
+		}
+		cfg.BusyTimeout = time.Duration(iv) * time.Millisecond
+	}
+
+	// _txlock
+	if val := params.Get("_txlock"); val != "" {
+		cfg.TxLock = val
+	}
+
+	// _vfs
+	if val := params.Get("_vfs"); val != "" {
+		cfg.VFS = val
+	}
+
+	// _mode
+	if val := params.Get("_mode"); val != "" {
+		switch val {
+		case "ro":
+			cfg.ReadOnly = true
+		case "rw":
+			cfg.NoCreate = true
+		case "rwc":
+		default:
+			return nil, fmt.Errorf("Invalid _mode: %v", val)
+		}
+	}
+
+	// _mutex
+	if val := params.Get("_mutex"); val != "" {
+		switch val {
+		case "no":
+			cfg.NoMutex = true
+		case "full":
+		default:
+			return nil, fmt.Errorf("Invalid _mutex: %v", val)
+		}
+	}
+
+	// _cache
+	if val := params.Get("_cache"); val != "" {
+		cfg.Cache = val
+	}
+
+	// _budget_steps
+	if val := params.Get("_budget_steps"); val != "" {
+		iv, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || iv < 0 {
+			return nil, fmt.Errorf("Invalid _budget_steps: %v", val)
+		}
+		cfg.Budget.MaxSteps = iv
+	}
+
+	// _budget_time
+	if val := params.Get("_budget_time"); val != "" {
+		iv, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || iv < 0 {
+			return nil, fmt.Errorf("Invalid _budget_time: %v", val)
+		}
+		cfg.Budget.MaxTime = time.Duration(iv) * time.Millisecond
+	}
+
+	// Pragmas, in the order they appear in the DSN.
+	for _, param := range strings.Split(query, "&") {
+		key := param
+		if i := strings.IndexRune(param, '='); i >= 0 {
+			key = param[:i]
+		}
+		name := strings.TrimPrefix(key, "_")
+		if _, ok := configPragmas[name]; !ok || name == key {
+			continue
+		}
+		if val := params.Get(key); val != "" && !cfg.hasPragma(name) {
+			cfg.Pragmas = append(cfg.Pragmas, Pragma{Name: name, Value: val})
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	cfg.Filename = dsn[:pos]
+	if strings.HasPrefix(dsn, "file:") {
+		kept := []string{}
+		for _, param := range strings.Split(query, "&") {
+			if param != "" && !strings.HasPrefix(param, "_") {
+				kept = append(kept, param)
+			}
+		}
+		if len(kept) > 0 {
+			cfg.Filename += "?" + strings.Join(kept, "&")
+		}
+	}
+
+	return cfg, nil
+}
+
+// FormatDSN returns a DSN that ParseDSN turns back into an equivalent
+// configuration, except for the fields that are not part of the DSN.
+func (cfg *Config) FormatDSN() string {
+	params := []string{}
+
+	if cfg.Location != nil {
+		loc := cfg.Location.String()
+		if cfg.Location == time.Local {
+			loc = "auto"
+		}
+		params = append(params, "_loc="+url.QueryEscape(loc))
+	}
+	params = append(params, fmt.Sprintf("_busy_timeout=%d", cfg.BusyTimeout/time.Millisecond))
+	if cfg.TxLock != "" {
+		params = append(params, "_txlock="+url.QueryEscape(cfg.TxLock))
+	}
+	if cfg.VFS != "" {
+		params = append(params, "_vfs="+url.QueryEscape(cfg.VFS))
+	}
+	if cfg.ReadOnly {
+		params = append(params, "_mode=ro")
+	} else if cfg.NoCreate {
+		params = append(params, "_mode=rw")
+	}
+	if cfg.NoMutex {
+		params = append(params, "_mutex=no")
+	}
+	if cfg.Cache != "" {
+		params = append(params, "_cache="+cfg.Cache)
+	}
+	if cfg.Budget.MaxSteps > 0 {
+		params = append(params, fmt.Sprintf("_budget_steps=%d", cfg.Budget.MaxSteps))
+	}
+	if cfg.Budget.MaxTime > 0 {
+		params = append(params, fmt.Sprintf("_budget_time=%d", cfg.Budget.MaxTime/time.Millisecond))
+	}
+	for _, pragma := range cfg.Pragmas {
+		params = append(params, "_"+pragma.Name+"="+url.QueryEscape(pragma.Value))
+	}
+
+	separator := "?"
+	if strings.ContainsRune(cfg.Filename, '?') {
+		separator = "&"
+	}
+
+	return cfg.Filename + separator + strings.Join(params, "&")
+}
+
+// Check that all settings have valid values.
+func (cfg *Config) validate() error {
+	switch cfg.TxLock {
+	case "", "deferred", "immediate", "exclusive":
+	default:
+		return fmt.Errorf("Invalid _txlock: %v", cfg.TxLock)
+	}
+
+	switch cfg.Cache {
+	case "", "shared", "private":
+	default:
+		return fmt.Errorf("Invalid _cache: %v", cfg.Cache)
+	}
+
+	for _, pragma := range cfg.Pragmas {
+		p, ok := configPragmas[pragma.Name]
+		if !ok {
+			return fmt.Errorf("Unsupported pragma: %v", pragma.Name)
+		}
+		if _, err := p.expected(pragma.Value); err != nil {
+			return fmt.Errorf("Invalid _%s: %v: %v", pragma.Name, pragma.Value, err)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) hasPragma(name string) bool {
+	for _, pragma := range cfg.Pragmas {
+		if pragma.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the statement used to begin transactions.
+func (cfg *Config) beginStatement() string {
+	switch cfg.TxLock {
+	case "immediate":
+		return "BEGIN IMMEDIATE"
+	case "exclusive":
+		return "BEGIN EXCLUSIVE"
+	}
+	return "BEGIN"
+}
+
+// Set the given pragmas, in the order of their phase, and verify that they
+// took effect.
+func (c *SQLiteConn) setPragmas(pragmas []Pragma) error {
+	sorted := make(pragmasByPhase, len(pragmas))
+	copy(sorted, pragmas)
+	sort.Stable(sorted)
+
+	for _, pragma := range sorted {
+		p := configPragmas[pragma.Name]
+		expected, err := p.expected(pragma.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid _%s: %v: %v", pragma.Name, pragma.Value, err)
+		}
+
+		query := fmt.Sprintf("PRAGMA %s = %s", pragma.Name, pragma.Value)
+		if _, err := c.exec(internalContext, query, nil); err != nil {
+			return err
+		}
+		if p.writeOnly {
+			continue
+		}
+
+		value, err := c.pragma(pragma.Name)
+		if err != nil {
+			return err
+		}
+		if value != expected {
+			return fmt.Errorf("Failed to set pragma %s to %s: it is %s", pragma.Name, pragma.Value, value)
+		}
+	}
+
+	return nil
+}
+
+// Sort pragmas by the phase they must run in.
+type pragmasByPhase []Pragma
+
+func (p pragmasByPhase) Len() int      { return len(p) }
+func (p pragmasByPhase) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pragmasByPhase) Less(i, j int) bool {
+	return configPragmas[p[i].Name].phase < configPragmas[p[j].Name].phase
+}
+
+// Return the current value of the given pragma.
+func (c *SQLiteConn) pragma(name string) (string, error) {
+	rows, err := c.query(internalContext, "PRAGMA "+name, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		if err == io.EOF {
+			return "", nil
+		}
+		return "", err
+	}
+
+	switch value := values[0].(type) {
+	case []byte:
+		return strings.ToLower(string(value)), nil
+	case string:
+		return strings.ToLower(value), nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
@@ -0,0 +1,265 @@
+package sqlite3
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDSN(t *testing.T) {
+	cfg, err := ParseDSN("file:test.db?mode=memory&_loc=auto&_busy_timeout=100&_txlock=immediate&_recursive_triggers=0&cache=shared&_foreign_keys=1")
+	if err != nil {
+		t.Fatal("failed to parse DSN", err)
+	}
+
+	expected := &Config{
+		Filename:    "file:test.db?mode=memory&cache=shared",
+		Location:    time.Local,
+		BusyTimeout: 100 * time.Millisecond,
+		TxLock:      "immediate",
+		Pragmas: []Pragma{
+			{Name: "recursive_triggers", Value: "0"},
+			{Name: "foreign_keys", Value: "1"},
+		},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+
+	cfg, err = ParseDSN("test.db?mode=memory")
+	if err != nil {
+		t.Fatal("failed to parse DSN", err)
+	}
+	if !reflect.DeepEqual(cfg, NewConfig("test.db")) {
+		t.Errorf("expected defaults for plain file name, got %+v", cfg)
+	}
+
+	for _, dsn := range []string{
+		"test.db?_loc=Nowhere/Bogus",
+		"test.db?_busy_timeout=abc",
+		"test.db?_txlock=bogus",
+		"test.db?_foreign_keys=yes",
+	} {
+		if _, err := ParseDSN(dsn); err == nil {
+			t.Errorf("expected parsing %q to fail", dsn)
+		}
+	}
+}
+
+func TestFormatDSN(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+
+	configs := []*Config{
+		NewConfig("test.db"),
+		NewConfig(":memory:"),
+		{
+			Filename:    "file:test.db?cache=shared",
+			Location:    loc,
+			BusyTimeout: 250 * time.Millisecond,
+			TxLock:      "exclusive",
+			VFS:         "volatile",
+			NoCreate:    true,
+			NoMutex:     true,
+			Cache:       "private",
+			Budget:      StatementBudget{MaxSteps: 5000, MaxTime: time.Second},
+			Pragmas: []Pragma{
+				{Name: "foreign_keys", Value: "1"},
+				{Name: "recursive_triggers", Value: "1"},
+			},
+		},
+		{Filename: "test.db", Location: time.Local, TxLock: "deferred", ReadOnly: true, Cache: "shared"},
+	}
+
+	for _, cfg := range configs {
+		dsn := cfg.FormatDSN()
+		parsed, err := ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to parse formatted DSN %q: %v", dsn, err)
+		}
+		if !reflect.DeepEqual(parsed, cfg) {
+			t.Errorf("DSN %q: expected %+v, got %+v", dsn, cfg, parsed)
+		}
+	}
+}
+
+func TestParseDSN_Pragmas(t *testing.T) {
+	cfg, err := ParseDSN("test.db?_journal_mode=WAL&_cache_size=-2000&_synchronous=normal&_mmap_size=0")
+	if err != nil {
+		t.Fatal("failed to parse DSN", err)
+	}
+	expected := []Pragma{
+		{Name: "journal_mode", Value: "WAL"},
+		{Name: "cache_size", Value: "-2000"},
+		{Name: "synchronous", Value: "normal"},
+		{Name: "mmap_size", Value: "0"},
+	}
+	if !reflect.DeepEqual(cfg.Pragmas, expected) {
+		t.Errorf("expected pragmas %+v, got %+v", expected, cfg.Pragmas)
+	}
+
+	for _, dsn := range []string{
+		"test.db?_journal_mode=bogus",
+		"test.db?_synchronous=4",
+		"test.db?_mmap_size=-1",
+		"test.db?_wal_autocheckpoint=many",
+		"test.db?_secure_delete=full",
+	} {
+		if _, err := ParseDSN(dsn); err == nil {
+			t.Errorf("expected parsing %q to fail", dsn)
+		}
+	}
+}
+
+// Pragmas run in an order that makes them effective, regardless of their
+// position in the DSN, and are verified.
+func TestOpenPragmas(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename + "?_query_only=1&_journal_mode=wal&_auto_vacuum=incremental&_locking_mode=exclusive" +
+		"&_synchronous=normal&_cache_size=-4000&_temp_store=memory&_secure_delete=fast&_wal_autocheckpoint=100" +
+		"&_case_sensitive_like=1&_foreign_keys=1")
+	if err != nil {
+		t.Fatal("failed to open connection", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	expected := map[string]string{
+		"journal_mode":       "wal",
+		"auto_vacuum":        "2",
+		"locking_mode":       "exclusive",
+		"synchronous":        "1",
+		"cache_size":         "-4000",
+		"temp_store":         "2",
+		"secure_delete":      "2",
+		"wal_autocheckpoint": "100",
+		"foreign_keys":       "1",
+		"query_only":         "1",
+	}
+	for name, value := range expected {
+		actual, err := conn.pragma(name)
+		if err != nil {
+			t.Fatal("failed to read pragma", err)
+		}
+		if actual != value {
+			t.Errorf("expected pragma %s to be %s, got %s", name, value, actual)
+		}
+	}
+}
+
+// Opening fails if a pragma didn't take effect.
+func TestOpenPragmas_NotEffective(t *testing.T) {
+	drv := &SQLiteDriver{}
+	_, err := drv.Open(":memory:?_journal_mode=wal")
+	if err == nil {
+		t.Fatal("expected WAL mode on in-memory database to fail")
+	}
+	if !strings.Contains(err.Error(), "journal_mode") || !strings.Contains(err.Error(), "memory") {
+		t.Errorf("expected error to report the actual journal mode, got %v", err)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+
+	drv := &SQLiteDriver{}
+	if _, err := drv.Open(tempFilename + "-missing?_mode=rw"); err == nil {
+		t.Fatal("expected opening missing database without create to fail")
+	}
+
+	conni, err := drv.Open(tempFilename + "?_mutex=no")
+	if err != nil {
+		t.Fatal("failed to open connection", err)
+	}
+	conn := conni.(*SQLiteConn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	conn.Close()
+
+	conni, err = drv.Open(tempFilename + "?_mode=ro")
+	if err != nil {
+		t.Fatal("failed to open read-only connection", err)
+	}
+	conn = conni.(*SQLiteConn)
+	defer conn.Close()
+	if _, err := conn.Exec("INSERT INTO test(n) VALUES(1)", nil); err == nil {
+		t.Error("expected insert on read-only connection to fail")
+	}
+	assertTestTableCount(t, conn, 0)
+
+	for _, dsn := range []string{
+		"test.db?_mode=rwx",
+		"test.db?_mutex=yes",
+		"test.db?_cache=none",
+		"test.db?_budget_steps=-1",
+		"test.db?_budget_time=soon",
+	} {
+		if _, err := ParseDSN(dsn); err == nil {
+			t.Errorf("expected parsing %q to fail", dsn)
+		}
+	}
+}
+
+// Connections with shared cache to the same in-memory database see each
+// other's tables.
+func TestOpenSharedCache(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file::memory:?_cache=shared")
+	if err != nil {
+		t.Fatal("failed to open connection", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	conni, err = drv.Open("file::memory:?_cache=shared")
+	if err != nil {
+		t.Fatal("failed to open second connection", err)
+	}
+	shared := conni.(*SQLiteConn)
+	defer shared.Close()
+	assertTestTableCount(t, shared, 0)
+
+	conni, err = drv.Open("file::memory:?_cache=private")
+	if err != nil {
+		t.Fatal("failed to open private connection", err)
+	}
+	private := conni.(*SQLiteConn)
+	defer private.Close()
+	if _, err := private.Query("SELECT n FROM test", nil); err == nil {
+		t.Error("expected private connection not to see the shared table")
+	}
+}
+
+func TestOpenVFS(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("test.db?_vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conni.Close()
+	if _, err := fs.FileSize("test.db"); err != nil {
+		t.Error("expected database to be created in volatile VFS", err)
+	}
+
+	_, err = drv.Open("test.db?_vfs=missing")
+	if err == nil || err.Error() != "no such VFS: missing" {
+		t.Errorf("expected missing VFS error, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// +build go1.10
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// NewConnector returns a connector opening connections with the given
+// configuration, for use with sql.OpenDB.
+func NewConnector(cfg *Config) (driver.Connector, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	c := *cfg
+	return &sqliteConnector{cfg: &c}, nil
+}
+
+// OpenConnector implement DriverContext.
+func (d *SQLiteDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Extensions = d.Extensions
+	cfg.ConnectHook = d.ConnectHook
+
+	return NewConnector(cfg)
+}
+
+// Implementation of driver.Connector.
+type sqliteConnector struct {
+	cfg *Config
+}
+
+// Connect implement Connector.
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := openConfig(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ResetSession implement SessionResetter. Connections that were closed
+// because they were left in an inconsistent state are reported as bad, so
+// that database/sql discards them.
+func (c *SQLiteConn) ResetSession(ctx context.Context) error {
+	if !c.dbConnOpen() {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// Driver implement Connector.
+func (c *sqliteConnector) Driver() driver.Driver {
+	return &SQLiteDriver{
+		Extensions:  c.cfg.Extensions,
+		ConnectHook: c.cfg.ConnectHook,
+	}
+}
@@ -0,0 +1,123 @@
+// +build go1.10
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+)
+
+func TestConnector(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	hooked := 0
+	cfg := NewConfig("test.db")
+	cfg.VFS = "volatile"
+	cfg.Pragmas = []Pragma{{Name: "foreign_keys", Value: "1"}}
+	cfg.ConnectHook = func(conn *SQLiteConn) error {
+		hooked++
+		return nil
+	}
+
+	connector, err := NewConnector(cfg)
+	if err != nil {
+		t.Fatal("failed to create connector", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var foreignKeys int
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		t.Fatal("failed to query foreign keys", err)
+	}
+	if foreignKeys != 1 {
+		t.Errorf("expected foreign keys to be enabled, got %d", foreignKeys)
+	}
+	if hooked != 1 {
+		t.Errorf("expected connect hook to be invoked once, got %d", hooked)
+	}
+	if _, err := db.Exec("CREATE TABLE test (n INT)"); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if _, err := fs.FileSize("test.db"); err != nil {
+		t.Error("expected database to be created in volatile VFS", err)
+	}
+
+	cfg.TxLock = "bogus"
+	if _, err := NewConnector(cfg); err == nil {
+		t.Error("expected connector with invalid configuration to fail")
+	}
+}
+
+func TestOpenConnector(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	connector, err := drv.OpenConnector("test.db?_vfs=volatile&_recursive_triggers=1")
+	if err != nil {
+		t.Fatal("failed to open connector", err)
+	}
+
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal("failed to connect", err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.(*SQLiteConn).Query("PRAGMA recursive_triggers", nil)
+	if err != nil {
+		t.Fatal("failed to query recursive triggers", err)
+	}
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		t.Fatal("failed to read recursive triggers", err)
+	}
+	rows.Close()
+	if values[0] != int64(1) {
+		t.Errorf("expected recursive triggers to be enabled, got %v", values[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := connector.Connect(ctx); err != context.Canceled {
+		t.Errorf("expected canceled connect to fail, got %v", err)
+	}
+
+	if _, err := drv.OpenConnector("test.db?_txlock=bogus"); err == nil {
+		t.Error("expected connector with invalid DSN to fail")
+	}
+}
+
+// A connection whose pragmas can't be restored after a transaction is
+// closed, and reported as bad to database/sql.
+func TestRestoreFailureClosesConnection(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(":memory:")
+	if err != nil {
+		t.Fatal("failed to open connection", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	txi, err := conn.BeginTx(context.Background(), driver.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal("failed to begin transaction", err)
+	}
+	tx := txi.(*SQLiteTx)
+	tx.pragmas = append(tx.pragmas, Pragma{Name: "query_only", Value: "("})
+
+	// The transaction was committed, so the failure is not reported here.
+	if err := tx.Commit(); err != nil {
+		t.Fatal("expected commit to succeed", err)
+	}
+	if conn.dbConnOpen() {
+		t.Error("expected connection to be closed")
+	}
+	if err := conn.ResetSession(context.Background()); err != driver.ErrBadConn {
+		t.Errorf("expected closed connection to be bad, got %v", err)
+	}
+}
@@ -8,8 +8,10 @@
 package sqlite3
 
 import (
+	"database/sql"
 	"database/sql/driver"
 	"errors"
+	"fmt"
 
 	"context"
 )
@@ -46,8 +48,46 @@ func (c *SQLiteConn) PrepareContext(ctx context.Context, query string) (driver.S
 }
 
 // BeginTx implement ConnBeginTx.
+//
+// Transactions are serializable by default. The isolation levels map onto
+// SQLite as follows:
+//   sql.LevelDefault, sql.LevelSerializable
+//     Begin the transaction as configured with _txlock.
+//   sql.LevelLinearizable
+//     Begin an exclusive transaction, ordered with respect to all other
+//     connections.
+//   sql.LevelReadUncommitted
+//     Enable the read_uncommitted pragma for the duration of the
+//     transaction. This only makes a difference for connections in
+//     shared cache mode, which can then read uncommitted changes of other
+//     connections sharing the cache.
+// Other levels return an error.
+//
+// Read-only transactions enable the query_only pragma for their duration,
+// so that writes fail with SQLITE_READONLY. They never take a write lock
+// upfront, even if _txlock is "immediate" or "exclusive", or the isolation
+// level is sql.LevelLinearizable.
 func (c *SQLiteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
-	return c.begin(ctx)
+	begin := c.txlock
+	pragmas := []Pragma{}
+
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSerializable:
+	case sql.LevelLinearizable:
+		begin = "BEGIN EXCLUSIVE"
+	case sql.LevelReadUncommitted:
+		pragmas = append(pragmas, Pragma{Name: "read_uncommitted", Value: "1"})
+	default:
+		return nil, fmt.Errorf("Unsupported isolation level: %d", opts.Isolation)
+	}
+
+	// This must come after the isolation level, which can change begin.
+	if opts.ReadOnly {
+		begin = "BEGIN"
+		pragmas = append(pragmas, Pragma{Name: "query_only", Value: "1"})
+	}
+
+	return c.beginWith(ctx, begin, pragmas)
 }
 
 // QueryContext implement QueryerContext.
@@ -10,9 +10,11 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -155,3 +157,241 @@ func TestExecCancel(t *testing.T) {
 		}
 	}
 }
+
+func TestBeginTxReadOnly(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	db, err := sql.Open("sqlite3", tempFilename+"?_txlock=immediate")
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("create table foo (id integer)"); err != nil {
+		t.Fatal("Failed to create table:", err)
+	}
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal("Failed to begin read-only transaction:", err)
+	}
+	if _, err := tx.Query("select id from foo"); err != nil {
+		t.Fatal("Failed to query in read-only transaction:", err)
+	}
+	_, err = tx.Exec("insert into foo(id) values(1)")
+	if err == nil {
+		t.Fatal("Expected insert in read-only transaction to fail")
+	}
+	if err.(Error).Code != ErrReadonly {
+		t.Errorf("Expected read-only error, got %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("Failed to rollback read-only transaction:", err)
+	}
+
+	// The connection is writable again.
+	if _, err := db.Exec("insert into foo(id) values(1)"); err != nil {
+		t.Fatal("Failed to insert after read-only transaction:", err)
+	}
+}
+
+// Read-only transactions don't take a write lock, even at the linearizable
+// isolation level.
+func TestBeginTxReadOnlyLinearizable(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	writer := conni.(*SQLiteConn)
+	defer writer.Close()
+	conni, err = drv.Open(tempFilename + "?_busy_timeout=0")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	reader := conni.(*SQLiteConn)
+	defer reader.Close()
+
+	pragmaWAL(t, writer)
+	if _, err := writer.Exec("CREATE TABLE test (n INT); BEGIN IMMEDIATE", nil); err != nil {
+		t.Fatal("Failed to begin write transaction:", err)
+	}
+	defer writer.Exec("ROLLBACK", nil)
+
+	opts := driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelLinearizable), ReadOnly: true}
+	tx, err := reader.BeginTx(context.Background(), opts)
+	if err != nil {
+		t.Fatal("Failed to begin read-only linearizable transaction:", err)
+	}
+	assertTestTableCount(t, reader, 0)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("Failed to rollback:", err)
+	}
+}
+
+func TestBeginTxIsolation(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	for _, level := range []sql.IsolationLevel{sql.LevelDefault, sql.LevelSerializable, sql.LevelLinearizable, sql.LevelReadUncommitted} {
+		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+		if err != nil {
+			t.Fatalf("Failed to begin transaction with isolation level %d: %v", level, err)
+		}
+		tx.Rollback()
+	}
+
+	for _, level := range []sql.IsolationLevel{sql.LevelReadCommitted, sql.LevelWriteCommitted, sql.LevelRepeatableRead, sql.LevelSnapshot} {
+		if _, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level}); err == nil {
+			t.Errorf("Expected isolation level %d to be unsupported", level)
+		}
+	}
+}
+
+// Read-uncommitted transactions see uncommitted changes of connections
+// sharing the same cache.
+func TestBeginTxReadUncommitted(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file::memory:?_cache=shared")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	writer := conni.(*SQLiteConn)
+	defer writer.Close()
+	conni, err = drv.Open("file::memory:?_cache=shared")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	reader := conni.(*SQLiteConn)
+	defer reader.Close()
+
+	if _, err := writer.Exec("CREATE TABLE test (n INT); BEGIN; INSERT INTO test(n) VALUES(1)", nil); err != nil {
+		t.Fatal("Failed to insert uncommitted row:", err)
+	}
+	defer writer.Exec("ROLLBACK", nil)
+
+	tx, err := reader.BeginTx(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelReadUncommitted)})
+	if err != nil {
+		t.Fatal("Failed to begin read-uncommitted transaction:", err)
+	}
+	assertTestTableCount(t, reader, 1)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("Failed to rollback:", err)
+	}
+
+	value, err := reader.pragma("read_uncommitted")
+	if err != nil {
+		t.Fatal("Failed to read pragma:", err)
+	}
+	if value != "0" {
+		t.Errorf("Expected read_uncommitted to be restored, got %s", value)
+	}
+}
+
+// A statement canceled while running fails with an interrupt error
+// wrapping the error of its context.
+func TestExecContextInterrupt(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(":memory:")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = conn.ExecContext(ctx, `
+		WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+		SELECT count(*) FROM c`, nil)
+	if err == nil {
+		t.Fatal("Expected endless statement to be interrupted")
+	}
+	sqliteErr, ok := err.(Error)
+	if !ok || sqliteErr.Code != ErrInterrupt || sqliteErr.Unwrap() != context.DeadlineExceeded {
+		t.Fatalf("Expected interrupt error wrapping deadline, got %#v", err)
+	}
+
+	// The interruption doesn't leak into the next statement.
+	if _, err := conn.ExecContext(context.Background(), "SELECT 1", nil); err != nil {
+		t.Fatal("Failed to run statement after interruption:", err)
+	}
+
+	// A context that is already done prevents the statement from running.
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE test (n INT)", nil); err == nil {
+		t.Fatal("Expected statement with expired context to fail")
+	}
+	if _, err := conn.Exec("SELECT n FROM test", nil); err == nil {
+		t.Error("Expected statement with expired context not to run")
+	}
+}
+
+// Rows are interrupted when the context of the query is canceled, while
+// other statements on the same connection are not.
+func TestQueryContextInterrupt(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(":memory:")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err := conn.QueryContext(ctx, `
+		WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+		SELECT x FROM c`, nil)
+	if err != nil {
+		t.Fatal("Failed to query:", err)
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		t.Fatal("Failed to fetch row:", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT 1", nil); err != nil {
+		t.Fatal("Failed to run statement while rows are open:", err)
+	}
+
+	cancel()
+	err = rows.Next(values)
+	if sqliteErr, ok := err.(Error); !ok || sqliteErr.Code != ErrInterrupt || sqliteErr.Unwrap() != context.Canceled {
+		t.Fatalf("Expected interrupt error wrapping cancellation, got %#v", err)
+	}
+}
+
+// Statements don't spawn goroutines to watch their context.
+func TestExecContextGoroutines(t *testing.T) {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(":memory:")
+	if err != nil {
+		t.Fatal("Failed to open connection:", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		rows, err := conn.QueryContext(ctx, "SELECT 1", nil)
+		if err != nil {
+			t.Fatal("Failed to query:", err)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Fatalf("Expected no new goroutines, got %d instead of %d", after, before)
+		}
+		rows.Close()
+	}
+}
@@ -0,0 +1,293 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdint.h>
+
+int progressHandlerTrampoline(void*);
+
+static void _sqlite3_progress_handler(sqlite3 *db, int n, uintptr_t handle) {
+  if (handle == 0) {
+    sqlite3_progress_handler(db, 0, 0, 0);
+    return;
+  }
+  sqlite3_progress_handler(db, n, progressHandlerTrampoline, (void*)handle);
+}
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of virtual machine instructions between checks of the
+// context and budget of the running statement.
+const progressInterval = 1000
+
+// ErrBudgetExceeded is wrapped by the error of statements interrupted
+// because they exceeded their StatementBudget.
+var ErrBudgetExceeded = errors.New("statement budget exceeded")
+
+// StatementBudget limits the resources a single statement can use. When a
+// limit is reached the statement is interrupted, and fails with an Error
+// whose code is ErrInterrupt and that wraps ErrBudgetExceeded.
+//
+// A budget applies to all the steps of a statement, so for queries it
+// covers all the calls to Next. Statements run internally by the driver,
+// such as the ones setting pragmas, beginning and ending transactions or
+// managing savepoints, have no budget.
+type StatementBudget struct {
+	// Maximum number of virtual machine instructions. It's enforced with
+	// a granularity of up to 1000 instructions. Zero means no limit.
+	MaxSteps int64
+
+	// Maximum time spent running the statement, not counting the time
+	// between calls to Next. Zero means no limit.
+	MaxTime time.Duration
+}
+
+// Return true if the budget has no limits.
+func (b StatementBudget) unlimited() bool {
+	return b.MaxSteps <= 0 && b.MaxTime <= 0
+}
+
+type statementBudgetKey struct{}
+
+// WithStatementBudget returns a context that makes statements run with it
+// use the given budget, instead of the one of their connection.
+func WithStatementBudget(ctx context.Context, budget StatementBudget) context.Context {
+	return context.WithValue(ctx, statementBudgetKey{}, budget)
+}
+
+// Context of the statements run internally by the driver. It has no
+// budget, so those statements are never interrupted.
+var internalContext = WithStatementBudget(context.Background(), StatementBudget{})
+
+// SetProgressHandler sets a callback invoked periodically while statements
+// run, approximately every nOps virtual machine instructions. If it returns
+// true, the running statement is interrupted and fails with ErrInterrupt.
+//
+// If callback is nil or nOps is not positive, the existing handler (if
+// any) is removed.
+func (c *SQLiteConn) SetProgressHandler(nOps int, callback func() bool) {
+	if callback == nil || nOps <= 0 {
+		nOps = 0
+		callback = nil
+	}
+	c.progress.ops = nOps
+	c.progress.callback = callback
+	c.progress.count = 0
+	c.setProgressHandler(nOps)
+}
+
+// A single run of a statement, tracking whether it must be interrupted.
+type statementRun struct {
+	ctx     context.Context
+	budget  StatementBudget
+	steps   int64         // Instructions run so far, approximately.
+	elapsed time.Duration // Time spent in previous steps.
+	started time.Time     // Start of the current step, if any.
+	err     error         // Reason of the interruption, if any.
+}
+
+// Start a new statement run with the given context, using the budget
+// attached to the context, or else the one of the connection.
+func (c *SQLiteConn) newRun(ctx context.Context) *statementRun {
+	budget, ok := ctx.Value(statementBudgetKey{}).(StatementBudget)
+	if !ok {
+		budget = c.budget
+	}
+	return &statementRun{ctx: ctx, budget: budget}
+}
+
+// Check whether the run must be interrupted, returning the reason.
+func (r *statementRun) check() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.budget.MaxSteps > 0 && r.steps >= r.budget.MaxSteps {
+		return ErrBudgetExceeded
+	}
+	if r.budget.MaxTime > 0 {
+		elapsed := r.elapsed
+		if !r.started.IsZero() {
+			elapsed += time.Since(r.started)
+		}
+		if elapsed >= r.budget.MaxTime {
+			return ErrBudgetExceeded
+		}
+	}
+	return nil
+}
+
+// Run the given step of a statement, interrupting it if the context of the
+// run is done or its budget is exceeded before the step completes. If that
+// is already the case, the step is not run and SQLITE_INTERRUPT is
+// returned.
+//
+// The run is checked by a progress handler installed only for the duration
+// of the step, so interruptions affect only the statement they were issued
+// for, and statements whose context can't be canceled and that have no
+// budget have no overhead.
+func (c *SQLiteConn) step(run *statementRun, step func() C.int) C.int {
+	if run.ctx.Done() == nil && run.budget.unlimited() {
+		return step()
+	}
+	if run.err = run.check(); run.err != nil {
+		return C.SQLITE_INTERRUPT
+	}
+
+	interval := progressInterval
+	if steps := run.budget.MaxSteps; steps > 0 && steps < int64(interval) {
+		interval = int(steps)
+	}
+	if ops := c.progress.ops; ops > 0 && ops < interval {
+		interval = ops
+	}
+
+	c.progress.run = run
+	run.started = time.Now()
+	c.setProgressHandler(interval)
+
+	rv := step()
+
+	c.setProgressHandler(c.progress.ops)
+	run.elapsed += time.Since(run.started)
+	run.started = time.Time{}
+	c.progress.run = nil
+
+	return rv
+}
+
+// Install the progress handler with the given interval, or remove it if
+// the interval is zero.
+func (c *SQLiteConn) setProgressHandler(interval int) {
+	c.progress.interval = interval
+	if interval == 0 {
+		C._sqlite3_progress_handler(c.db, 0, 0)
+		return
+	}
+	if c.progress.handle == 0 {
+		newProgressHandle(c.progress)
+	}
+	C._sqlite3_progress_handler(c.db, C.int(interval), C.uintptr_t(c.progress.handle))
+}
+
+// State of the progress handler of a connection.
+//
+// The progress handler reaches it through a handle registered in
+// progressHandles, rather than through the handles of the connection, so
+// that invocations don't contend for handleLock, and so that the handle
+// doesn't keep the connection alive. The state is registered the first
+// time the handler is installed, and unregistered when the connection is
+// closed. Note that the callback set with SetProgressHandler is kept alive
+// until then, together with anything it references.
+type progressState struct {
+	handle   uintptr       // Handle passed to the progress handler, or zero.
+	interval int           // Interval of the installed progress handler, or zero.
+	ops      int           // Interval of the user progress handler, or zero.
+	callback func() bool   // User progress handler.
+	count    int           // Instructions since the user progress handler was last invoked.
+	run      *statementRun // Statement run checked by the progress handler, if any.
+}
+
+// Invoked by the progress handler while a statement runs. A non-zero
+// return value interrupts the statement.
+func (s *progressState) tick() int {
+	if s.callback != nil {
+		s.count += s.interval
+		if s.count >= s.ops {
+			s.count = 0
+			if s.callback() {
+				return 1
+			}
+		}
+	}
+
+	if run := s.run; run != nil {
+		run.steps += int64(s.interval)
+		if run.err = run.check(); run.err != nil {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Registry of progress handler states by handle. Lookups happen on every
+// invocation of a progress handler, so the map is never modified: changes
+// replace it with a modified copy, and lookups don't need to lock.
+var (
+	progressHandlesLock  sync.Mutex   // Serializes changes.
+	progressHandles      atomic.Value // Current map[uintptr]*progressState.
+	progressHandlesIndex uintptr      // Last handle assigned.
+)
+
+// Register the given state, setting its handle.
+func newProgressHandle(state *progressState) {
+	progressHandlesLock.Lock()
+	defer progressHandlesLock.Unlock()
+
+	old, _ := progressHandles.Load().(map[uintptr]*progressState)
+	handles := make(map[uintptr]*progressState, len(old)+1)
+	for handle, s := range old {
+		handles[handle] = s
+	}
+	progressHandlesIndex++
+	state.handle = progressHandlesIndex
+	handles[state.handle] = state
+	progressHandles.Store(handles)
+}
+
+// Unregister the given state, if it was registered.
+func deleteProgressHandle(state *progressState) {
+	if state.handle == 0 {
+		return
+	}
+
+	progressHandlesLock.Lock()
+	defer progressHandlesLock.Unlock()
+
+	old, _ := progressHandles.Load().(map[uintptr]*progressState)
+	handles := make(map[uintptr]*progressState, len(old))
+	for handle, s := range old {
+		if handle != state.handle {
+			handles[handle] = s
+		}
+	}
+	state.handle = 0
+	progressHandles.Store(handles)
+}
+
+// Return the state registered with the given handle.
+func lookupProgressHandle(handle uintptr) *progressState {
+	handles, _ := progressHandles.Load().(map[uintptr]*progressState)
+	state, ok := handles[handle]
+	if !ok {
+		panic("invalid progress handle")
+	}
+	return state
+}
+
+// Return the error for a step of the given run that failed with the given
+// return code. If the run was interrupted because its context is done or
+// its budget exceeded, the error has the SQLITE_INTERRUPT code and wraps
+// the reason.
+func (c *SQLiteConn) stepError(run *statementRun, rv C.int) error {
+	if rv == C.SQLITE_INTERRUPT && run.err != nil {
+		return Error{
+			Code:         ErrInterrupt,
+			ExtendedCode: ErrNoExtended(ErrInterrupt),
+			err:          ErrInterrupt.Error() + ": " + run.err.Error(),
+			cause:        run.err,
+		}
+	}
+	return c.lastError()
+}
@@ -0,0 +1,169 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql/driver"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Statement running until interrupted.
+const endlessQuery = `
+	WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+	SELECT count(*) FROM c`
+
+func TestSetProgressHandler(t *testing.T) {
+	conn := openTestConn(t, ":memory:")
+	defer conn.Close()
+
+	calls := 0
+	conn.SetProgressHandler(100, func() bool {
+		calls++
+		return calls == 50
+	})
+
+	_, err := conn.Exec(endlessQuery, nil)
+	if sqliteErr, ok := err.(Error); !ok || sqliteErr.Code != ErrInterrupt {
+		t.Fatalf("expected statement to be interrupted, got %v", err)
+	}
+	if sqliteErr := err.(Error); sqliteErr.Unwrap() != nil {
+		t.Errorf("expected interruption without cause, got %v", sqliteErr.Unwrap())
+	}
+	if calls != 50 {
+		t.Errorf("expected handler to be invoked 50 times, got %d", calls)
+	}
+
+	// The handler keeps its interval alongside a cancelable context.
+	calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := conn.ExecContext(ctx, endlessQuery, nil); err == nil {
+		t.Fatal("expected statement to be interrupted")
+	}
+	if calls != 50 {
+		t.Errorf("expected handler to be invoked 50 times with context, got %d", calls)
+	}
+
+	conn.SetProgressHandler(0, nil)
+	calls = 0
+	ctx = WithStatementBudget(context.Background(), StatementBudget{MaxSteps: 10000})
+	_, err = conn.ExecContext(ctx, endlessQuery, nil)
+	assertBudgetExceeded(t, err)
+	if calls != 0 {
+		t.Errorf("expected removed handler not to be invoked, got %d calls", calls)
+	}
+}
+
+// A budget attached to the context interrupts the statement with a
+// distinguishable error.
+func TestStatementBudget_Steps(t *testing.T) {
+	conn := openTestConn(t, ":memory:")
+	defer conn.Close()
+
+	ctx := WithStatementBudget(context.Background(), StatementBudget{MaxSteps: 10000})
+	_, err := conn.ExecContext(ctx, endlessQuery, nil)
+	assertBudgetExceeded(t, err)
+
+	if _, err := conn.ExecContext(ctx, "SELECT 1", nil); err != nil {
+		t.Fatal("failed to run statement within budget", err)
+	}
+
+	// The budget covers all steps of a query.
+	rows, err := conn.QueryContext(ctx, "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT x FROM c", nil)
+	if err != nil {
+		t.Fatal("failed to query", err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	n := 0
+	for {
+		if err = rows.Next(values); err != nil {
+			break
+		}
+		n++
+	}
+	assertBudgetExceeded(t, err)
+	if n == 0 || n > 10000 {
+		t.Errorf("expected some rows within the budget, got %d", n)
+	}
+}
+
+// A budget set in the DSN applies to all statements without one in their
+// context.
+func TestStatementBudget_Time(t *testing.T) {
+	conn := openTestConn(t, ":memory:?_budget_time=20")
+	defer conn.Close()
+
+	start := time.Now()
+	_, err := conn.Exec(endlessQuery, nil)
+	assertBudgetExceeded(t, err)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected statement to be interrupted after 20ms, took %s", elapsed)
+	}
+
+	ctx := WithStatementBudget(context.Background(), StatementBudget{MaxSteps: 1000000000})
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = conn.ExecContext(ctx, endlessQuery, nil)
+	if sqliteErr, ok := err.(Error); !ok || sqliteErr.Unwrap() != context.DeadlineExceeded {
+		t.Errorf("expected context budget to replace the DSN one, got %v", err)
+	}
+}
+
+// Statements run internally by the driver are not subject to the budget of
+// the connection.
+func TestStatementBudget_Internal(t *testing.T) {
+	conn := openTestConn(t, ":memory:?_budget_steps=1&_foreign_keys=1&_cache_size=-4000")
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(context.Background(), driver.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal("failed to begin read-only transaction", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("failed to rollback", err)
+	}
+
+	value, err := conn.pragma("query_only")
+	if err != nil {
+		t.Fatal("failed to read pragma", err)
+	}
+	if value != "0" {
+		t.Errorf("expected query_only to be restored, got %s", value)
+	}
+}
+
+// Installing the progress handler doesn't keep the connection alive, so
+// unreachable connections still get closed by their finalizer.
+func TestProgressHandler_Finalizer(t *testing.T) {
+	handle := func() uintptr {
+		conn := openTestConn(t, ":memory:")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, "SELECT 1", nil); err != nil {
+			t.Fatal("failed to execute statement", err)
+		}
+		return conn.progress.handle
+	}()
+	if handle == 0 {
+		t.Fatal("expected progress handler to be registered")
+	}
+
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		handles, _ := progressHandles.Load().(map[uintptr]*progressState)
+		if _, ok := handles[handle]; !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected connection to be finalized")
+}
+
+func assertBudgetExceeded(t *testing.T, err error) {
+	sqliteErr, ok := err.(Error)
+	if !ok || sqliteErr.Code != ErrInterrupt || sqliteErr.Unwrap() != ErrBudgetExceeded {
+		t.Fatalf("expected budget exceeded error, got %#v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQLiteSavepoint is a savepoint within a transaction, marking a point that
+// the transaction can be rolled back to without being aborted.
+type SQLiteSavepoint struct {
+	tx     *SQLiteTx
+	name   string
+	active bool
+}
+
+// Savepoint starts a new savepoint with the given name, nested within the
+// transaction and within any active savepoint of it. It fails with
+// sql.ErrTxDone if the transaction was committed or rolled back.
+//
+// Since SQLite resolves a savepoint name to the most recent savepoint with
+// that name, regardless of case, the name must differ from the ones of the
+// active savepoints of the transaction.
+func (tx *SQLiteTx) Savepoint(name string) (*SQLiteSavepoint, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+	for _, savepoint := range tx.savepoints {
+		if strings.EqualFold(savepoint.name, name) {
+			return nil, fmt.Errorf("savepoint %s is already active", name)
+		}
+	}
+	if _, err := tx.c.exec(internalContext, "SAVEPOINT "+quoteIdentifier(name), nil); err != nil {
+		return nil, err
+	}
+
+	savepoint := &SQLiteSavepoint{tx: tx, name: name, active: true}
+	tx.savepoints = append(tx.savepoints, savepoint)
+
+	return savepoint, nil
+}
+
+// WithSavepoint runs the given function within a new savepoint with the
+// given name. The savepoint is released if the function succeeds, and
+// rolled back to and released if it returns an error, panics or calls
+// runtime.Goexit. The error or panic is then propagated.
+func (tx *SQLiteTx) WithSavepoint(name string, f func() error) error {
+	savepoint, err := tx.Savepoint(name)
+	if err != nil {
+		return err
+	}
+
+	// A panic can't be told apart from runtime.Goexit with recover, so
+	// track whether the function returned instead.
+	returned := false
+	defer func() {
+		if !returned {
+			savepoint.abort()
+		}
+	}()
+
+	err = f()
+	returned = true
+
+	if err != nil {
+		savepoint.abort()
+		return err
+	}
+	return savepoint.Release()
+}
+
+// Name returns the name of the savepoint.
+func (s *SQLiteSavepoint) Name() string {
+	return s.name
+}
+
+// Release the savepoint, together with all savepoints nested within it.
+// Their changes become part of the enclosing savepoint or transaction.
+func (s *SQLiteSavepoint) Release() error {
+	i, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.tx.c.exec(internalContext, "RELEASE SAVEPOINT "+quoteIdentifier(s.name), nil); err != nil {
+		return err
+	}
+	s.tx.popSavepoints(i)
+
+	return nil
+}
+
+// RollbackTo undoes all changes made since the savepoint was started, and
+// releases all savepoints nested within it. Unlike a transaction rollback,
+// the savepoint stays active, so it can be rolled back to again and must
+// still be released.
+//
+// The rollback hook is not invoked, since the transaction is not aborted.
+// The savepoint rollback hook is invoked instead.
+func (s *SQLiteSavepoint) RollbackTo() error {
+	i, err := s.index()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.tx.c.exec(internalContext, "ROLLBACK TO SAVEPOINT "+quoteIdentifier(s.name), nil); err != nil {
+		return err
+	}
+	s.tx.popSavepoints(i + 1)
+
+	if hook := s.tx.c.savepointRollbackHook; hook != nil {
+		hook(s.name)
+	}
+
+	return nil
+}
+
+// Roll back to the savepoint and release it, ignoring errors, since the
+// caller is already reporting a failure.
+func (s *SQLiteSavepoint) abort() {
+	if s.RollbackTo() == nil {
+		s.Release()
+	}
+}
+
+// Return the position of the savepoint in the stack of active savepoints
+// of its transaction, or an error if it was released or the transaction
+// ended.
+func (s *SQLiteSavepoint) index() (int, error) {
+	if s.active {
+		for i, savepoint := range s.tx.savepoints {
+			if savepoint == s {
+				return i, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("savepoint %s is no longer active", s.name)
+}
+
+// Deactivate the savepoints from the given position of the stack onwards.
+func (tx *SQLiteTx) popSavepoints(i int) {
+	for _, savepoint := range tx.savepoints[i:] {
+		savepoint.active = false
+	}
+	tx.savepoints = tx.savepoints[:i]
+}
+
+// RegisterSavepointRollbackHook sets the savepoint rollback hook for a
+// connection. It's invoked with the name of the savepoint after every
+// SQLiteSavepoint.RollbackTo, which unlike a full rollback doesn't invoke
+// the hook set with RegisterRollbackHook.
+//
+// If callback is nil the existing hook (if any) will be removed.
+func (c *SQLiteConn) RegisterSavepointRollbackHook(callback func(name string)) {
+	c.savepointRollbackHook = callback
+}
+
+// Quote the given name for use as an SQL identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
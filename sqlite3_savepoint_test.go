@@ -0,0 +1,205 @@
+package sqlite3
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSavepoint(t *testing.T) {
+	conn, tx := openSavepointTx(t)
+	defer conn.Close()
+	defer tx.Rollback()
+
+	events := []string{}
+	conn.RegisterRollbackHook(func() { events = append(events, "rollback") })
+	conn.RegisterSavepointRollbackHook(func(name string) { events = append(events, "rollback to "+name) })
+
+	insertTestTableRow(t, conn, 1)
+
+	outer, err := tx.Savepoint("outer")
+	if err != nil {
+		t.Fatal("failed to start savepoint", err)
+	}
+	insertTestTableRow(t, conn, 2)
+
+	inner, err := tx.Savepoint(`in"ner`)
+	if err != nil {
+		t.Fatal("failed to start nested savepoint", err)
+	}
+	insertTestTableRow(t, conn, 3)
+
+	if err := outer.RollbackTo(); err != nil {
+		t.Fatal("failed to roll back to savepoint", err)
+	}
+	assertTestTableCount(t, conn, 1)
+
+	// Rolling back to the outer savepoint releases the inner one, but
+	// keeps the outer one active.
+	if err := inner.Release(); err == nil {
+		t.Error("expected release of rolled back nested savepoint to fail")
+	}
+	insertTestTableRow(t, conn, 4)
+	if err := outer.Release(); err != nil {
+		t.Fatal("failed to release savepoint", err)
+	}
+	if err := outer.RollbackTo(); err == nil {
+		t.Error("expected rollback to released savepoint to fail")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	assertTestTableCount(t, conn, 2)
+
+	if expected := []string{"rollback to outer"}; !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected hook events %v, got %v", expected, events)
+	}
+}
+
+func TestWithSavepoint(t *testing.T) {
+	conn, tx := openSavepointTx(t)
+	defer conn.Close()
+	defer tx.Rollback()
+
+	err := tx.WithSavepoint("ok", func() error {
+		insertTestTableRow(t, conn, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to run function in savepoint", err)
+	}
+
+	failure := errors.New("failure")
+	err = tx.WithSavepoint("error", func() error {
+		insertTestTableRow(t, conn, 2)
+		return failure
+	})
+	if err != failure {
+		t.Errorf("expected function error to be returned, got %v", err)
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("expected panic to be propagated, got %v", p)
+			}
+		}()
+		tx.WithSavepoint("panic", func() error {
+			insertTestTableRow(t, conn, 3)
+			panic("boom")
+		})
+	}()
+
+	if len(tx.savepoints) != 0 {
+		t.Errorf("expected all savepoints to be released, got %d", len(tx.savepoints))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	assertTestTableCount(t, conn, 1)
+}
+
+// A function calling runtime.Goexit, like t.Fatal does, is treated as a
+// failure.
+func TestWithSavepoint_Goexit(t *testing.T) {
+	conn, tx := openSavepointTx(t)
+	defer conn.Close()
+	defer tx.Rollback()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tx.WithSavepoint("goexit", func() error {
+			insertTestTableRow(t, conn, 1)
+			runtime.Goexit()
+			return nil
+		})
+	}()
+	<-done
+
+	if len(tx.savepoints) != 0 {
+		t.Errorf("expected savepoint to be released, got %d", len(tx.savepoints))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	assertTestTableCount(t, conn, 0)
+}
+
+// Savepoints can't be started once the transaction is over.
+func TestSavepoint_TxDone(t *testing.T) {
+	conn, tx := openSavepointTx(t)
+	defer conn.Close()
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	if _, err := tx.Savepoint("late"); err != sql.ErrTxDone {
+		t.Errorf("expected savepoint after commit to fail, got %v", err)
+	}
+	if !conn.AutoCommit() {
+		t.Error("expected no transaction to be started")
+	}
+}
+
+// Nested savepoints can't reuse the name of an active savepoint, while
+// released ones can be reused.
+func TestSavepoint_DuplicateName(t *testing.T) {
+	conn, tx := openSavepointTx(t)
+	defer conn.Close()
+	defer tx.Rollback()
+
+	outer, err := tx.Savepoint("sp")
+	if err != nil {
+		t.Fatal("failed to start savepoint", err)
+	}
+	insertTestTableRow(t, conn, 1)
+
+	if _, err := tx.Savepoint("SP"); err == nil {
+		t.Fatal("expected nested savepoint with the same name to fail")
+	}
+	err = tx.WithSavepoint("sp", func() error {
+		t.Error("expected nested savepoint with the same name not to run")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected nested savepoint with the same name to fail")
+	}
+
+	inner, err := tx.Savepoint("inner")
+	if err != nil {
+		t.Fatal("failed to start nested savepoint", err)
+	}
+	insertTestTableRow(t, conn, 2)
+	if err := inner.Release(); err != nil {
+		t.Fatal("failed to release nested savepoint", err)
+	}
+	if _, err := tx.Savepoint("inner"); err != nil {
+		t.Fatal("failed to reuse name of released savepoint", err)
+	}
+	insertTestTableRow(t, conn, 3)
+
+	if err := outer.RollbackTo(); err != nil {
+		t.Fatal("failed to roll back to savepoint", err)
+	}
+	assertTestTableCount(t, conn, 0)
+	if err := outer.Release(); err != nil {
+		t.Fatal("failed to release savepoint", err)
+	}
+}
+
+func openSavepointTx(t *testing.T) (*SQLiteConn, *SQLiteTx) {
+	conn := openTestConn(t, ":memory:")
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal("failed to begin transaction", err)
+	}
+
+	return conn, tx.(*SQLiteTx)
+}
@@ -0,0 +1,150 @@
+// +build snapshot
+
+package sqlite3
+
+/*
+#cgo CFLAGS: -DSQLITE_ENABLE_SNAPSHOT
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"runtime"
+	"unsafe"
+)
+
+// ErrSnapshotFreed is returned when using a snapshot after Free.
+var ErrSnapshotFreed = errors.New("snapshot has been freed")
+
+// Snapshot identifies a historical version of a WAL database, which can be
+// read by any connection to the same database while the frames it refers
+// to are still in the WAL. See https://sqlite.org/c3ref/snapshot.html.
+type Snapshot struct {
+	s *C.sqlite3_snapshot
+}
+
+// GetSnapshot returns the version of the given schema that the current
+// read transaction of the connection sees. It fails if the connection has
+// no read transaction open on that schema, or if it has a write
+// transaction open.
+func (c *SQLiteConn) GetSnapshot(schema string) (*Snapshot, error) {
+	zSchema := C.CString(schema)
+	defer C.free(unsafe.Pointer(zSchema))
+
+	var s *C.sqlite3_snapshot
+	if rv := C.sqlite3_snapshot_get(c.db, zSchema, &s); rv != C.SQLITE_OK {
+		return nil, newError(rv)
+	}
+
+	snapshot := &Snapshot{s: s}
+	runtime.SetFinalizer(snapshot, (*Snapshot).Free)
+
+	return snapshot, nil
+}
+
+// OpenSnapshot makes the current transaction of the connection read the
+// given version of the given schema. It must be called after BEGIN, before
+// the transaction reads from that schema. It fails with ErrBusySnapshot if
+// the snapshot is not available anymore.
+func (c *SQLiteConn) OpenSnapshot(schema string, snapshot *Snapshot) error {
+	if snapshot.s == nil {
+		return ErrSnapshotFreed
+	}
+
+	zSchema := C.CString(schema)
+	defer C.free(unsafe.Pointer(zSchema))
+
+	rv := C.sqlite3_snapshot_open(c.db, zSchema, snapshot.s)
+	runtime.KeepAlive(snapshot)
+	if rv != C.SQLITE_OK {
+		return newError(rv)
+	}
+
+	return nil
+}
+
+// RecoverSnapshots makes the snapshots of the given schema that are still
+// in the WAL available again after the database was closed and reopened.
+// See https://sqlite.org/c3ref/snapshot_recover.html.
+func (c *SQLiteConn) RecoverSnapshots(schema string) error {
+	zSchema := C.CString(schema)
+	defer C.free(unsafe.Pointer(zSchema))
+
+	if rv := C.sqlite3_snapshot_recover(c.db, zSchema); rv != C.SQLITE_OK {
+		return newError(rv)
+	}
+
+	return nil
+}
+
+// Compare returns a negative number if the snapshot is older than the
+// given one, zero if they are the same, and a positive number if it is
+// newer. The result is only meaningful if both snapshots were taken from
+// the same database, and the WAL was not reset in between. It fails with
+// ErrSnapshotFreed if any of the snapshots was freed.
+func (s *Snapshot) Compare(other *Snapshot) (int, error) {
+	if s.s == nil || other.s == nil {
+		return 0, ErrSnapshotFreed
+	}
+
+	cmp := C.sqlite3_snapshot_cmp(s.s, other.s)
+	runtime.KeepAlive(s)
+	runtime.KeepAlive(other)
+
+	return int(cmp), nil
+}
+
+// Free releases the memory used by the snapshot.
+func (s *Snapshot) Free() {
+	if s.s == nil {
+		return
+	}
+	C.sqlite3_snapshot_free(s.s)
+	s.s = nil
+	runtime.SetFinalizer(s, nil)
+}
+
+type snapshotContextKey struct{}
+
+type snapshotContext struct {
+	schema   string
+	snapshot *Snapshot
+}
+
+// WithSnapshot returns a copy of the given context that makes transactions
+// started with it read the given snapshot of the given schema. Such
+// transactions always start with a plain BEGIN, regardless of the _txlock
+// setting and of the isolation level, since a snapshot can only be opened
+// before the transaction reads or writes.
+//
+//   tx, err := db.BeginTx(sqlite3.WithSnapshot(ctx, "main", snapshot), nil)
+//
+func WithSnapshot(ctx context.Context, schema string, snapshot *Snapshot) context.Context {
+	return context.WithValue(ctx, snapshotContextKey{}, snapshotContext{
+		schema:   schema,
+		snapshot: snapshot,
+	})
+}
+
+// Return true if a snapshot is attached to the given context.
+func hasContextSnapshot(ctx context.Context) bool {
+	_, ok := ctx.Value(snapshotContextKey{}).(snapshotContext)
+	return ok
+}
+
+// Open the snapshot attached to the given context with WithSnapshot, if
+// any, in the transaction that was just started.
+func (c *SQLiteConn) openContextSnapshot(ctx context.Context) error {
+	value, ok := ctx.Value(snapshotContextKey{}).(snapshotContext)
+	if !ok {
+		return nil
+	}
+
+	return c.OpenSnapshot(value.schema, value.snapshot)
+}
@@ -0,0 +1,16 @@
+// +build !snapshot
+
+package sqlite3
+
+import (
+	"context"
+)
+
+// Snapshots are only available when building with the snapshot tag.
+func hasContextSnapshot(ctx context.Context) bool {
+	return false
+}
+
+func (c *SQLiteConn) openContextSnapshot(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,185 @@
+// +build snapshot
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	writer := conni.(*SQLiteConn)
+	defer writer.Close()
+	conni, err = drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	reader := conni.(*SQLiteConn)
+	defer reader.Close()
+
+	pragmaWAL(t, writer)
+	if _, err := writer.Exec("CREATE TABLE test (n INT); INSERT INTO test(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	snapshot1 := getTestSnapshot(t, reader)
+	defer snapshot1.Free()
+
+	if _, err := writer.Exec("INSERT INTO test(n) VALUES(2)", nil); err != nil {
+		t.Fatal("failed to insert value", err)
+	}
+
+	snapshot2 := getTestSnapshot(t, reader)
+	defer snapshot2.Free()
+
+	if compareTestSnapshots(t, snapshot1, snapshot2) >= 0 ||
+		compareTestSnapshots(t, snapshot2, snapshot1) <= 0 ||
+		compareTestSnapshots(t, snapshot1, snapshot1) != 0 {
+		t.Error("expected first snapshot to be older than the second one")
+	}
+
+	// A transaction started with the snapshot doesn't see later changes.
+	tx, err := reader.BeginTx(WithSnapshot(context.Background(), "main", snapshot1), driver.TxOptions{})
+	if err != nil {
+		t.Fatal("failed to begin transaction at snapshot", err)
+	}
+	assertTestTableCount(t, reader, 1)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("failed to rollback transaction", err)
+	}
+	assertTestTableCount(t, reader, 2)
+
+	// Snapshots can be opened explicitly too.
+	if _, err := reader.Exec("BEGIN", nil); err != nil {
+		t.Fatal("failed to begin transaction", err)
+	}
+	if err := reader.OpenSnapshot("main", snapshot1); err != nil {
+		t.Fatal("failed to open snapshot", err)
+	}
+	assertTestTableCount(t, reader, 1)
+	if _, err := reader.Exec("ROLLBACK", nil); err != nil {
+		t.Fatal("failed to rollback transaction", err)
+	}
+
+	// After a checkpoint that resets the WAL, old snapshots are gone.
+	if _, err := writer.Exec("PRAGMA wal_checkpoint(TRUNCATE); INSERT INTO test(n) VALUES(3)", nil); err != nil {
+		t.Fatal("failed to checkpoint", err)
+	}
+	_, err = reader.BeginTx(WithSnapshot(context.Background(), "main", snapshot1), driver.TxOptions{})
+	if err == nil || err.(Error).ExtendedCode != ErrBusySnapshot {
+		t.Fatalf("expected stale snapshot to fail with busy snapshot error, got %v", err)
+	}
+	if !reader.AutoCommit() {
+		t.Error("expected failed transaction to be rolled back")
+	}
+}
+
+// Freed snapshots can't be opened or compared.
+func TestSnapshot_Freed(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	snapshot := getTestSnapshot(t, conn)
+	other := getTestSnapshot(t, conn)
+	defer other.Free()
+	snapshot.Free()
+
+	if _, err := snapshot.Compare(other); err != ErrSnapshotFreed {
+		t.Errorf("expected compare of freed snapshot to fail, got %v", err)
+	}
+	if _, err := other.Compare(snapshot); err != ErrSnapshotFreed {
+		t.Errorf("expected compare with freed snapshot to fail, got %v", err)
+	}
+	_, err = conn.BeginTx(WithSnapshot(context.Background(), "main", snapshot), driver.TxOptions{})
+	if err != ErrSnapshotFreed {
+		t.Fatalf("expected opening freed snapshot to fail, got %v", err)
+	}
+	if !conn.AutoCommit() {
+		t.Error("expected failed transaction to be rolled back")
+	}
+}
+
+// Transactions reading a snapshot start with a plain BEGIN, even if the
+// connection uses a different locking behavior.
+func TestSnapshot_TxLock(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename + "?_txlock=immediate")
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	snapshot := getTestSnapshot(t, conn)
+	defer snapshot.Free()
+
+	tx, err := conn.BeginTx(WithSnapshot(context.Background(), "main", snapshot), driver.TxOptions{})
+	if err != nil {
+		t.Fatal("failed to begin transaction at snapshot", err)
+	}
+	assertTestTableCount(t, conn, 0)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal("failed to rollback transaction", err)
+	}
+}
+
+// Compare two snapshots, failing the test on error.
+func compareTestSnapshots(t *testing.T, s1, s2 *Snapshot) int {
+	cmp, err := s1.Compare(s2)
+	if err != nil {
+		t.Fatal("failed to compare snapshots", err)
+	}
+	return cmp
+}
+
+// Return a snapshot of the current version of the database.
+func getTestSnapshot(t *testing.T, conn *SQLiteConn) *Snapshot {
+	if _, err := conn.Exec("BEGIN; SELECT count(*) FROM test", nil); err != nil {
+		t.Fatal("failed to begin read transaction", err)
+	}
+	snapshot, err := conn.GetSnapshot("main")
+	if err != nil {
+		t.Fatal("failed to get snapshot", err)
+	}
+	if _, err := conn.Exec("COMMIT", nil); err != nil {
+		t.Fatal("failed to end read transaction", err)
+	}
+	return snapshot
+}
@@ -0,0 +1,164 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+*/
+import "C"
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Clone duplicates the database file with the given name, together with
+// its WAL or rollback journal if present, under a new name.
+//
+// The clone shares the content of the original files until either of them
+// is modified, so it takes constant time regardless of the size of the
+// database. The first write to a shared file makes a private copy of it.
+//
+// Writers are not quiesced: the clone captures the state of the files at a
+// single instant, which is what a crash at that instant would leave behind.
+// Any transaction that was in progress gets rolled back when the clone is
+// first opened, just like after a crash.
+//
+// It returns an error if the source database doesn't exist, or if any of
+// the destination files already exists.
+func (fs *VolatileFileSystem) Clone(src, dst string) error {
+	fs.vfs.mu.Lock()
+	defer fs.vfs.mu.Unlock()
+
+	if _, ok := fs.vfs.files[src]; !ok {
+		return errors.Errorf("no such file %s", src)
+	}
+
+	srcNames := []string{}
+	dstNames := []string{}
+	for _, suffix := range []string{"", "-journal", "-wal"} {
+		if _, ok := fs.vfs.files[dst+suffix]; ok {
+			return errors.Errorf("file %s already exists", dst+suffix)
+		}
+		if _, ok := fs.vfs.files[src+suffix]; ok {
+			srcNames = append(srcNames, src+suffix)
+			dstNames = append(dstNames, dst+suffix)
+		}
+	}
+
+	data := fs.vfs.share(srcNames)
+	if rc := fs.vfs.addShared(dstNames, data); rc != C.SQLITE_OK {
+		return Error{
+			Code:         ErrNo(rc),
+			ExtendedCode: ErrNoExtended(rc),
+		}
+	}
+
+	return nil
+}
+
+// Fork registers a new volatile file system under the given name, holding
+// a clone of every file of this one. The new file system is configured
+// with the given options, not with the ones of this file system.
+//
+// As with Clone, the files are captured at a single instant and their
+// content is shared until modified.
+func (fs *VolatileFileSystem) Fork(name string, options ...VolatileOption) (*VolatileFileSystem, error) {
+	fork := RegisterVolatileFileSystem(name, options...)
+
+	fs.vfs.mu.RLock()
+	names := make([]string, 0, len(fs.vfs.files))
+	for name := range fs.vfs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := fs.vfs.share(names)
+	fs.vfs.mu.RUnlock()
+
+	fork.vfs.mu.Lock()
+	rc := fork.vfs.addShared(names, data)
+	fork.vfs.mu.Unlock()
+
+	if rc != C.SQLITE_OK {
+		UnregisterVolatileFileSystem(fork)
+		return nil, Error{
+			Code:         ErrNo(rc),
+			ExtendedCode: ErrNoExtended(rc),
+		}
+	}
+
+	return fork, nil
+}
+
+// Return the content of the files with the given names, captured while
+// holding the locks of all of them, and mark it as shared. The caller must
+// hold the VFS lock.
+func (vfs *volatileVFS) share(names []string) [][]byte {
+	files := make([]*volatileFile, len(names))
+	for i, name := range names {
+		files[i] = vfs.files[name]
+		files[i].mu.Lock()
+	}
+
+	data := make([][]byte, len(files))
+	for i, file := range files {
+		// Memory referenced by fetched pages gets modified in place, so
+		// it can't be shared.
+		if file.mapped != nil {
+			data[i] = make([]byte, len(file.data))
+			copy(data[i], file.data)
+			continue
+		}
+		// Limit the capacity of the shared slice, so appends always
+		// re-allocate instead of writing past its end.
+		data[i] = file.data[:len(file.data):len(file.data)]
+		file.cow = true
+	}
+
+	for _, file := range files {
+		file.mu.Unlock()
+	}
+
+	return data
+}
+
+// Add new files with the given names, sharing the given content. If the
+// quota is exceeded, none of the files is added. The caller must hold the
+// VFS lock.
+func (vfs *volatileVFS) addShared(names []string, data [][]byte) C.int {
+	for i, name := range names {
+		if rc := vfs.quota.GrowFile(0, len(data[i])); rc != C.SQLITE_OK {
+			for _, name := range names[:i] {
+				vfs.remove(vfs.files[name])
+			}
+			return rc
+		}
+
+		file := newVolatileFile(name, vfs.quota, vfs.events)
+		file.data = data[i]
+		file.cow = true
+		if vfs.crash {
+			file.unsynced = newVolatileUnsynced(data[i])
+		}
+		vfs.files[name] = file
+		vfs.events.Create(name)
+		vfs.events.Replace(name, data[i])
+	}
+
+	return C.SQLITE_OK
+}
+
+// Make a private copy of the content of the file, if it's shared with a
+// clone. It must be called before modifying the content.
+func (f *volatileFile) own() {
+	if !f.cow {
+		return
+	}
+
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+	f.data = data
+	f.cow = false
+}
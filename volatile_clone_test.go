@@ -0,0 +1,123 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+// A cloned database has the committed content of the original one, and the
+// two evolve independently.
+func Test_VolatileVFSClone(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)}); err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+
+	// A transaction in progress is not part of the clone.
+	if _, err := conn.Exec("BEGIN; INSERT INTO test(n) VALUES(10)", nil); err != nil {
+		t.Fatal("failed to begin transaction", err)
+	}
+	if err := fs.Clone("test.db", "clone.db"); err != nil {
+		t.Fatal("failed to clone database", err)
+	}
+	if _, err := conn.Exec("COMMIT", nil); err != nil {
+		t.Fatal("failed to commit transaction", err)
+	}
+
+	if _, err := fs.FileSize("clone.db-wal"); err != nil {
+		t.Fatal("expected the WAL to be cloned", err)
+	}
+
+	conni, err = drv.Open("file:clone.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection to clone", err)
+	}
+	clone := conni.(*SQLiteConn)
+	defer clone.Close()
+
+	assertTestTableCount(t, clone, 10)
+	assertIntegrity(t, clone)
+
+	if _, err := clone.Exec("DELETE FROM test", nil); err != nil {
+		t.Fatal("failed to delete values from clone", err)
+	}
+	assertTestTableCount(t, clone, 0)
+	assertTestTableCount(t, conn, 11)
+
+	if err := fs.Clone("test.db", "clone.db"); err == nil {
+		t.Error("expected clone over existing database to fail")
+	}
+	if err := fs.Clone("missing.db", "other.db"); err == nil {
+		t.Error("expected clone of missing database to fail")
+	}
+}
+
+// A forked file system holds a copy of all files, which evolve
+// independently.
+func Test_VolatileVFSFork(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if _, err := conn.Exec("INSERT INTO test(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to insert value", err)
+	}
+
+	fork, err := fs.Fork("fork")
+	if err != nil {
+		t.Fatal("failed to fork file system", err)
+	}
+	defer UnregisterVolatileFileSystem(fork)
+
+	if _, err := conn.Exec("INSERT INTO test(n) VALUES(2)", nil); err != nil {
+		t.Fatal("failed to insert value", err)
+	}
+
+	conni, err = drv.Open("file:test.db?vfs=fork")
+	if err != nil {
+		t.Fatal("failed to open connection with forked VFS", err)
+	}
+	forked := conni.(*SQLiteConn)
+	defer forked.Close()
+
+	assertTestTableCount(t, forked, 1)
+	assertTestTableCount(t, conn, 2)
+
+	size, err := fork.FileSize("test.db")
+	if err != nil {
+		t.Fatal("failed to get forked database size", err)
+	}
+	if fork.Usage().Files != size {
+		t.Errorf("expected fork usage to account for its files, got %+v", fork.Usage())
+	}
+
+	if _, err := fs.Fork("small", VolatileMaxSize(1)); err == nil {
+		t.Error("expected fork exceeding the quota to fail")
+	}
+}
@@ -0,0 +1,195 @@
+package sqlite3
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Size of the sectors that a torn write is split into when simulating a
+// crash.
+const volatileCrashSectorSize = 512
+
+// VolatileCrashSimulation turns on tracking of the writes and truncates
+// that were not followed by a sync, so that VolatileFileSystem.Crash and
+// VolatileFileSystem.CrashRandom can simulate a power loss.
+//
+// Tracking keeps a copy of the last synced content of every file, so the
+// memory used by the file system roughly doubles. It's meant for tests.
+func VolatileCrashSimulation() VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.crash = true
+	}
+}
+
+// Crash simulates a power loss, discarding every write and truncate that
+// was not followed by a sync. File creations and deletions are considered
+// durable.
+//
+// Connections that were open at the time of the crash can't be used
+// anymore, all their I/O operations fail with SQLITE_IOERR. They should be
+// closed before opening new connections against the file system, which
+// will see the post-crash content.
+//
+// It returns an error if the file system was not registered with the
+// VolatileCrashSimulation option.
+func (fs *VolatileFileSystem) Crash() error {
+	return fs.vfs.Crash(nil)
+}
+
+// CrashRandom is like Crash, but instead of discarding all unsynced changes
+// it decides randomly which ones survive, using a pseudo-random source
+// seeded with the given value. Each unsynced write is either lost, kept or
+// torn, keeping only some of its sectors. Each unsynced truncate is either
+// lost or kept.
+//
+// The same seed applied to the same sequence of changes always produces
+// the same post-crash content.
+func (fs *VolatileFileSystem) CrashRandom(seed int64) error {
+	return fs.vfs.Crash(rand.New(rand.NewSource(seed)))
+}
+
+// Crash replaces every file with a new one holding its post-crash content,
+// and marks the old file as crashed.
+func (vfs *volatileVFS) Crash(r *rand.Rand) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	if !vfs.crash {
+		return errors.New("crash simulation is not enabled")
+	}
+
+	// Iterate in a stable order, so random crashes are reproducible.
+	names := make([]string, 0, len(vfs.files))
+	for name := range vfs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		old := vfs.files[name]
+
+		old.mu.Lock()
+		data := old.unsynced.Crash(r)
+		size := len(old.data)
+		old.crashed = true
+		old.mu.Unlock()
+
+		file := newVolatileFile(name, vfs.quota, vfs.events)
+		file.data = data
+		file.unsynced = newVolatileUnsynced(data)
+
+		vfs.quota.ShrinkFile(size, len(data))
+		vfs.files[name] = file
+		vfs.events.Replace(name, data)
+	}
+
+	return nil
+}
+
+// Track the changes made to a volatile file since it was last synced.
+type volatileUnsynced struct {
+	durable []byte            // Content of the file as of the last sync.
+	ops     []volatileCrashOp // Changes since the last sync, in order.
+}
+
+// A single unsynced write or truncate.
+type volatileCrashOp struct {
+	data   []byte // Written data, or nil for truncates.
+	offset int    // Offset of the write, or new size for truncates.
+}
+
+func newVolatileUnsynced(data []byte) *volatileUnsynced {
+	durable := make([]byte, len(data))
+	copy(durable, data)
+	return &volatileUnsynced{durable: durable}
+}
+
+// Write records a write of the given data at the given offset.
+func (u *volatileUnsynced) Write(data []byte, offset int) {
+	op := volatileCrashOp{data: make([]byte, len(data)), offset: offset}
+	copy(op.data, data)
+	u.ops = append(u.ops, op)
+}
+
+// Truncate records a truncate to the given size.
+func (u *volatileUnsynced) Truncate(size int) {
+	u.ops = append(u.ops, volatileCrashOp{offset: size})
+}
+
+// Sync makes all recorded changes durable.
+func (u *volatileUnsynced) Sync() {
+	for _, op := range u.ops {
+		u.durable = op.Apply(u.durable)
+	}
+	u.ops = nil
+}
+
+// Crash returns the content of the file after a simulated crash. If r is
+// nil all changes are lost, otherwise it's used to pick the ones that
+// survive.
+func (u *volatileUnsynced) Crash(r *rand.Rand) []byte {
+	data := make([]byte, len(u.durable))
+	copy(data, u.durable)
+
+	if r == nil {
+		return data
+	}
+
+	for _, op := range u.ops {
+		if op.data == nil {
+			if r.Intn(2) == 1 {
+				data = op.Apply(data)
+			}
+			continue
+		}
+		switch r.Intn(3) {
+		case 0: // Lost
+		case 1: // Kept
+			data = op.Apply(data)
+		case 2: // Torn
+			for _, sector := range op.Sectors() {
+				if r.Intn(2) == 1 {
+					data = sector.Apply(data)
+				}
+			}
+		}
+	}
+
+	return data
+}
+
+// Apply the change to the given content, returning the new content.
+func (op volatileCrashOp) Apply(data []byte) []byte {
+	if op.data == nil {
+		if op.offset < len(data) {
+			data = data[:op.offset]
+		} else {
+			data = append(data, make([]byte, op.offset-len(data))...)
+		}
+		return data
+	}
+
+	if end := op.offset + len(op.data); end > len(data) {
+		data = append(data, make([]byte, end-len(data))...)
+	}
+	copy(data[op.offset:], op.data)
+
+	return data
+}
+
+// Sectors splits a write into writes that don't cross sector boundaries.
+func (op volatileCrashOp) Sectors() []volatileCrashOp {
+	sectors := []volatileCrashOp{}
+	for i := 0; i < len(op.data); {
+		offset := op.offset + i
+		n := volatileCrashSectorSize - offset%volatileCrashSectorSize
+		if n > len(op.data)-i {
+			n = len(op.data) - i
+		}
+		sectors = append(sectors, volatileCrashOp{data: op.data[i : i+n], offset: offset})
+		i += n
+	}
+	return sectors
+}
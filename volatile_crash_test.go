@@ -0,0 +1,185 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// Committed transactions survive a crash, uncommitted ones are lost.
+func Test_VolatileVFSCrash(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("PRAGMA synchronous=FULL", nil); err != nil {
+		t.Fatal("failed to set synchronous mode", err)
+	}
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)})
+		if err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+
+	// Leave a transaction open.
+	if _, err := conn.Exec("BEGIN; INSERT INTO test(n) VALUES(10)", nil); err != nil {
+		t.Fatal("failed to insert uncommitted value", err)
+	}
+
+	if err := fs.Crash(); err != nil {
+		t.Fatal("failed to crash volatile VFS", err)
+	}
+
+	// The old connection is unusable.
+	if _, err := conn.Exec("COMMIT", nil); err == nil {
+		t.Fatal("expected commit after crash to fail")
+	}
+	conn.Close()
+
+	conni, err = drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection after crash", err)
+	}
+	conn = conni.(*SQLiteConn)
+	defer conn.Close()
+
+	assertTestTableRows(t, conn, 10)
+	assertIntegrity(t, conn)
+	assertTestTableCount(t, conn, 10)
+}
+
+// A random crash in the middle of a transaction that spills to the
+// database file leaves it consistent, with only committed data in it.
+func Test_VolatileVFSCrashRandom(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		fs := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+
+		drv := &SQLiteDriver{}
+		conni, err := drv.Open("file:test.db?vfs=volatile")
+		if err != nil {
+			t.Fatal("failed to open connection with volatile VFS", err)
+		}
+		conn := conni.(*SQLiteConn)
+
+		if _, err := conn.Exec("PRAGMA cache_size=2", nil); err != nil {
+			t.Fatal("failed to set cache size", err)
+		}
+		if _, err := conn.Exec("CREATE TABLE test (n INT, s TEXT)", nil); err != nil {
+			t.Fatal("failed to create table", err)
+		}
+		insert := "INSERT INTO test(n, s) VALUES(?, ?)"
+		s := strings.Repeat("x", 1000)
+		for i := 0; i < 20; i++ {
+			if _, err := conn.Exec(insert, []driver.Value{int64(i), s}); err != nil {
+				t.Fatal("failed to insert value", err)
+			}
+		}
+
+		if _, err := conn.Exec("BEGIN; UPDATE test SET s = s || 'y'", nil); err != nil {
+			t.Fatal("failed to update values", err)
+		}
+		for i := 20; i < 40; i++ {
+			if _, err := conn.Exec(insert, []driver.Value{int64(i), s}); err != nil {
+				t.Fatal("failed to insert uncommitted value", err)
+			}
+		}
+
+		if err := fs.CrashRandom(seed); err != nil {
+			t.Fatal("failed to crash volatile VFS", err)
+		}
+		conn.Close()
+
+		conni, err = drv.Open("file:test.db?vfs=volatile")
+		if err != nil {
+			t.Fatal("failed to open connection after crash", err)
+		}
+		conn = conni.(*SQLiteConn)
+
+		assertIntegrity(t, conn)
+		assertTestTableCount(t, conn, 20)
+
+		conn.Close()
+		UnregisterVolatileFileSystem(fs)
+	}
+}
+
+// Truncates that grow a file survive a crash once synced.
+func Test_VolatileVFSCrashTruncateGrow(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+	defer UnregisterVolatileFileSystem(fs)
+
+	if err := fs.CreateFile("test", []byte("hello")); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+	file, _ := fs.vfs.FileByName("test")
+
+	file.Truncate(4096)
+	file.Sync()
+	file.Truncate(8192)
+
+	if err := fs.Crash(); err != nil {
+		t.Fatal("failed to crash volatile VFS", err)
+	}
+
+	data, err := fs.ReadFile("test")
+	if err != nil {
+		t.Fatal("failed to read file", err)
+	}
+	if len(data) != 4096 {
+		t.Fatalf("expected size to be 4096, got %d", len(data))
+	}
+	if string(data[:5]) != "hello" {
+		t.Errorf("expected content to be preserved, got %q", data[:5])
+	}
+}
+
+// Crashing is only possible with the VolatileCrashSimulation option.
+func Test_VolatileVFSCrashNotEnabled(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	if err := fs.Crash(); err == nil {
+		t.Fatal("expected crash without simulation enabled to fail")
+	}
+}
+
+func assertIntegrity(t *testing.T, conn *SQLiteConn) {
+	rows, err := conn.Query("PRAGMA integrity_check", nil)
+	if err != nil {
+		t.Fatal("failed to check integrity", err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		t.Fatal("failed to fetch integrity check result", err)
+	}
+	if result := string(values[0].([]byte)); result != "ok" {
+		t.Fatalf("expected integrity check to be ok, got %s", result)
+	}
+}
+
+func assertTestTableCount(t *testing.T, conn *SQLiteConn, n int) {
+	rows, err := conn.Query("SELECT count(*) FROM test", nil)
+	if err != nil {
+		t.Fatal("failed to count test table rows", err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil {
+		t.Fatal("failed to fetch test table count", err)
+	}
+	if count := values[0].(int64); int(count) != n {
+		t.Fatalf("expected %d rows, got %d", n, count)
+	}
+}
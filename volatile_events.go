@@ -0,0 +1,141 @@
+package sqlite3
+
+import (
+	"sync"
+)
+
+// VolatileEventType identifies the kind of change a VolatileEvent
+// describes.
+type VolatileEventType int
+
+// Kinds of changes to volatile files.
+const (
+	VolatileCreate   VolatileEventType = iota // A file was created.
+	VolatileWrite                             // Data was written to a file.
+	VolatileTruncate                          // A file was truncated or extended.
+	VolatileDelete                            // A file was deleted.
+)
+
+// VolatileEvent describes a change to a file of a volatile file system.
+type VolatileEvent struct {
+	Type   VolatileEventType
+	Name   string // Name of the file.
+	Offset int    // Offset of the written data, or new size of the file.
+	Length int    // Length of the written data.
+
+	// Written data. It's only valid until the callback returns, and must
+	// be copied to be retained.
+	Data []byte
+}
+
+// Subscribe registers a callback that gets invoked for every change to
+// the files of the volatile file system, and returns a function that
+// cancels the subscription.
+//
+// Replacing the whole content of a file, as CreateFile and simulated
+// crashes do, is reported as a truncate to zero followed by a write, so
+// applying every event in order to a copy of the files keeps it identical
+// to the volatile file system.
+//
+// The callback is invoked synchronously from within the VFS, while the
+// changed file is locked, so events of the same file are delivered in
+// order. It must not use the file system, nor any connection to it.
+func (fs *VolatileFileSystem) Subscribe(callback func(VolatileEvent)) func() {
+	return fs.vfs.events.Subscribe(callback)
+}
+
+// Dispatch change events to subscribers.
+type volatileEvents struct {
+	mu        sync.RWMutex
+	callbacks map[int]func(VolatileEvent)
+	serial    int // Serial number for subscriptions.
+}
+
+func newVolatileEvents() *volatileEvents {
+	return &volatileEvents{
+		callbacks: make(map[int]func(VolatileEvent)),
+	}
+}
+
+// Subscribe adds the given callback, returning a function to remove it.
+func (e *volatileEvents) Subscribe(callback func(VolatileEvent)) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.serial
+	e.serial++
+	e.callbacks[id] = callback
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.callbacks, id)
+	}
+}
+
+// Create publishes the creation of a file.
+func (e *volatileEvents) Create(name string) {
+	e.publish(func() VolatileEvent {
+		return VolatileEvent{Type: VolatileCreate, Name: name}
+	})
+}
+
+// Write publishes a write of the given data.
+func (e *volatileEvents) Write(name string, data []byte, offset int) {
+	e.publish(func() VolatileEvent {
+		return VolatileEvent{
+			Type:   VolatileWrite,
+			Name:   name,
+			Offset: offset,
+			Length: len(data),
+			Data:   data,
+		}
+	})
+}
+
+// Truncate publishes a change of the size of a file.
+func (e *volatileEvents) Truncate(name string, size int) {
+	e.publish(func() VolatileEvent {
+		return VolatileEvent{Type: VolatileTruncate, Name: name, Offset: size}
+	})
+}
+
+// Replace publishes the replacement of the whole content of a file.
+func (e *volatileEvents) Replace(name string, data []byte) {
+	e.Truncate(name, 0)
+	if len(data) > 0 {
+		e.Write(name, data, 0)
+	}
+}
+
+// Delete publishes the deletion of a file.
+func (e *volatileEvents) Delete(name string) {
+	e.publish(func() VolatileEvent {
+		return VolatileEvent{Type: VolatileDelete, Name: name}
+	})
+}
+
+// Invoke all callbacks with the event built by the given function, which
+// is only called if there are subscribers.
+func (e *volatileEvents) publish(event func() VolatileEvent) {
+	if e == nil {
+		return // Anonymous temporary file.
+	}
+
+	e.mu.RLock()
+	if len(e.callbacks) == 0 {
+		e.mu.RUnlock()
+		return
+	}
+	callbacks := make([]func(VolatileEvent), 0, len(e.callbacks))
+	for _, callback := range e.callbacks {
+		callbacks = append(callbacks, callback)
+	}
+	e.mu.RUnlock()
+
+	evt := event()
+	for _, callback := range callbacks {
+		callback(evt)
+	}
+}
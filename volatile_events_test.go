@@ -0,0 +1,85 @@
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"testing"
+)
+
+// Applying change events to a copy of the files keeps it identical to the
+// volatile file system.
+func Test_VolatileVFSSubscribe(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	mirror := make(map[string][]byte)
+	created := make(map[string]bool)
+	deleted := make(map[string]bool)
+	unsubscribe := fs.Subscribe(func(event VolatileEvent) {
+		data := mirror[event.Name]
+		switch event.Type {
+		case VolatileCreate:
+			created[event.Name] = true
+			mirror[event.Name] = []byte{}
+		case VolatileWrite:
+			if end := event.Offset + event.Length; end > len(data) {
+				data = append(data, make([]byte, end-len(data))...)
+			}
+			copy(data[event.Offset:], event.Data)
+			mirror[event.Name] = data
+		case VolatileTruncate:
+			if event.Offset > len(data) {
+				data = append(data, make([]byte, event.Offset-len(data))...)
+			}
+			mirror[event.Name] = data[:event.Offset]
+		case VolatileDelete:
+			deleted[event.Name] = true
+			delete(mirror, event.Name)
+		}
+	})
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)})
+		if err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+	if err := fs.CreateFile("other.db", []byte("other")); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+
+	if !created["test.db"] || !created["test.db-journal"] || !deleted["test.db-journal"] {
+		t.Errorf("expected database and journal events, got created %v, deleted %v", created, deleted)
+	}
+	if len(mirror) != 2 {
+		t.Fatalf("expected 2 files in mirror, got %d", len(mirror))
+	}
+	for name, data := range mirror {
+		expected, err := fs.ReadFile(name)
+		if err != nil {
+			t.Fatal("failed to read file", err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("mirror of %s differs from the volatile file", name)
+		}
+	}
+
+	unsubscribe()
+	if err := fs.Remove("other.db"); err != nil {
+		t.Fatal("failed to remove file", err)
+	}
+	if deleted["other.db"] {
+		t.Error("expected no events after unsubscribing")
+	}
+}
@@ -0,0 +1,72 @@
+// +build go1.21
+
+package sqlite3
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Keep the memory referenced by fetched pages in place, so that SQLite can
+// hold pointers to it.
+type volatilePinner struct {
+	runtime.Pinner
+}
+
+// MmapSize returns the maximum offset of the pages that can be fetched,
+// changing it first if the given value is not negative.
+func (f *volatileFile) MmapSize(size int64) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev := f.mmapSize
+	if size >= 0 {
+		f.mmapSize = size
+	}
+
+	return prev
+}
+
+// Fetch returns a pointer to the given range of the content of the file,
+// which SQLite reads directly until the page is released with Unfetch. It
+// returns nil if the range can't be fetched, in which case SQLite falls
+// back to Read.
+//
+// Like with a memory-mapped file, pages that were fetched keep reflecting
+// writes to the file. If the file grows while pages are fetched, the new
+// content can't be fetched until all pages are released.
+func (f *volatileFile) Fetch(offset, n int) unsafe.Pointer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed || n <= 0 || int64(offset+n) > f.mmapSize || offset+n > len(f.data) {
+		return nil
+	}
+
+	if f.mapped == nil {
+		f.own()
+		f.mapped = f.data
+		f.pinner.Pin(&f.mapped[0])
+	}
+	if offset+n > len(f.mapped) {
+		return nil
+	}
+	f.fetches++
+
+	return unsafe.Pointer(&f.mapped[offset])
+}
+
+// Unfetch releases a page returned by Fetch.
+func (f *volatileFile) Unfetch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fetches == 0 {
+		return
+	}
+	f.fetches--
+	if f.fetches == 0 {
+		f.pinner.Unpin()
+		f.mapped = nil
+	}
+}
@@ -0,0 +1,25 @@
+// +build !go1.21
+
+package sqlite3
+
+import (
+	"unsafe"
+)
+
+// Pinning memory referenced by C code requires runtime.Pinner, so pages
+// can't be fetched and SQLite always falls back to xRead.
+type volatilePinner struct{}
+
+// MmapSize always returns zero, since memory-mapped I/O is not supported.
+func (f *volatileFile) MmapSize(size int64) int64 {
+	return 0
+}
+
+// Fetch always returns nil, since memory-mapped I/O is not supported.
+func (f *volatileFile) Fetch(offset, n int) unsafe.Pointer {
+	return nil
+}
+
+// Unfetch is a no-op, since memory-mapped I/O is not supported.
+func (f *volatileFile) Unfetch() {
+}
@@ -0,0 +1,93 @@
+// +build go1.21
+
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"io"
+	"testing"
+)
+
+// With mmap_size set, pages are read directly from the volatile file's
+// memory, and stay consistent while the file grows.
+func Test_VolatileVFSMmap(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT, s TEXT); CREATE TABLE other (s TEXT)", nil); err != nil {
+		t.Fatal("failed to create tables", err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err := conn.Exec("INSERT INTO test(n, s) VALUES(?, zeroblob(1000))", []driver.Value{int64(i)})
+		if err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+
+	// Read with another connection, whose page cache is empty.
+	conni, err = drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open reader connection", err)
+	}
+	reader := conni.(*SQLiteConn)
+	defer reader.Close()
+	if _, err := reader.Exec("PRAGMA mmap_size=1048576", nil); err != nil {
+		t.Fatal("failed to set mmap size", err)
+	}
+
+	before, err := fs.FileStats("test.db")
+	if err != nil {
+		t.Fatal("failed to get database stats", err)
+	}
+
+	// Grow the file while pages are fetched by an open cursor.
+	rows, err := reader.Query("SELECT n FROM test ORDER BY n", nil)
+	if err != nil {
+		t.Fatal("failed to query test table", err)
+	}
+	values := make([]driver.Value, 1)
+	n := int64(0)
+	for ; ; n++ {
+		err := rows.Next(values)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("failed to fetch row", err)
+		}
+		if values[0] != n {
+			t.Fatalf("expected row %d, got %v", n, values[0])
+		}
+		if n == 50 {
+			_, err := conn.Exec("INSERT INTO other(s) SELECT zeroblob(10000) FROM test", nil)
+			if err != nil {
+				t.Fatal("failed to grow database", err)
+			}
+		}
+	}
+	rows.Close()
+	if n != 100 {
+		t.Fatalf("expected 100 rows, got %d", n)
+	}
+
+	after, err := fs.FileStats("test.db")
+	if err != nil {
+		t.Fatal("failed to get database stats", err)
+	}
+	if after.Size <= before.Size {
+		t.Errorf("expected database to grow, got %d", after.Size)
+	}
+	if reads := after.Reads - before.Reads; reads > 10 {
+		t.Errorf("expected pages to be fetched instead of read, got %d reads", reads)
+	}
+
+	assertIntegrity(t, reader)
+}
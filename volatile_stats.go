@@ -0,0 +1,129 @@
+package sqlite3
+
+/*
+#ifndef USE_LIBSQLITE3
+#include <sqlite3-binding.h>
+#else
+#include <sqlite3.h>
+#endif
+*/
+import "C"
+import (
+	"sync"
+)
+
+// VolatileFileStats holds I/O statistics about a single volatile file,
+// accumulated since the file was created, or since the last simulated
+// crash.
+type VolatileFileStats struct {
+	Size         int   // Current size of the file.
+	Reads        int64 // Number of reads.
+	BytesRead    int64 // Number of bytes requested by reads.
+	Writes       int64 // Number of writes.
+	BytesWritten int64 // Number of bytes written.
+	Truncates    int64 // Number of truncates.
+	Syncs        int64 // Number of syncs.
+	Locks        int64 // Number of lock acquisitions.
+	Unlocks      int64 // Number of lock releases.
+	ShmMaps      int64 // Number of shared memory region mappings.
+	ShmUnmaps    int64 // Number of shared memory unmappings.
+}
+
+// FileStats returns I/O statistics about the volatile file with the given
+// name.
+//
+// If the file does not exists, an error is returned.
+func (fs *VolatileFileSystem) FileStats(name string) (VolatileFileStats, error) {
+	file, rc := fs.vfs.FileByName(name)
+	if rc != C.SQLITE_OK {
+		return VolatileFileStats{}, Error{
+			Code:         ErrIoErr,
+			ExtendedCode: ErrIoErrRead,
+		}
+	}
+
+	stats := file.stats.Get()
+	stats.Size = file.Size()
+
+	return stats, nil
+}
+
+// Track the I/O statistics of a volatile file.
+type volatileStats struct {
+	mu    sync.Mutex
+	stats VolatileFileStats
+}
+
+// Get returns a copy of the current statistics.
+func (s *volatileStats) Get() VolatileFileStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// Read records a read of n bytes.
+func (s *volatileStats) Read(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Reads++
+	s.stats.BytesRead += int64(n)
+}
+
+// Write records a write of n bytes.
+func (s *volatileStats) Write(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Writes++
+	s.stats.BytesWritten += int64(n)
+}
+
+// Truncate records a truncate.
+func (s *volatileStats) Truncate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Truncates++
+}
+
+// Sync records a sync.
+func (s *volatileStats) Sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Syncs++
+}
+
+// Lock records a lock acquisition.
+func (s *volatileStats) Lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Locks++
+}
+
+// Unlock records a lock release.
+func (s *volatileStats) Unlock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Unlocks++
+}
+
+// ShmMap records a shared memory region mapping.
+func (s *volatileStats) ShmMap() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.ShmMaps++
+}
+
+// ShmUnmap records a shared memory unmapping.
+func (s *volatileStats) ShmUnmap() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.ShmUnmaps++
+}
@@ -0,0 +1,96 @@
+package sqlite3
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+// I/O statistics track checkpoints and vacuums.
+func Test_VolatileVFSFileStats(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("PRAGMA wal_autocheckpoint=0", nil); err != nil {
+		t.Fatal("failed to disable auto checkpoint", err)
+	}
+	if _, err := conn.Exec("CREATE TABLE test (n INT, s TEXT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err := conn.Exec("INSERT INTO test(n, s) VALUES(?, zeroblob(1000))", []driver.Value{int64(i)})
+		if err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+
+	files := fs.Files()
+	if !reflect.DeepEqual(files, []string{"test.db", "test.db-wal"}) {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	db, err := fs.FileStats("test.db")
+	if err != nil {
+		t.Fatal("failed to get database stats", err)
+	}
+	wal, err := fs.FileStats("test.db-wal")
+	if err != nil {
+		t.Fatal("failed to get WAL stats", err)
+	}
+	if wal.Writes == 0 || wal.BytesWritten < int64(wal.Size) {
+		t.Errorf("expected WAL writes to cover its size, got %+v", wal)
+	}
+	if db.ShmMaps == 0 || db.Locks == 0 {
+		t.Errorf("expected database to be locked and shared memory mapped, got %+v", db)
+	}
+
+	// A checkpoint writes the database and truncates the WAL.
+	if _, err := conn.Exec("PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		t.Fatal("failed to checkpoint", err)
+	}
+	checkpointed, err := fs.FileStats("test.db")
+	if err != nil {
+		t.Fatal("failed to get database stats", err)
+	}
+	if checkpointed.Writes == db.Writes || checkpointed.Size <= db.Size {
+		t.Errorf("expected checkpoint to write the database, got %+v", checkpointed)
+	}
+	wal, err = fs.FileStats("test.db-wal")
+	if err != nil {
+		t.Fatal("failed to get WAL stats", err)
+	}
+	if wal.Truncates == 0 || wal.Size != 0 {
+		t.Errorf("expected checkpoint to truncate the WAL, got %+v", wal)
+	}
+
+	// A vacuum shrinks the database.
+	if _, err := conn.Exec("DELETE FROM test", nil); err != nil {
+		t.Fatal("failed to delete values", err)
+	}
+	if _, err := conn.Exec("VACUUM", nil); err != nil {
+		t.Fatal("failed to vacuum", err)
+	}
+	if _, err := conn.Exec("PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		t.Fatal("failed to checkpoint", err)
+	}
+	vacuumed, err := fs.FileStats("test.db")
+	if err != nil {
+		t.Fatal("failed to get database stats", err)
+	}
+	if vacuumed.Truncates == checkpointed.Truncates || vacuumed.Size >= checkpointed.Size {
+		t.Errorf("expected vacuum to shrink the database, got %+v", vacuumed)
+	}
+
+	if _, err := fs.FileStats("missing.db"); err == nil {
+		t.Error("expected stats of missing file to fail")
+	}
+}
@@ -7,7 +7,6 @@ package sqlite3
 #else
 #include <sqlite3.h>
 #endif
-#include <sys/time.h>
 #include <unistd.h>
 #include <stdio.h>
 #include <errno.h>
@@ -22,8 +21,10 @@ package sqlite3
 int volatileOpen(int iVfs, char *zName, sqlite3_file *pFile, int flags, int *pOutFlags);
 int volatileDelete(int iVfs, char *zName);
 int volatileAccess(int iVfs, char *zName, int flags, int *pResOut);
-int volatileRandomness(int nBuf, char *zBuf);
-int volatileSleep(int microseconds);
+int volatileFullPathname(char *zName, int nOut, char *zOut);
+int volatileRandomness(int iVfs, int nBuf, char *zBuf);
+int volatileSleep(int iVfs, int microseconds);
+int volatileCurrentTimeInt64(int iVfs, sqlite3_int64 *piNow);
 int volatileGetLastError(int iVfs);
 
 // SQLite file Go implementation.
@@ -31,12 +32,22 @@ int volatileClose(int iVfs, int iFd);
 int volatileRead(int iVfs, int iFd, void *zBuf, int iAmt, sqlite_int64 iOfst);
 int volatileWrite(int iVfs, int iFd, void *zBuf, int iAmt, sqlite_int64 iOfst);
 int volatileTruncate(int iVfs, int iFd, sqlite_int64 size);
+int volatileSync(int iVfs, int iFd, int flags);
 int volatileFileSize(int iVfs, int iFd, sqlite_int64 *pSize);
 int volatileLock(int iVfs, int iFd, int eLock);
 int volatileUnlock(int iVfs, int iFd, int eLock);
 int volatileCheckReservedLock(int iVfs, int iFd, int *pResOut);
 int volatileShmMap(int iVfs, int iFd, int iRegion, int szRegion, int bExtend, void **pp);
 int volatileShmUnmap(int iVfs, int iFd, int deleteFlag);
+int volatileFileControl(int iVfs, int iFd, int op, void *pArg);
+int volatileFetch(int iVfs, int iFd, sqlite3_int64 iOfst, int iAmt, void **pp);
+int volatileUnfetch(int iVfs, int iFd, void *p);
+
+// Return a copy of the given string allocated with sqlite3_malloc(), as
+// required by file control opcodes that transfer ownership to SQLite.
+static char *volatileStrdup(const char *z){
+  return sqlite3_mprintf("%s", z);
+}
 
 typedef struct sqlite3VolatileFile sqlite3VolatileFile;
 struct sqlite3VolatileFile {
@@ -76,7 +87,8 @@ static int sqlite3VolatileTruncate(sqlite3_file *pFile, sqlite_int64 size){
 }
 
 static int sqlite3VolatileSync(sqlite3_file *pFile, int flags){
-  return SQLITE_OK;
+  sqlite3VolatileFile *p = (sqlite3VolatileFile*)pFile;
+  return volatileSync(p->iVfs, p->iFd, flags);
 }
 
 static int sqlite3VolatileFileSize(sqlite3_file *pFile, sqlite_int64 *pSize){
@@ -100,15 +112,8 @@ static int sqlite3VolatileCheckReservedLock(sqlite3_file *pFile, int *pResOut){
 }
 
 static int sqlite3VolatileFileControl(sqlite3_file *pFile, int op, void *pArg){
-  if( op==SQLITE_FCNTL_PRAGMA ){
-    // This is needed in order for pragmas to work. See the xFileControl docstring
-    // in sqlite.h.in.
-    //
-    // TODO: there are other op codes that should be handled. Also, xFileControl
-    //       should return SQLITE_OK if the pragma is already applied.
-    return SQLITE_NOTFOUND;
-  }
-  return SQLITE_OK;
+  sqlite3VolatileFile *p = (sqlite3VolatileFile*)pFile;
+  return volatileFileControl(p->iVfs, p->iFd, op, pArg);
 }
 
 static int sqlite3VolatileSectorSize(sqlite3_file *pFile){
@@ -148,6 +153,22 @@ static int sqlite3VolatileShmUnmap(sqlite3_file *pFile, int deleteFlag){
   return volatileShmUnmap(p->iVfs, p->iFd, deleteFlag);
 }
 
+static int sqlite3VolatileFetch(sqlite3_file *pFile, sqlite3_int64 iOfst, int iAmt, void **pp){
+  sqlite3VolatileFile *p = (sqlite3VolatileFile*)pFile;
+  *pp = 0;
+  return volatileFetch(p->iVfs, p->iFd, iOfst, iAmt, pp);
+}
+
+static int sqlite3VolatileUnfetch(sqlite3_file *pFile, sqlite3_int64 iOfst, void *pPage){
+  sqlite3VolatileFile *p = (sqlite3VolatileFile*)pFile;
+  // A NULL page is a request to release the whole mapping, which is done
+  // anyway as soon as there are no more fetched pages.
+  if( pPage==0 ){
+    return SQLITE_OK;
+  }
+  return volatileUnfetch(p->iVfs, p->iFd, pPage);
+}
+
 static int sqlite3VolatileOpen(
   sqlite3_vfs *pVfs,              // VFS
   const char *zName,              // File to open, or 0 for a temp file
@@ -166,7 +187,7 @@ static int sqlite3VolatileOpen(
   }
 
   static const sqlite3_io_methods io = {
-    2,                                       // iVersion
+    3,                                       // iVersion
     sqlite3VolatileClose,                    // xClose
     sqlite3VolatileRead,                     // xRead
     sqlite3VolatileWrite,                    // xWrite
@@ -182,7 +203,9 @@ static int sqlite3VolatileOpen(
     sqlite3VolatileShmMap,                   // xShmMap
     sqlite3VolatileShmLock,                  // xShmLock
     sqlite3VolatileShmBarrier,               // xShmBarrier
-    sqlite3VolatileShmUnmap                  // xShmUnmap
+    sqlite3VolatileShmUnmap,                 // xShmUnmap
+    sqlite3VolatileFetch,                    // xFetch
+    sqlite3VolatileUnfetch                   // xUnfetch
   };
 
   p->base.pMethods = &io;
@@ -209,9 +232,7 @@ static int sqlite3VolatileFullPathname(
   int nPathOut,                   // Size of output buffer in bytes
   char *zPathOut                  // Pointer to output buffer
 ){
-  // Just return the path unchanged.
-  sqlite3_snprintf(nPathOut, zPathOut, "%s", zPath);
-  return SQLITE_OK;
+  return volatileFullPathname((char*)zPath, nPathOut, zPathOut);
 }
 
 static void* sqlite3VolatileDlOpen(sqlite3_vfs *pVfs, const char *zPath){
@@ -232,26 +253,24 @@ static void sqlite3VolatileDlClose(sqlite3_vfs *pVfs, void *pHandle){
 }
 
 static int sqlite3VolatileRandomness(sqlite3_vfs *pVfs, int nByte, char *zByte){
-  return volatileRandomness(nByte, zByte);
+  return volatileRandomness(*(int*)(pVfs->pAppData), nByte, zByte);
 }
 
-static int sqlite3VolatileSleep(sqlite3_vfs *NotUsed, int microseconds){
+static int sqlite3VolatileSleep(sqlite3_vfs *pVfs, int microseconds){
   // Sleep in Go, to avoid the scheduler unconditionally preempting the
   // SQLite API call being invoked.
-  return volatileSleep(microseconds);
+  return volatileSleep(*(int*)(pVfs->pAppData), microseconds);
 }
 
 static int sqlite3VolatileCurrentTimeInt64(sqlite3_vfs *pVfs, sqlite3_int64 *piNow){
-  static const sqlite3_int64 unixEpoch = 24405875*(sqlite3_int64)8640000;
-  struct timeval sNow;
-  (void)gettimeofday(&sNow, 0);
-  *piNow = unixEpoch + 1000*(sqlite3_int64)sNow.tv_sec + sNow.tv_usec/1000;
-  return SQLITE_OK;
+  return volatileCurrentTimeInt64(*(int*)(pVfs->pAppData), piNow);
 }
 
-static int sqlite3VolatileCurrentTime(sqlite3_vfs *pVfs, double *piNow){
-  // TODO: check if it's always safe to cast a double* to a sqlite3_int64*.
-  return sqlite3VolatileCurrentTimeInt64(pVfs, (sqlite3_int64*)piNow);
+static int sqlite3VolatileCurrentTime(sqlite3_vfs *pVfs, double *prNow){
+  sqlite3_int64 i = 0;
+  int rc = sqlite3VolatileCurrentTimeInt64(pVfs, &i);
+  *prNow = i/86400000.0;
+  return rc;
 }
 
 static int sqlite3VolatileGetLastError(sqlite3_vfs *pVfs, int NotUsed2, char *NotUsed3){
@@ -310,9 +329,13 @@ import "C"
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -323,7 +346,7 @@ import (
 
 // RegisterVolatileFileSystem registers a new volatile VFS under the given
 // name.
-func RegisterVolatileFileSystem(name string) *VolatileFileSystem {
+func RegisterVolatileFileSystem(name string, options ...VolatileOption) *VolatileFileSystem {
 	volatileVFSLock.Lock()
 	defer volatileVFSLock.Unlock()
 
@@ -331,6 +354,9 @@ func RegisterVolatileFileSystem(name string) *VolatileFileSystem {
 	volatileVFSHandles++
 
 	vfs := newVolatileVFS()
+	for _, option := range options {
+		option(vfs)
+	}
 	volatileVFSs[iFs] = vfs
 
 	zName := C.CString(name)
@@ -362,6 +388,79 @@ func UnregisterVolatileFileSystem(fs *VolatileFileSystem) {
 	panic("unknown volatile file system")
 }
 
+// VolatileOption tunes the behavior of a volatile file system.
+type VolatileOption func(*volatileVFS)
+
+// VolatileMaxFileSize limits the size in bytes of every single file in the
+// volatile file system. Writes or truncates that would exceed the limit fail
+// with SQLITE_FULL.
+func VolatileMaxFileSize(size int) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.quota.maxFileSize = size
+	}
+}
+
+// VolatileMaxSize limits the total number of bytes used by the volatile file
+// system, including shared memory regions. Writes, truncates or shared
+// memory allocations that would exceed the limit fail with SQLITE_FULL.
+func VolatileMaxSize(size int) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.quota.maxSize = size
+	}
+}
+
+// VolatileHighWaterMark sets a callback that gets invoked every time the
+// total usage of the volatile file system goes above the given number of
+// bytes. The callback won't fire again until usage drops below the mark.
+//
+// The callback is invoked synchronously from within the VFS and must not
+// use any connection to the file system.
+func VolatileHighWaterMark(size int, callback func(VolatileUsage)) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.quota.highWaterMark = size
+		vfs.quota.onHighWaterMark = callback
+	}
+}
+
+// VolatileClock sets the function used to get the current time, for
+// example by date and time SQL functions. It defaults to time.Now.
+func VolatileClock(now func() time.Time) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.now = now
+	}
+}
+
+// VolatileRandomSource sets the source of the random bytes returned by the
+// xRandomness method of the VFS. It defaults to crypto/rand.Reader.
+//
+// Note that SQLite seeds its internal pseudo-random number generator only
+// once per process, using the default VFS, so the source affects it only if
+// the volatile file system is the default one.
+func VolatileRandomSource(source io.Reader) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.random = source
+	}
+}
+
+// VolatileSleep sets the function used to sleep, for example by busy
+// handlers retrying to acquire a lock. It defaults to time.Sleep.
+func VolatileSleep(sleep func(time.Duration)) VolatileOption {
+	return func(vfs *volatileVFS) {
+		vfs.sleep = sleep
+	}
+}
+
+// VolatileUsage reports the memory currently used by a volatile file system.
+type VolatileUsage struct {
+	Files int // Bytes of file content.
+	Shm   int // Bytes of shared memory regions allocated on the C heap.
+}
+
+// Total returns the total number of bytes used.
+func (u VolatileUsage) Total() int {
+	return u.Files + u.Shm
+}
+
 // Global registry of volatileFileSystem instances.
 var volatileVFSLock sync.RWMutex
 var volatileVFSs = make(map[C.int]*volatileVFS)
@@ -391,7 +490,7 @@ func (fs *VolatileFileSystem) ReadFile(name string) ([]byte, error) {
 		}
 	}
 
-	return file.data[:], nil
+	return file.Data(), nil
 }
 
 // CreateFile adds a new volatile file with the given name and content.
@@ -409,9 +508,15 @@ func (fs *VolatileFileSystem) CreateFile(name string, data []byte) error {
 	}
 
 	file, _ := fs.vfs.FileByFD(iFd)
-	file.mu.Lock()
-	file.data = data
-	file.mu.Unlock()
+	if rc := file.SetData(data); rc != C.SQLITE_OK {
+		fs.vfs.Close(iFd)
+		fs.vfs.Delete(name)
+		return Error{
+			Code:         ErrNo(rc),
+			ExtendedCode: ErrNoExtended(rc),
+		}
+	}
+	fs.vfs.Close(iFd)
 
 	return nil
 }
@@ -429,6 +534,26 @@ func (fs *VolatileFileSystem) FileSize(name string) (int, error) {
 	return file.Size(), nil
 }
 
+// Files returns the names of all files in the volatile file system, in
+// lexical order.
+func (fs *VolatileFileSystem) Files() []string {
+	fs.vfs.mu.RLock()
+	defer fs.vfs.mu.RUnlock()
+
+	names := make([]string, 0, len(fs.vfs.files))
+	for name := range fs.vfs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Usage returns the memory currently used by the volatile file system.
+func (fs *VolatileFileSystem) Usage() VolatileUsage {
+	return fs.vfs.quota.Usage()
+}
+
 // Remove the volatile file with the given name.
 func (fs *VolatileFileSystem) Remove(name string) error {
 	rc := fs.vfs.Delete(name)
@@ -462,13 +587,26 @@ type volatileVFS struct {
 	files  map[string]*volatileFile // Map file names to file objects.
 	fds    map[C.int]*volatileFile  // Map C-land open file numbers to files objects.
 	serial C.int                    // Serial number for file numbers, increasing monotonically.
+	temps  int                      // Serial number for temporary file names.
 	errno  C.int                    // Last error.
+	quota  *volatileQuota           // Memory limits and usage.
+	events *volatileEvents          // Subscribers to file changes.
+	crash  bool                     // Whether crash simulation is on.
+	now    func() time.Time         // Source of the current time.
+	random io.Reader                // Source of random bytes.
+	randMu sync.Mutex               // Serialize reads from random.
+	sleep  func(time.Duration)      // Sleep function.
 }
 
 func newVolatileVFS() *volatileVFS {
 	return &volatileVFS{
-		files: make(map[string]*volatileFile),
-		fds:   make(map[C.int]*volatileFile),
+		files:  make(map[string]*volatileFile),
+		fds:    make(map[C.int]*volatileFile),
+		quota:  &volatileQuota{},
+		events: newVolatileEvents(),
+		now:    time.Now,
+		random: rand.Reader,
+		sleep:  time.Sleep,
 	}
 }
 
@@ -503,9 +641,17 @@ func (vfs *volatileVFS) Open(name string, flags C.int) (C.int, C.int) {
 			return -1, C.SQLITE_CANTOPEN
 		}
 		// This is a new file.
-		file = newVolatileFile(name)
+		file = newVolatileFile(name, vfs.quota, vfs.events)
+		if vfs.crash {
+			file.unsynced = newVolatileUnsynced(nil)
+		}
 		vfs.files[name] = file
+		vfs.events.Create(name)
+
+	}
 
+	if flags&C.SQLITE_OPEN_DELETEONCLOSE != 0 {
+		file.autoDelete = true
 	}
 
 	// Create a new file handle.
@@ -516,18 +662,43 @@ func (vfs *volatileVFS) Open(name string, flags C.int) (C.int, C.int) {
 	return iFd, C.SQLITE_OK
 }
 
+// OpenTemp opens a new anonymous temporary file, which is not visible by
+// name and gets deleted when closed.
+func (vfs *volatileVFS) OpenTemp() C.int {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	file := newVolatileFile("", vfs.quota, nil)
+	file.autoDelete = true
+
+	iFd := vfs.serial
+	vfs.fds[iFd] = file
+	vfs.serial++
+
+	return iFd
+}
+
 // Close new volatile file.
 func (vfs *volatileVFS) Close(iFd C.int) C.int {
 	vfs.mu.Lock()
 	defer vfs.mu.Unlock()
 
-	if _, ok := vfs.fds[iFd]; !ok {
+	file, ok := vfs.fds[iFd]
+	if !ok {
 		vfs.errno = C.EBADF
 		return C.SQLITE_IOERR_CLOSE
 	}
 
 	delete(vfs.fds, iFd)
 
+	if file.autoDelete && !vfs.isOpen(file) {
+		if file.name == "" {
+			vfs.quota.ShrinkFile(file.Size(), 0)
+		} else if vfs.files[file.name] == file {
+			vfs.remove(file)
+		}
+	}
+
 	return C.SQLITE_OK
 }
 
@@ -543,16 +714,31 @@ func (vfs *volatileVFS) Delete(name string) C.int {
 	}
 
 	// Check that there are no consumers of this file.
+	if vfs.isOpen(file) {
+		vfs.errno = C.EBUSY
+		return C.SQLITE_IOERR_DELETE
+	}
+
+	vfs.remove(file)
+
+	return C.SQLITE_OK
+}
+
+// Return true if any file handle references the given file.
+func (vfs *volatileVFS) isOpen(file *volatileFile) bool {
 	for iFd := range vfs.fds {
 		if vfs.fds[iFd] == file {
-			vfs.errno = C.EBUSY
-			return C.SQLITE_IOERR_DELETE
+			return true
 		}
 	}
+	return false
+}
 
-	delete(vfs.files, name)
-
-	return C.SQLITE_OK
+// Remove the given named file from the file system.
+func (vfs *volatileVFS) remove(file *volatileFile) {
+	delete(vfs.files, file.name)
+	vfs.quota.ShrinkFile(file.Size(), 0)
+	vfs.events.Delete(file.name)
 }
 
 // Access returns true if the file exists.
@@ -569,6 +755,30 @@ func (vfs *volatileVFS) Access(name string, flags C.int) bool {
 	return true
 }
 
+// Randomness fills the given buffer with random bytes. Connections can ask
+// for randomness concurrently, and sources like math/rand.Rand are not safe
+// for concurrent use, so reads are serialized.
+func (vfs *volatileVFS) Randomness(buf []byte) {
+	vfs.randMu.Lock()
+	defer vfs.randMu.Unlock()
+
+	// A short read leaves the rest of the buffer zeroed, which is fine for
+	// SQLite's purposes.
+	io.ReadFull(vfs.random, buf)
+}
+
+// Sleep for the given duration.
+func (vfs *volatileVFS) Sleep(d time.Duration) {
+	vfs.sleep(d)
+}
+
+// CurrentTime returns the current time as a Julian day number in
+// milliseconds.
+func (vfs *volatileVFS) CurrentTime() int64 {
+	const unixEpoch = 24405875 * 8640000 // Julian day of the Unix epoch, in ms.
+	return unixEpoch + vfs.now().UnixNano()/int64(time.Millisecond)
+}
+
 // GetLastError returns the last error happened.
 func (vfs *volatileVFS) GetLastError() C.int {
 	vfs.mu.RLock()
@@ -577,6 +787,62 @@ func (vfs *volatileVFS) GetLastError() C.int {
 	return vfs.errno
 }
 
+// TempName returns a file name that is not used by any existing file.
+func (vfs *volatileVFS) TempName() string {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	for {
+		vfs.temps++
+		name := fmt.Sprintf("etilqs_%d", vfs.temps)
+		if _, ok := vfs.files[name]; !ok {
+			return name
+		}
+	}
+}
+
+// HasMoved returns true if the given file is no longer reachable through
+// the name it was opened with.
+func (vfs *volatileVFS) HasMoved(file *volatileFile) bool {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	return vfs.files[file.name] != file
+}
+
+// Pragma handles the custom pragmas implemented by the volatile VFS, which
+// report statistics about the file system. It returns the pragma result, or
+// SQLITE_NOTFOUND if the pragma is not a volatile VFS one and should be
+// handled by SQLite.
+func (vfs *volatileVFS) Pragma(file *volatileFile, name string, value *C.char) (string, C.int) {
+	var result string
+
+	switch name {
+	case "volatile_file_size":
+		result = strconv.Itoa(file.Size())
+	case "volatile_file_count":
+		vfs.mu.RLock()
+		result = strconv.Itoa(len(vfs.files))
+		vfs.mu.RUnlock()
+	case "volatile_size":
+		vfs.mu.RLock()
+		size := 0
+		for _, other := range vfs.files {
+			size += other.Size()
+		}
+		vfs.mu.RUnlock()
+		result = strconv.Itoa(size)
+	default:
+		return "", C.SQLITE_NOTFOUND
+	}
+
+	if value != nil {
+		return fmt.Sprintf("%s is read-only", name), C.SQLITE_ERROR
+	}
+
+	return result, C.SQLITE_OK
+}
+
 // FileByFD returns the open volatile file with the given fd number.
 func (vfs *volatileVFS) FileByFD(iFd C.int) (*volatileFile, C.int) {
 	vfs.mu.RLock()
@@ -605,12 +871,126 @@ func (vfs *volatileVFS) FileByName(name string) (*volatileFile, C.int) {
 	return file, C.SQLITE_OK
 }
 
+// Track the memory used by a volatile file system and enforce its limits.
+type volatileQuota struct {
+	mu              sync.Mutex
+	maxFileSize     int                 // Maximum size of a single file, or 0.
+	maxSize         int                 // Maximum total size, or 0.
+	highWaterMark   int                 // Usage that triggers onHighWaterMark, or 0.
+	onHighWaterMark func(VolatileUsage) // Callback for high-water mark crossing.
+	aboveMark       bool                // Whether usage is above the high-water mark.
+	usage           VolatileUsage       // Current usage.
+}
+
+// GrowFile accounts for a file growing from the given size to the new one,
+// returning SQLITE_FULL if that would exceed the limits.
+func (q *volatileQuota) GrowFile(from, to int) C.int {
+	if q.maxFileSize > 0 && to > q.maxFileSize {
+		return C.SQLITE_FULL
+	}
+	return q.grow(to-from, 0)
+}
+
+// LimitFile returns the given size, lowered if needed so that a file of the
+// current size could grow to it without exceeding the limits.
+func (q *volatileQuota) LimitFile(current, size int) int {
+	if q.maxFileSize > 0 && size > q.maxFileSize {
+		size = q.maxFileSize
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxSize > 0 {
+		if max := current + q.maxSize - q.usage.Total(); size > max {
+			size = max
+		}
+	}
+	return size
+}
+
+// ShrinkFile accounts for a file shrinking from the given size to the new
+// one.
+func (q *volatileQuota) ShrinkFile(from, to int) {
+	q.shrink(from-to, 0)
+}
+
+// GrowShm accounts for a new shared memory region of the given size,
+// returning SQLITE_FULL if that would exceed the limits.
+func (q *volatileQuota) GrowShm(size int) C.int {
+	return q.grow(0, size)
+}
+
+// ShrinkShm accounts for shared memory regions being released.
+func (q *volatileQuota) ShrinkShm(size int) {
+	q.shrink(0, size)
+}
+
+// Usage returns the current usage.
+func (q *volatileQuota) Usage() VolatileUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.usage
+}
+
+func (q *volatileQuota) grow(files, shm int) C.int {
+	q.mu.Lock()
+
+	usage := VolatileUsage{Files: q.usage.Files + files, Shm: q.usage.Shm + shm}
+	if q.maxSize > 0 && usage.Total() > q.maxSize {
+		q.mu.Unlock()
+		return C.SQLITE_FULL
+	}
+	q.usage = usage
+
+	crossed := false
+	if q.highWaterMark > 0 && !q.aboveMark && usage.Total() > q.highWaterMark {
+		q.aboveMark = true
+		crossed = q.onHighWaterMark != nil
+	}
+
+	q.mu.Unlock()
+
+	if crossed {
+		q.onHighWaterMark(usage)
+	}
+
+	return C.SQLITE_OK
+}
+
+func (q *volatileQuota) shrink(files, shm int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.usage.Files -= files
+	q.usage.Shm -= shm
+
+	if q.aboveMark && q.usage.Total() <= q.highWaterMark {
+		q.aboveMark = false
+	}
+}
+
 // Hold the content of a volatile in-memory file.
 type volatileFile struct {
-	mu          sync.RWMutex     // Serialize access to the fields below.
-	data        []byte           // Content of the file.
-	shm         []unsafe.Pointer // Regions of C-allocated memory
-	shmRefCount int              // Number of opened files referencing the shared memory
+	mu          sync.RWMutex      // Serialize access to the fields below.
+	name        string            // Name the file was created with.
+	quota       *volatileQuota    // Memory accounting of the file system.
+	events      *volatileEvents   // Subscribers to changes of the file.
+	data        []byte            // Content of the file.
+	cow         bool              // Whether data is shared with a clone, copy on write.
+	shm         []unsafe.Pointer  // Regions of C-allocated memory
+	shmSize     int               // Size of each shared memory region.
+	shmRefCount int               // Number of opened files referencing the shared memory
+	persistWAL  bool              // Whether SQLITE_FCNTL_PERSIST_WAL is on.
+	autoDelete  bool              // Whether to delete the file when its last handle is closed.
+	unsynced    *volatileUnsynced // Changes since the last sync, if crash simulation is on.
+	crashed     bool              // Whether the file was replaced by a simulated crash.
+	mmapSize    int64             // Maximum offset of fetched pages.
+	mapped      []byte            // Memory referenced by fetched pages.
+	fetches     int               // Number of fetched pages not yet released.
+	pinner      volatilePinner    // Keeps mapped memory in place while fetched.
+	stats       volatileStats     // I/O statistics.
 
 	// Lock counters.
 	none      int
@@ -620,10 +1000,13 @@ type volatileFile struct {
 	exclusive int
 }
 
-func newVolatileFile(name string) *volatileFile {
+func newVolatileFile(name string, quota *volatileQuota, events *volatileEvents) *volatileFile {
 	return &volatileFile{
-		data: make([]byte, 0),
-		shm:  make([]unsafe.Pointer, 0),
+		name:   name,
+		quota:  quota,
+		events: events,
+		data:   make([]byte, 0),
+		shm:    make([]unsafe.Pointer, 0),
 	}
 }
 
@@ -632,6 +1015,11 @@ func (f *volatileFile) Read(buf unsafe.Pointer, n int, offset int) C.int {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
+	if f.crashed {
+		return C.SQLITE_IOERR_READ
+	}
+	f.stats.Read(n)
+
 	var rc C.int
 	rc = C.SQLITE_OK
 	size := unsafe.Sizeof(byte(0))
@@ -666,7 +1054,16 @@ func (f *volatileFile) Write(buf unsafe.Pointer, n int, offset int) C.int {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.crashed {
+		return C.SQLITE_IOERR_WRITE
+	}
+	f.stats.Write(n)
+	f.own()
+
 	if offset+n >= len(f.data) {
+		if rc := f.quota.GrowFile(len(f.data), offset+n); rc != C.SQLITE_OK {
+			return rc
+		}
 		f.data = append(f.data, make([]byte, offset+n-len(f.data))...)
 	}
 
@@ -677,6 +1074,13 @@ func (f *volatileFile) Write(buf unsafe.Pointer, n int, offset int) C.int {
 		f.data[j] = *(*byte)(unsafe.Pointer(uintptr(buf) + size*uintptr(i)))
 	}
 
+	f.syncMapped(offset, offset+n)
+
+	if f.unsynced != nil {
+		f.unsynced.Write(f.data[offset:offset+n], offset)
+	}
+	f.events.Write(f.name, f.data[offset:offset+n], offset)
+
 	return C.SQLITE_OK
 }
 
@@ -685,15 +1089,97 @@ func (f *volatileFile) Truncate(size int) C.int {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.crashed {
+		return C.SQLITE_IOERR_TRUNCATE
+	}
+	f.stats.Truncate()
+	f.own()
+
 	if size >= len(f.data) {
+		if rc := f.quota.GrowFile(len(f.data), size); rc != C.SQLITE_OK {
+			return rc
+		}
+		from := len(f.data)
 		f.data = append(f.data, make([]byte, size-len(f.data))...)
+		f.syncMapped(from, size)
 	} else {
+		f.quota.ShrinkFile(len(f.data), size)
 		f.data = f.data[:size]
 	}
 
+	if f.unsynced != nil {
+		f.unsynced.Truncate(size)
+	}
+	f.events.Truncate(f.name, size)
+
+	return C.SQLITE_OK
+}
+
+// Sync makes all data written so far durable.
+func (f *volatileFile) Sync() C.int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return C.SQLITE_IOERR_FSYNC
+	}
+	f.stats.Sync()
+
+	if f.unsynced != nil {
+		f.unsynced.Sync()
+	}
+
+	return C.SQLITE_OK
+}
+
+// SetData replaces the whole content of the file.
+func (f *volatileFile) SetData(data []byte) C.int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(data) > len(f.data) {
+		if rc := f.quota.GrowFile(len(f.data), len(data)); rc != C.SQLITE_OK {
+			return rc
+		}
+	} else {
+		f.quota.ShrinkFile(len(f.data), len(data))
+	}
+	f.data = data
+	f.cow = false
+	f.syncMapped(0, len(data))
+
+	if f.unsynced != nil {
+		f.unsynced = newVolatileUnsynced(data)
+	}
+	f.events.Replace(f.name, data)
+
 	return C.SQLITE_OK
 }
 
+// Copy the given range of the content of the file to the memory referenced
+// by fetched pages, if it has been re-allocated since they were fetched, so
+// they keep reflecting the current content.
+func (f *volatileFile) syncMapped(from, to int) {
+	if f.mapped == nil || from >= len(f.mapped) {
+		return
+	}
+	if to > len(f.mapped) {
+		to = len(f.mapped)
+	}
+	copy(f.mapped[from:to], f.data[from:to])
+}
+
+// Data returns a copy of the content of the file.
+func (f *volatileFile) Data() []byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+
+	return data
+}
+
 // Size returns the size of the file.
 func (f *volatileFile) Size() int {
 	f.mu.RLock()
@@ -702,6 +1188,38 @@ func (f *volatileFile) Size() int {
 	return len(f.data)
 }
 
+// SizeHint grows the capacity of the file buffer, so that subsequent writes
+// up to the given size don't need to re-allocate memory. The capacity never
+// exceeds what the quota would let the file grow to.
+func (f *volatileFile) SizeHint(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size = f.quota.LimitFile(len(f.data), size)
+	if size > cap(f.data) {
+		data := make([]byte, len(f.data), size)
+		copy(data, f.data)
+		f.data = data
+		f.cow = false
+	}
+}
+
+// PersistWAL returns the current value of the SQLITE_FCNTL_PERSIST_WAL
+// setting, changing it first if the given value is not negative.
+func (f *volatileFile) PersistWAL(value int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if value >= 0 {
+		f.persistWAL = value != 0
+	}
+
+	if f.persistWAL {
+		return 1
+	}
+	return 0
+}
+
 // Lock increases the count of the given lock type.
 func (f *volatileFile) Lock(lock C.int) C.int {
 	f.mu.Lock()
@@ -721,6 +1239,7 @@ func (f *volatileFile) Lock(lock C.int) C.int {
 	default:
 		return C.SQLITE_ERROR
 	}
+	f.stats.Lock()
 
 	return C.SQLITE_OK
 }
@@ -744,6 +1263,7 @@ func (f *volatileFile) Unlock(lock C.int) C.int {
 	default:
 		return C.SQLITE_ERROR
 	}
+	f.stats.Unlock()
 
 	return C.SQLITE_OK
 }
@@ -761,6 +1281,8 @@ func (f *volatileFile) ShmMap(region int, size int, extend int) (unsafe.Pointer,
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	f.stats.ShmMap()
+
 	if region < len(f.shm) {
 		// The region was already allocated.
 		f.shmRefCount++
@@ -770,13 +1292,19 @@ func (f *volatileFile) ShmMap(region int, size int, extend int) (unsafe.Pointer,
 		return nil, C.SQLITE_OK
 	}
 
+	if rc := f.quota.GrowShm(size); rc != C.SQLITE_OK {
+		return nil, rc
+	}
+
 	data := C.sqlite3_malloc(C.int(size))
 	if data == nil {
+		f.quota.ShrinkShm(size)
 		return nil, C.SQLITE_NOMEM
 	}
 	C.memset(data, C.int(0), C.size_t(size))
 
 	f.shm = append(f.shm, data)
+	f.shmSize = size
 	f.shmRefCount++
 
 	return data, C.SQLITE_OK
@@ -787,11 +1315,14 @@ func (f *volatileFile) ShmUnmap(deleteFlag int) C.int {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	f.stats.ShmUnmap()
+
 	f.shmRefCount--
 	if f.shmRefCount == 0 {
 		for _, data := range f.shm {
 			C.sqlite3_free(data)
 		}
+		f.quota.ShrinkShm(len(f.shm) * f.shmSize)
 		f.shm = f.shm[0:0]
 	}
 
@@ -807,9 +1338,18 @@ func volatileOpen(iVfs C.int, zName *C.char, pFile *C.sqlite3_file, flags C.int,
 	if !ok {
 		return C.SQLITE_CANTOPEN
 	}
-	iFd, rc := vfs.Open(C.GoString(zName), flags)
-	if rc != C.SQLITE_OK {
-		return rc
+
+	var iFd C.int
+	if zName == nil {
+		// SQLite passes no name for temporary files that it doesn't
+		// need to reopen, such as sorter and statement journal files.
+		iFd = vfs.OpenTemp()
+	} else {
+		var rc C.int
+		iFd, rc = vfs.Open(C.GoString(zName), flags)
+		if rc != C.SQLITE_OK {
+			return rc
+		}
 	}
 
 	file := (*C.sqlite3VolatileFile)(unsafe.Pointer(pFile))
@@ -851,10 +1391,34 @@ func volatileAccess(iVfs C.int, zName *C.char, flags C.int, pResOut *C.int) C.in
 	return C.SQLITE_OK
 }
 
+//export volatileFullPathname
+func volatileFullPathname(zName *C.char, nOut C.int, zOut *C.char) C.int {
+	// There's no working directory, so relative names stay relative, but
+	// different spellings of the same name must map to the same file.
+	name := C.GoString(zName)
+	if name != "" {
+		name = path.Clean(name)
+	}
+
+	if len(name) >= int(nOut) {
+		return C.SQLITE_CANTOPEN
+	}
+	out := (*[1 << 30]byte)(unsafe.Pointer(zOut))[:nOut:nOut]
+	copy(out, name)
+	out[len(name)] = 0
+
+	return C.SQLITE_OK
+}
+
 //export volatileRandomness
-func volatileRandomness(nBuf C.int, zBuf *C.char) C.int {
+func volatileRandomness(iVfs C.int, nBuf C.int, zBuf *C.char) C.int {
+	vfs := volatileFindVFS(iVfs)
+	if vfs == nil {
+		return 0
+	}
+
 	buf := make([]byte, nBuf)
-	rand.Read(buf) // According to the documentation this never fails.
+	vfs.Randomness(buf)
 
 	start := unsafe.Pointer(zBuf)
 	size := unsafe.Sizeof(*zBuf)
@@ -867,11 +1431,29 @@ func volatileRandomness(nBuf C.int, zBuf *C.char) C.int {
 }
 
 //export volatileSleep
-func volatileSleep(microseconds C.int) C.int {
-	time.Sleep(time.Duration(microseconds) * time.Microsecond)
+func volatileSleep(iVfs C.int, microseconds C.int) C.int {
+	vfs := volatileFindVFS(iVfs)
+	if vfs == nil {
+		return 0
+	}
+
+	vfs.Sleep(time.Duration(microseconds) * time.Microsecond)
+
 	return microseconds
 }
 
+//export volatileCurrentTimeInt64
+func volatileCurrentTimeInt64(iVfs C.int, piNow *C.sqlite3_int64) C.int {
+	vfs := volatileFindVFS(iVfs)
+	if vfs == nil {
+		return C.SQLITE_ERROR
+	}
+
+	*piNow = C.sqlite3_int64(vfs.CurrentTime())
+
+	return C.SQLITE_OK
+}
+
 //export volatileGetLastError
 func volatileGetLastError(iVfs C.int) C.int {
 	volatileVFSLock.RLock()
@@ -885,6 +1467,13 @@ func volatileGetLastError(iVfs C.int) C.int {
 	return vfs.GetLastError()
 }
 
+func volatileFindVFS(iVfs C.int) *volatileVFS {
+	volatileVFSLock.RLock()
+	defer volatileVFSLock.RUnlock()
+
+	return volatileVFSs[iVfs]
+}
+
 func volatileFindFile(iVfs C.int, iFd C.int) (*volatileFile, C.int) {
 	volatileVFSLock.RLock()
 	defer volatileVFSLock.RUnlock()
@@ -950,6 +1539,16 @@ func volatileTruncate(iVfs C.int, iFd C.int, size C.sqlite_int64) C.int {
 	return file.Truncate(int(size))
 }
 
+//export volatileSync
+func volatileSync(iVfs C.int, iFd C.int, flags C.int) C.int {
+	file, rc := volatileFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	return file.Sync()
+}
+
 //export volatileFileSize
 func volatileFileSize(iVfs C.int, iFd C.int, pSize *C.sqlite3_int64) C.int {
 	file, rc := volatileFindFile(iVfs, iFd)
@@ -1032,6 +1631,87 @@ func volatileShmUnmap(iVfs C.int, iFd C.int, deleteFlag C.int) C.int {
 	return file.ShmUnmap(int(deleteFlag))
 }
 
+//export volatileFileControl
+func volatileFileControl(iVfs C.int, iFd C.int, op C.int, pArg unsafe.Pointer) C.int {
+	volatileVFSLock.RLock()
+	defer volatileVFSLock.RUnlock()
+
+	vfs, ok := volatileVFSs[iVfs]
+	if !ok {
+		return C.SQLITE_IOERR
+	}
+
+	file, rc := vfs.FileByFD(iFd)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	switch op {
+	case C.SQLITE_FCNTL_SIZE_HINT:
+		file.SizeHint(int(*(*C.sqlite3_int64)(pArg)))
+	case C.SQLITE_FCNTL_MMAP_SIZE:
+		pSize := (*C.sqlite3_int64)(pArg)
+		*pSize = C.sqlite3_int64(file.MmapSize(int64(*pSize)))
+	case C.SQLITE_FCNTL_PERSIST_WAL:
+		pValue := (*C.int)(pArg)
+		*pValue = C.int(file.PersistWAL(int(*pValue)))
+	case C.SQLITE_FCNTL_VFSNAME:
+		*(**C.char)(pArg) = C.volatileStrdup(vfs.pVfs.zName)
+	case C.SQLITE_FCNTL_TEMPFILENAME:
+		zName := C.CString(vfs.TempName())
+		defer C.free(unsafe.Pointer(zName))
+		*(**C.char)(pArg) = C.volatileStrdup(zName)
+	case C.SQLITE_FCNTL_HAS_MOVED:
+		if vfs.HasMoved(file) {
+			*(*C.int)(pArg) = 1
+		} else {
+			*(*C.int)(pArg) = 0
+		}
+	case C.SQLITE_FCNTL_PRAGMA:
+		// The argument is an array of three strings: the first one
+		// is where the result should be stored, the second one is
+		// the pragma name and the third one the pragma value, if
+		// any. See the xFileControl docstring in sqlite.h.in.
+		azArg := (*[3]*C.char)(pArg)
+		result, rc := vfs.Pragma(file, C.GoString(azArg[1]), azArg[2])
+		if rc == C.SQLITE_NOTFOUND {
+			return rc
+		}
+		zResult := C.CString(result)
+		defer C.free(unsafe.Pointer(zResult))
+		azArg[0] = C.volatileStrdup(zResult)
+		return rc
+	default:
+		return C.SQLITE_NOTFOUND
+	}
+
+	return C.SQLITE_OK
+}
+
+//export volatileFetch
+func volatileFetch(iVfs C.int, iFd C.int, iOfst C.sqlite3_int64, iAmt C.int, pp *unsafe.Pointer) C.int {
+	file, rc := volatileFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	*pp = file.Fetch(int(iOfst), int(iAmt))
+
+	return C.SQLITE_OK
+}
+
+//export volatileUnfetch
+func volatileUnfetch(iVfs C.int, iFd C.int, p unsafe.Pointer) C.int {
+	file, rc := volatileFindFile(iVfs, iFd)
+	if rc != C.SQLITE_OK {
+		return rc
+	}
+
+	file.Unfetch()
+
+	return C.SQLITE_OK
+}
+
 // Dump the content of a volatile file to the actual file system.
 func volatileDumpFile(data []byte, dir string, name string) error {
 	if strings.HasPrefix(name, "/") {
@@ -1049,3 +1729,59 @@ func volatileDumpFile(data []byte, dir string, name string) error {
 
 	return nil
 }
+
+// File control opcodes handled by volatile files.
+//
+// This is only here so that tests can refer to it.
+const (
+	volatileFcntlSizeHint     = C.SQLITE_FCNTL_SIZE_HINT
+	volatileFcntlPersistWAL   = C.SQLITE_FCNTL_PERSIST_WAL
+	volatileFcntlVFSName      = C.SQLITE_FCNTL_VFSNAME
+	volatileFcntlTempFilename = C.SQLITE_FCNTL_TEMPFILENAME
+	volatileFcntlHasMoved     = C.SQLITE_FCNTL_HAS_MOVED
+)
+
+// Invoke the given file control opcode on the main database file of the
+// given connection, passing it a pointer to the given value and returning
+// the value it holds afterwards. The SIZE_HINT opcode gets a sqlite3_int64,
+// the other ones an int.
+//
+// This is only here so that tests can refer to it.
+func volatileFileControlInt(conn *SQLiteConn, op int, value int64) (int64, error) {
+	zDb := C.CString("main")
+	defer C.free(unsafe.Pointer(zDb))
+
+	var rc C.int
+	if op == volatileFcntlSizeHint {
+		pArg := C.sqlite3_int64(value)
+		rc = C.sqlite3_file_control(conn.db, zDb, C.int(op), unsafe.Pointer(&pArg))
+		value = int64(pArg)
+	} else {
+		pArg := C.int(value)
+		rc = C.sqlite3_file_control(conn.db, zDb, C.int(op), unsafe.Pointer(&pArg))
+		value = int64(pArg)
+	}
+	if rc != C.SQLITE_OK {
+		return -1, Error{Code: ErrNo(rc), ExtendedCode: ErrNoExtended(rc)}
+	}
+
+	return value, nil
+}
+
+// Invoke the given file control opcode on the main database file of the
+// given connection, returning the string it allocates.
+//
+// This is only here so that tests can refer to it.
+func volatileFileControlString(conn *SQLiteConn, op int) (string, error) {
+	zDb := C.CString("main")
+	defer C.free(unsafe.Pointer(zDb))
+
+	var zValue *C.char
+	rc := C.sqlite3_file_control(conn.db, zDb, C.int(op), unsafe.Pointer(&zValue))
+	if rc != C.SQLITE_OK {
+		return "", Error{Code: ErrNo(rc), ExtendedCode: ErrNoExtended(rc)}
+	}
+	defer C.sqlite3_free(unsafe.Pointer(zValue))
+
+	return C.GoString(zValue), nil
+}
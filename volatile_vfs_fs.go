@@ -0,0 +1,208 @@
+// +build go1.16
+
+package sqlite3
+
+import (
+	"bytes"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only view of the volatile file system, implementing
+// fs.FS, fs.ReadDirFS and fs.ReadFileFS. Opening a file returns a snapshot
+// of its content, which is not affected by later changes.
+//
+// Slashes in file names are treated as directory separators, and
+// directories are implied by the files they contain. Files whose names are
+// not valid fs.FS paths, such as absolute paths, are not visible.
+func (fs *VolatileFileSystem) FS() iofs.FS {
+	return &volatileFS{fs: fs}
+}
+
+// Implementation of fs.FS on top of a volatile file system.
+type volatileFS struct {
+	fs *VolatileFileSystem
+}
+
+func (v *volatileFS) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	if data, err := v.fs.ReadFile(name); err == nil {
+		info := &volatileFileInfo{name: path.Base(name), size: int64(len(data))}
+		return &volatileFSFile{info: info, Reader: bytes.NewReader(data)}, nil
+	}
+
+	entries, ok := v.readDir(name)
+	if !ok {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+	}
+	info := &volatileFileInfo{name: path.Base(name), dir: true}
+
+	return &volatileFSDir{info: info, entries: entries}, nil
+}
+
+// Return the entries of the given directory sorted by name.
+func (v *volatileFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	entries, ok := v.readDir(name)
+	if !ok {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: iofs.ErrNotExist}
+	}
+
+	return entries, nil
+}
+
+// Return a copy of the content of the given file.
+func (v *volatileFS) ReadFile(name string) ([]byte, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: iofs.ErrInvalid}
+	}
+
+	data, err := v.fs.ReadFile(name)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: iofs.ErrNotExist}
+	}
+
+	return data, nil
+}
+
+// Return the entries of the given directory, and whether it exists.
+func (v *volatileFS) readDir(name string) ([]iofs.DirEntry, bool) {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+
+	dirs := make(map[string]bool)
+	entries := []iofs.DirEntry{}
+	for _, file := range v.fs.Files() {
+		if !iofs.ValidPath(file) || !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		rest := file[len(prefix):]
+
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			if !dirs[rest[:i]] {
+				dirs[rest[:i]] = true
+				entries = append(entries, &volatileFileInfo{name: rest[:i], dir: true})
+			}
+			continue
+		}
+
+		size, err := v.fs.FileSize(file)
+		if err != nil {
+			continue // Deleted in the meantime.
+		}
+		entries = append(entries, &volatileFileInfo{name: rest, size: int64(size)})
+	}
+
+	if len(entries) == 0 && name != "." {
+		return nil, false
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, true
+}
+
+// Snapshot of a volatile file opened through fs.FS.
+type volatileFSFile struct {
+	*bytes.Reader
+	info *volatileFileInfo
+}
+
+func (f *volatileFSFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *volatileFSFile) Close() error {
+	return nil
+}
+
+// Directory opened through fs.FS.
+type volatileFSDir struct {
+	info    *volatileFileInfo
+	entries []iofs.DirEntry
+	offset  int
+}
+
+func (d *volatileFSDir) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *volatileFSDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: iofs.ErrInvalid}
+}
+
+func (d *volatileFSDir) Close() error {
+	return nil
+}
+
+func (d *volatileFSDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+// Implement both fs.FileInfo and fs.DirEntry for volatile files and their
+// implied directories.
+type volatileFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i *volatileFileInfo) Name() string {
+	return i.name
+}
+
+func (i *volatileFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *volatileFileInfo) Mode() iofs.FileMode {
+	if i.dir {
+		return iofs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i *volatileFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i *volatileFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *volatileFileInfo) Sys() interface{} {
+	return nil
+}
+
+func (i *volatileFileInfo) Type() iofs.FileMode {
+	return i.Mode().Type()
+}
+
+func (i *volatileFileInfo) Info() (iofs.FileInfo, error) {
+	return i, nil
+}
@@ -0,0 +1,95 @@
+// +build go1.16
+
+package sqlite3
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"testing"
+	"testing/fstest"
+)
+
+// A volatile file system can be inspected through io/fs.
+func Test_VolatileVFSFS(t *testing.T) {
+	volatile := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(volatile)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if err := volatile.CreateFile("backups/old.db", []byte("old")); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+	if err := volatile.CreateFile("/absolute.db", []byte("hidden")); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+
+	fsys := volatile.FS()
+	if err := fstest.TestFS(fsys, "test.db", "test.db-wal", "backups/old.db"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		paths = append(paths, path)
+		return err
+	})
+	if err != nil {
+		t.Fatal("failed to walk file system", err)
+	}
+	expected := []string{".", "backups", "backups/old.db", "test.db", "test.db-wal"}
+	if len(paths) != len(expected) {
+		t.Fatalf("expected paths %v, got %v", expected, paths)
+	}
+	for i := range paths {
+		if paths[i] != expected[i] {
+			t.Fatalf("expected paths %v, got %v", expected, paths)
+		}
+	}
+
+	// Opened files are snapshots.
+	f, err := fsys.Open("test.db")
+	if err != nil {
+		t.Fatal("failed to open database file", err)
+	}
+	defer f.Close()
+	if _, err := conn.Exec("PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		t.Fatal("failed to checkpoint", err)
+	}
+	snapshot, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	data, err := fs.ReadFile(fsys, "test.db")
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	if bytes.Equal(snapshot, data) {
+		t.Fatal("expected snapshot to predate the checkpoint")
+	}
+
+	for _, name := range []string{"missing.db", "backups"} {
+		if _, err := fs.ReadFile(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected reading %s to fail with ErrNotExist, got %v", name, err)
+		}
+	}
+	if _, err := fsys.Open("missing.db"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected open of missing file to fail with ErrNotExist, got %v", err)
+	}
+	for _, name := range []string{"/absolute.db", "./test.db", "backups/../test.db"} {
+		if _, err := fs.ReadFile(fsys, name); !errors.Is(err, fs.ErrInvalid) {
+			t.Fatalf("expected reading %s to fail with ErrInvalid, got %v", name, err)
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package sqlite3
 
 import (
+	"bytes"
 	"database/sql/driver"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Exercise the volatile VFS implementation.
@@ -47,15 +55,15 @@ func Test_VolatileVFS(t *testing.T) {
 	assertTestTableRows(t, conn, 100)
 
 	// Take a full checkpoint of the volatile database.
-	size, ckpt, err := conn.WalCheckpoint("main", WalCheckpointTruncate)
+	result, err := conn.WalCheckpoint("main", WalCheckpointTruncate)
 	if err != nil {
 		t.Fatal("failed to perform WAL checkpoint on volatile VFS", err)
 	}
-	if size != 0 {
-		t.Fatalf("expected size to be %d, got %d", 0, size)
+	if result.Log != 0 {
+		t.Fatalf("expected size to be %d, got %d", 0, result.Log)
 	}
-	if ckpt != 0 {
-		t.Fatalf("expected ckpt to be %d, got %d", 0, ckpt)
+	if result.Checkpointed != 0 {
+		t.Fatalf("expected ckpt to be %d, got %d", 0, result.Checkpointed)
 	}
 
 	// Close the connection to the volatile database.
@@ -85,6 +93,411 @@ func Test_VolatileVFS(t *testing.T) {
 	}
 }
 
+// The volatile VFS implements custom pragmas reporting file system
+// statistics, and lets SQLite handle all other pragmas.
+func Test_VolatileVFSPragmas(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table on volatile VFS", err)
+	}
+
+	size, err := fs.FileSize("test.db")
+	if err != nil {
+		t.Fatal("failed to get volatile file size", err)
+	}
+	walSize, err := fs.FileSize("test.db-wal")
+	if err != nil {
+		t.Fatal("failed to get volatile WAL file size", err)
+	}
+
+	cases := []struct {
+		pragma string
+		value  int
+	}{
+		{"volatile_file_size", size},
+		{"volatile_file_count", 2},
+		{"volatile_size", size + walSize},
+	}
+	for _, c := range cases {
+		rows, err := conn.Query(fmt.Sprintf("PRAGMA %s", c.pragma), nil)
+		if err != nil {
+			t.Fatalf("failed to query %s: %v", c.pragma, err)
+		}
+		values := make([]driver.Value, 1)
+		if err := rows.Next(values); err != nil {
+			t.Fatalf("failed to fetch %s row: %v", c.pragma, err)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatalf("failed to close %s rows: %v", c.pragma, err)
+		}
+		if value := fmt.Sprintf("%s", values[0]); value != strconv.Itoa(c.value) {
+			t.Errorf("expected %s to be %d, got %s", c.pragma, c.value, value)
+		}
+	}
+
+	_, err = conn.Exec("PRAGMA volatile_file_size=1", nil)
+	if err == nil {
+		t.Fatal("expected error when setting read-only pragma")
+	}
+	if err.Error() != "volatile_file_size is read-only" {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
+
+// Writes exceeding the limits of a volatile file system fail with
+// SQLITE_FULL.
+func Test_VolatileVFSQuota(t *testing.T) {
+	var marks []VolatileUsage
+	fs := RegisterVolatileFileSystem(
+		"volatile",
+		VolatileMaxSize(256*1024),
+		VolatileHighWaterMark(128*1024, func(usage VolatileUsage) {
+			marks = append(marks, usage)
+		}),
+	)
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+
+	if _, err := conn.Exec("CREATE TABLE test (data BLOB)", nil); err != nil {
+		t.Fatal("failed to create table on volatile VFS", err)
+	}
+
+	usage := fs.Usage()
+	if usage.Shm != 32768 {
+		t.Errorf("expected shm usage to be 32768, got %d", usage.Shm)
+	}
+	if usage.Files == 0 {
+		t.Error("expected files usage to be positive")
+	}
+
+	for i := 0; i < 100; i++ {
+		_, err = conn.Exec("INSERT INTO test(data) VALUES(?)", []driver.Value{make([]byte, 8192)})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Fatal("expected insert to fail after reaching the size limit")
+	}
+	if code := err.(Error).Code; code != ErrFull {
+		t.Fatalf("expected error code %d, got %d", ErrFull, code)
+	}
+	if total := fs.Usage().Total(); total > 256*1024 {
+		t.Errorf("usage %d exceeds the size limit", total)
+	}
+	if len(marks) != 1 {
+		t.Fatalf("expected high-water mark callback to fire once, got %d", len(marks))
+	}
+	if marks[0].Total() <= 128*1024 {
+		t.Errorf("high-water mark fired with usage %d", marks[0].Total())
+	}
+}
+
+// Files can't grow beyond the per-file limit.
+func Test_VolatileVFSMaxFileSize(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileMaxFileSize(1024))
+	defer UnregisterVolatileFileSystem(fs)
+
+	if err := fs.CreateFile("small", make([]byte, 1024)); err != nil {
+		t.Fatal("failed to create file within the limit", err)
+	}
+	err := fs.CreateFile("big", make([]byte, 1025))
+	if err == nil {
+		t.Fatal("expected file creation beyond the limit to fail")
+	}
+	if code := err.(Error).Code; code != ErrFull {
+		t.Fatalf("expected error code %d, got %d", ErrFull, code)
+	}
+	if _, err := fs.FileSize("big"); err == nil {
+		t.Error("expected file beyond the limit to not exist")
+	}
+	if files := fs.Usage().Files; files != 1024 {
+		t.Errorf("expected files usage to be 1024, got %d", files)
+	}
+	if err := fs.Remove("small"); err != nil {
+		t.Fatal("failed to remove file", err)
+	}
+	if files := fs.Usage().Files; files != 0 {
+		t.Errorf("expected files usage to be 0, got %d", files)
+	}
+}
+
+// Size hints grow the capacity of a file, but never beyond what the quota
+// allows.
+func Test_VolatileVFSSizeHint(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileMaxFileSize(64*1024))
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	file, _ := fs.vfs.FileByName("test.db")
+
+	if _, err := volatileFileControlInt(conn, volatileFcntlSizeHint, 16*1024); err != nil {
+		t.Fatal("failed to hint file size", err)
+	}
+	if n := cap(file.data); n != 16*1024 {
+		t.Errorf("expected capacity to be 16384, got %d", n)
+	}
+
+	if _, err := volatileFileControlInt(conn, volatileFcntlSizeHint, 1024*1024*1024); err != nil {
+		t.Fatal("failed to hint file size", err)
+	}
+	if n := cap(file.data); n != 64*1024 {
+		t.Errorf("expected capacity to be capped to 65536, got %d", n)
+	}
+}
+
+// Size hints are capped by the space left in the file system.
+func Test_VolatileVFSSizeHintMaxSize(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileMaxSize(64*1024))
+	defer UnregisterVolatileFileSystem(fs)
+
+	if err := fs.CreateFile("other", make([]byte, 16*1024)); err != nil {
+		t.Fatal("failed to create file", err)
+	}
+
+	conn := openTestConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	file, _ := fs.vfs.FileByName("test.db")
+
+	if _, err := volatileFileControlInt(conn, volatileFcntlSizeHint, 1024*1024*1024); err != nil {
+		t.Fatal("failed to hint file size", err)
+	}
+	if n := cap(file.data); n != 48*1024 {
+		t.Errorf("expected capacity to be capped to 49152, got %d", n)
+	}
+}
+
+// The WAL file is kept after the last connection closes, if the
+// PERSIST_WAL file control is on.
+func Test_VolatileVFSPersistWAL(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=volatile")
+	pragmaWAL(t, conn)
+
+	value, err := volatileFileControlInt(conn, volatileFcntlPersistWAL, -1)
+	if err != nil {
+		t.Fatal("failed to query persist WAL", err)
+	}
+	if value != 0 {
+		t.Errorf("expected persist WAL to be off, got %d", value)
+	}
+
+	if _, err := volatileFileControlInt(conn, volatileFcntlPersistWAL, 1); err != nil {
+		t.Fatal("failed to set persist WAL", err)
+	}
+	value, err = volatileFileControlInt(conn, volatileFcntlPersistWAL, -1)
+	if err != nil {
+		t.Fatal("failed to query persist WAL", err)
+	}
+	if value != 1 {
+		t.Errorf("expected persist WAL to be on, got %d", value)
+	}
+
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+
+	if _, err := fs.FileSize("test.db-wal"); err != nil {
+		t.Error("expected WAL file to be kept", err)
+	}
+}
+
+// The VFSNAME and TEMPFILENAME file controls return strings allocated by
+// the VFS.
+func Test_VolatileVFSNames(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	name, err := volatileFileControlString(conn, volatileFcntlVFSName)
+	if err != nil {
+		t.Fatal("failed to get VFS name", err)
+	}
+	if name != "volatile" {
+		t.Errorf("expected VFS name to be volatile, got %q", name)
+	}
+
+	name1, err := volatileFileControlString(conn, volatileFcntlTempFilename)
+	if err != nil {
+		t.Fatal("failed to get temporary file name", err)
+	}
+	name2, err := volatileFileControlString(conn, volatileFcntlTempFilename)
+	if err != nil {
+		t.Fatal("failed to get temporary file name", err)
+	}
+	if name1 == "" || name1 == name2 {
+		t.Errorf("expected distinct temporary file names, got %q and %q", name1, name2)
+	}
+}
+
+// A file has moved if it's no longer the one reachable by its name, for
+// example because a crash replaced it.
+func Test_VolatileVFSHasMoved(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile", VolatileCrashSimulation())
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openTestConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	moved, err := volatileFileControlInt(conn, volatileFcntlHasMoved, -1)
+	if err != nil {
+		t.Fatal("failed to check whether file has moved", err)
+	}
+	if moved != 0 {
+		t.Errorf("expected file to not have moved, got %d", moved)
+	}
+
+	if err := fs.Crash(); err != nil {
+		t.Fatal("failed to crash file system", err)
+	}
+
+	moved, err = volatileFileControlInt(conn, volatileFcntlHasMoved, -1)
+	if err != nil {
+		t.Fatal("failed to check whether file has moved", err)
+	}
+	if moved != 1 {
+		t.Errorf("expected file to have moved after crash, got %d", moved)
+	}
+}
+
+// Temporary tables and large sorts use anonymous files, which are deleted
+// when closed.
+func Test_VolatileVFSTempFiles(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+
+	if _, err := conn.Exec("PRAGMA temp_store=FILE; PRAGMA temp.cache_size=2", nil); err != nil {
+		t.Fatal("failed to set pragmas", err)
+	}
+	if _, err := conn.Exec("CREATE TABLE test (n INT, s TEXT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if _, err := conn.Exec("CREATE TEMP TABLE temp (n INT, s TEXT)", nil); err != nil {
+		t.Fatal("failed to create temporary table", err)
+	}
+	for i := 0; i < 100; i++ {
+		values := []driver.Value{int64(i), strings.Repeat("x", 1000)}
+		if _, err := conn.Exec("INSERT INTO temp(n, s) VALUES(?, ?)", values); err != nil {
+			t.Fatal("failed to insert value into temporary table", err)
+		}
+	}
+	_, err = conn.Exec("INSERT INTO test(n, s) SELECT n, s FROM temp ORDER BY s, n DESC", nil)
+	if err != nil {
+		t.Fatal("failed to copy temporary table", err)
+	}
+
+	if files := fs.Files(); len(files) != 1 || files[0] != "test.db" {
+		t.Errorf("expected only the database file to be visible, got %v", files)
+	}
+	size, err := fs.FileSize("test.db")
+	if err != nil {
+		t.Fatal("failed to get database size", err)
+	}
+	if usage := fs.Usage().Files; usage <= size {
+		t.Errorf("expected temporary files to use memory, got %d", usage)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal("failed to close connection", err)
+	}
+	if usage := fs.Usage().Files; usage != size {
+		t.Errorf("expected temporary files to be deleted, got usage %d", usage)
+	}
+}
+
+// Different spellings of the same file name refer to the same file.
+func Test_VolatileVFSFullPathname(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:./dir//test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	if files := fs.Files(); len(files) != 1 || files[0] != "dir/test.db" {
+		t.Fatalf("expected database file to be dir/test.db, got %v", files)
+	}
+}
+
+func openTestConn(t *testing.T, dsn string) *SQLiteConn {
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(dsn)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", dsn, err)
+	}
+	return conni.(*SQLiteConn)
+}
+
+// Create the test table and insert n rows in it.
+func insertTestTableRows(t *testing.T, conn *SQLiteConn, n int) {
+	if _, err := conn.Exec("CREATE TABLE test (n INT, s TEXT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	if _, err := conn.Exec("BEGIN", nil); err != nil {
+		t.Fatal("failed to begin transaction", err)
+	}
+	for i := 0; i < n; i++ {
+		values := []driver.Value{int64(i), strings.Repeat("secret", 20)}
+		if _, err := conn.Exec("INSERT INTO test(n, s) VALUES(?, ?)", values); err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+	if _, err := conn.Exec("COMMIT", nil); err != nil {
+		t.Fatal("failed to commit transaction", err)
+	}
+}
+
+func insertTestTableRow(t *testing.T, conn *SQLiteConn, n int) {
+	if _, err := conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(n)}); err != nil {
+		t.Fatal("failed to insert value", err)
+	}
+}
+
 func assertTestTableRows(t *testing.T, conn *SQLiteConn, n int) {
 	rows, err := conn.Query("SELECT n FROM test", nil)
 	if err != nil {
@@ -107,3 +520,109 @@ func assertTestTableRows(t *testing.T, conn *SQLiteConn, n int) {
 		t.Fatal("failed to close test table result set", err)
 	}
 }
+
+// Date and time functions use the injected clock.
+func Test_VolatileVFSClock(t *testing.T) {
+	now := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	fs := RegisterVolatileFileSystem("volatile", VolatileClock(func() time.Time { return now }))
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT datetime('now'), julianday('now')", nil)
+	if err != nil {
+		t.Fatal("failed to query current time", err)
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 2)
+	if err := rows.Next(values); err != nil {
+		t.Fatal("failed to fetch current time", err)
+	}
+	if string(values[0].([]byte)) != "2001-02-03 04:05:06" {
+		t.Errorf("expected injected datetime, got %v", values[0])
+	}
+	if julian := values[1].(float64); julian < 2451943.67 || julian > 2451943.68 {
+		t.Errorf("expected injected julian day, got %v", julian)
+	}
+}
+
+// The injected sleep function is used in place of a real sleep.
+func Test_VolatileVFSSleep(t *testing.T) {
+	var slept time.Duration
+	fs := RegisterVolatileFileSystem("volatile", VolatileSleep(func(d time.Duration) { slept += d }))
+	defer UnregisterVolatileFileSystem(fs)
+
+	start := time.Now()
+	fs.vfs.Sleep(time.Second)
+	fs.vfs.Sleep(time.Second)
+
+	if slept != 2*time.Second {
+		t.Errorf("expected injected sleep to be invoked, got %s", slept)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected no real sleep, took %s", elapsed)
+	}
+}
+
+// The same random source seed produces the same random bytes.
+func Test_VolatileVFSRandomSource(t *testing.T) {
+	random := func(seed int64) []byte {
+		source := rand.New(rand.NewSource(seed))
+		fs := RegisterVolatileFileSystem("volatile", VolatileRandomSource(source))
+		defer UnregisterVolatileFileSystem(fs)
+
+		buf := make([]byte, 16)
+		fs.vfs.Randomness(buf)
+		return buf
+	}
+
+	if !bytes.Equal(random(1), random(1)) {
+		t.Error("expected the same seed to produce the same bytes")
+	}
+	if bytes.Equal(random(1), random(2)) {
+		t.Error("expected different seeds to produce different bytes")
+	}
+}
+
+// Reads from the random source are serialized, since it might not be safe
+// for concurrent use.
+func Test_VolatileVFSRandomSourceConcurrent(t *testing.T) {
+	source := &overlapDetectingReader{}
+	fs := RegisterVolatileFileSystem("volatile", VolatileRandomSource(source))
+	defer UnregisterVolatileFileSystem(fs)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.vfs.Randomness(make([]byte, 16))
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&source.overlaps); n != 0 {
+		t.Errorf("expected reads to be serialized, got %d overlapping ones", n)
+	}
+}
+
+// A reader counting how many times it was read concurrently.
+type overlapDetectingReader struct {
+	active   int32
+	overlaps int32
+}
+
+func (r *overlapDetectingReader) Read(buf []byte) (int, error) {
+	if atomic.AddInt32(&r.active, 1) > 1 {
+		atomic.AddInt32(&r.overlaps, 1)
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&r.active, -1)
+	return len(buf), nil
+}
@@ -12,6 +12,11 @@ int walHookTrampoline(void*, sqlite3*, char*, int);
 */
 import "C"
 import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"strconv"
+	"time"
 	"unsafe"
 )
 
@@ -25,6 +30,32 @@ func (c *SQLiteConn) RegisterWalHook(callback func(string, int) int) {
 	}
 }
 
+// Return the name of the file of the given database attached to the
+// connection, or an empty string if it's a temporary or in-memory one.
+func (c *SQLiteConn) filename(db string) string {
+	zDb := C.CString(db)
+	defer C.free(unsafe.Pointer(zDb))
+
+	zFilename := C.sqlite3_db_filename(c.db, zDb)
+	if zFilename == nil {
+		return ""
+	}
+	return C.GoString(zFilename)
+}
+
+// Return the name of the VFS used by the main database of the connection.
+func (c *SQLiteConn) vfsName() (string, error) {
+	zDb := C.CString("main")
+	defer C.free(unsafe.Pointer(zDb))
+
+	var pVfs *C.sqlite3_vfs
+	rv := C.sqlite3_file_control(c.db, zDb, C.SQLITE_FCNTL_VFS_POINTER, unsafe.Pointer(&pVfs))
+	if rv != C.SQLITE_OK {
+		return "", newError(rv)
+	}
+	return C.GoString(pVfs.zName), nil
+}
+
 // WalCheckpointMode defines all valid values for the "checkpoint mode" parameter
 // of the WalCheckpointV2 API. See https://sqlite.org/c3ref/wal_checkpoint_v2.html.
 type WalCheckpointMode int
@@ -37,9 +68,24 @@ const (
 	WalCheckpointTruncate = WalCheckpointMode(C.SQLITE_CHECKPOINT_TRUNCATE)
 )
 
+// CheckpointResult holds the outcome of a WAL checkpoint.
+type CheckpointResult struct {
+	Mode         WalCheckpointMode // Mode of the checkpoint.
+	Log          int               // Number of frames in the WAL, or -1 if not in WAL mode.
+	Checkpointed int               // Number of frames copied back, or -1 if not in WAL mode.
+	Duration     time.Duration     // Time taken by the checkpoint.
+
+	// Whether the checkpoint could not complete because other connections
+	// were reading or writing, and the busy handler gave up waiting for
+	// them. In that case an ErrBusy error is returned as well. PASSIVE
+	// checkpoints never wait and never fail with ErrBusy: they are blocked
+	// if they leave some frames of the WAL behind.
+	Blocked bool
+}
+
 // WalCheckpoint triggers a WAL checkpoint on the given database attached to the
 // connection. See https://sqlite.org/c3ref/wal_checkpoint_v2.html
-func (c *SQLiteConn) WalCheckpoint(db string, mode WalCheckpointMode) (int, int, error) {
+func (c *SQLiteConn) WalCheckpoint(db string, mode WalCheckpointMode) (CheckpointResult, error) {
 	var size C.int
 	var ckpt C.int
 	var err error
@@ -48,10 +94,122 @@ func (c *SQLiteConn) WalCheckpoint(db string, mode WalCheckpointMode) (int, int,
 	zDb := C.CString(db)
 	defer C.free(unsafe.Pointer(zDb))
 
+	start := time.Now()
 	rv := C.sqlite3_wal_checkpoint_v2(c.db, zDb, C.int(mode), &size, &ckpt)
 	if rv != 0 {
 		err = newError(rv)
 	}
 
-	return int(size), int(ckpt), err
+	result := CheckpointResult{
+		Mode:         mode,
+		Log:          int(size),
+		Checkpointed: int(ckpt),
+		Duration:     time.Since(start),
+		Blocked:      rv == C.SQLITE_BUSY,
+	}
+	if mode == WalCheckpointPassive && rv == C.SQLITE_OK {
+		result.Blocked = result.Checkpointed < result.Log
+	}
+
+	return result, err
+}
+
+// WalCheckpointAll triggers a WAL checkpoint on all databases attached to
+// the connection, returning the result of each of them by schema name. If
+// any of them is blocked, the others are checkpointed anyway and ErrBusy is
+// returned, unless the mode is PASSIVE. Other errors stop the checkpoints.
+func (c *SQLiteConn) WalCheckpointAll(mode WalCheckpointMode) (map[string]CheckpointResult, error) {
+	schemas, err := c.schemas()
+	if err != nil {
+		return nil, err
+	}
+
+	var busy error
+	results := make(map[string]CheckpointResult, len(schemas))
+	for _, schema := range schemas {
+		result, err := c.WalCheckpoint(schema, mode)
+		results[schema] = result
+		if result.Blocked {
+			if busy == nil {
+				busy = err
+			}
+			continue
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, busy
+}
+
+// Return the names of the databases attached to the connection.
+func (c *SQLiteConn) schemas() ([]string, error) {
+	rows, err := c.query(internalContext, "PRAGMA database_list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := []string{}
+	values := make([]driver.Value, 3)
+	for {
+		if err := rows.Next(values); err != nil {
+			if err == io.EOF {
+				return schemas, nil
+			}
+			return nil, err
+		}
+		switch name := values[1].(type) {
+		case []byte:
+			schemas = append(schemas, string(name))
+		case string:
+			schemas = append(schemas, name)
+		}
+	}
+}
+
+// WalCheckpointContext is like WalCheckpoint, but if the checkpoint is
+// blocked it keeps retrying with exponential backoff until it succeeds or
+// the context is done, in which case the result of the last attempt is
+// returned along with the context error.
+//
+// While retrying, the connection's busy handler is not invoked, so waiting
+// is bounded by the context alone. The busy timeout in effect is restored
+// afterwards.
+func (c *SQLiteConn) WalCheckpointContext(ctx context.Context, db string, mode WalCheckpointMode) (CheckpointResult, error) {
+	value, err := c.pragma("busy_timeout")
+	if err != nil {
+		return CheckpointResult{Mode: mode}, err
+	}
+	busyTimeout, err := strconv.Atoi(value)
+	if err != nil {
+		return CheckpointResult{Mode: mode}, err
+	}
+
+	C.sqlite3_busy_timeout(c.db, 0)
+	defer C.sqlite3_busy_timeout(c.db, C.int(busyTimeout))
+
+	start := time.Now()
+	backoff := time.Millisecond
+	for {
+		result, err := c.WalCheckpoint(db, mode)
+		result.Duration = time.Since(start)
+		if !result.Blocked {
+			return result, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			result.Duration = time.Since(start)
+			return result, ctx.Err()
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > 100*time.Millisecond {
+			backoff = 100 * time.Millisecond
+		}
+	}
 }
@@ -0,0 +1,240 @@
+package sqlite3
+
+import (
+	"sync"
+	"time"
+)
+
+// WalCheckpointPolicy configures when a WalCheckpointer runs checkpoints,
+// and which mode it uses.
+type WalCheckpointPolicy struct {
+	// Run a passive checkpoint when the WAL has at least this number of
+	// frames. Defaults to 1000, like SQLite's automatic checkpoints.
+	Threshold int
+
+	// Escalate to EscalationMode when the WAL has at least this number of
+	// frames, even during quiet hours. Zero means no hard limit.
+	HardLimit int
+
+	// Escalate to EscalationMode after this number of consecutive passive
+	// checkpoints that could not copy all frames back to the database,
+	// because readers keep the WAL pinned. Zero means never.
+	MaxPinned int
+
+	// Mode used when escalating, either WalCheckpointRestart or
+	// WalCheckpointTruncate. Defaults to WalCheckpointRestart.
+	EscalationMode WalCheckpointMode
+
+	// If not nil, checkpoints below the hard limit are skipped whenever
+	// this function returns true for the current time. They are retried
+	// at the next commit after the quiet period ends. See WalQuietHours.
+	Quiet func(time.Time) bool
+
+	// If not nil, invoked after every checkpoint with its outcome. It's
+	// called from the checkpointer's goroutine.
+	OnCheckpoint func(WalCheckpointMetrics)
+}
+
+// WalCheckpointMetrics reports the outcome of a checkpoint run by a
+// WalCheckpointer.
+type WalCheckpointMetrics struct {
+	CheckpointResult
+	Database string // Name of the checkpointed database.
+	Frames   int    // Frames in the WAL when the checkpoint was triggered.
+	Err      error  // Error returned by the checkpoint, if any.
+}
+
+// WalQuietHours returns a function suitable for WalCheckpointPolicy.Quiet,
+// that returns true between the given hours of the day, in local time. The
+// end hour is excluded, and may be lower than the start hour to span
+// midnight.
+func WalQuietHours(start, end int) func(time.Time) bool {
+	return func(now time.Time) bool {
+		hour := now.Hour()
+		if start <= end {
+			return hour >= start && hour < end
+		}
+		return hour >= start || hour < end
+	}
+}
+
+// WalCheckpointer runs checkpoints of a connection's databases in a
+// background goroutine, according to a WalCheckpointPolicy. It replaces
+// SQLite's automatic checkpoints.
+//
+// Checkpoints don't run on the connection itself, which is not safe for
+// concurrent use and might be in the middle of a transaction, but on
+// dedicated connections to the same database files, opened and owned by
+// the checkpointer. For this reason databases using exclusive locking mode
+// can't be checkpointed, and temporary or in-memory ones are ignored.
+type WalCheckpointer struct {
+	conn        *SQLiteConn
+	db          string
+	policy      WalCheckpointPolicy
+	vfs         string                    // VFS of the connection's main database.
+	busyTimeout time.Duration             // Busy timeout of the dedicated connections.
+	pending     chan walCheckpointRequest // Checkpoints triggered by the WAL hook.
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	pinned      map[string]int         // Consecutive pinned passive checkpoints, by database.
+	conns       map[string]*SQLiteConn // Dedicated connections, by database file name.
+}
+
+// Checkpoint triggered by a commit.
+type walCheckpointRequest struct {
+	db       string
+	filename string
+	frames   int
+}
+
+// NewWalCheckpointer starts a checkpointer for the given database of the
+// given connection, or for all its databases if the name is empty.
+//
+// It takes over the WAL hook of the connection, so RegisterWalHook must
+// not be used until the checkpointer is stopped. The checkpointer must be
+// stopped before closing the connection. The dedicated connections use the
+// same VFS and busy timeout as the given one.
+func NewWalCheckpointer(conn *SQLiteConn, db string, policy WalCheckpointPolicy) *WalCheckpointer {
+	if policy.Threshold <= 0 {
+		policy.Threshold = 1000
+	}
+	if policy.EscalationMode != WalCheckpointTruncate {
+		policy.EscalationMode = WalCheckpointRestart
+	}
+
+	// If the VFS can't be determined, checkpoints use the default one.
+	vfs, _ := conn.vfsName()
+
+	c := &WalCheckpointer{
+		conn:        conn,
+		db:          db,
+		policy:      policy,
+		vfs:         vfs,
+		busyTimeout: time.Duration(conn.busyTimeout) * time.Millisecond,
+		pending:     make(chan walCheckpointRequest, 1),
+		stop:        make(chan struct{}),
+		pinned:      make(map[string]int),
+		conns:       make(map[string]*SQLiteConn),
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	conn.RegisterWalHook(c.hook)
+
+	return c
+}
+
+// Stop unregisters the WAL hook, waits for the background goroutine to
+// exit and closes the dedicated connections. Checkpoints triggered but not
+// yet started are dropped.
+func (c *WalCheckpointer) Stop() {
+	c.conn.RegisterWalHook(nil)
+	close(c.stop)
+	c.wg.Wait()
+
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// Invoked by SQLite after every commit. It must not block, so if a
+// checkpoint is already pending the new request is dropped, since the
+// pending one will checkpoint the same frames.
+func (c *WalCheckpointer) hook(db string, frames int) int {
+	if c.db != "" && db != c.db {
+		return 0
+	}
+	if frames < c.policy.Threshold && (c.policy.HardLimit == 0 || frames < c.policy.HardLimit) {
+		return 0
+	}
+
+	// The hook runs on the connection, so it's safe to use it here.
+	filename := c.conn.filename(db)
+	if filename == "" {
+		return 0
+	}
+
+	select {
+	case c.pending <- walCheckpointRequest{db: db, filename: filename, frames: frames}:
+	default:
+	}
+
+	return 0
+}
+
+func (c *WalCheckpointer) run() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case request := <-c.pending:
+			c.checkpoint(request)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Run a checkpoint, choosing its mode according to the policy.
+func (c *WalCheckpointer) checkpoint(request walCheckpointRequest) {
+	hard := c.policy.HardLimit > 0 && request.frames >= c.policy.HardLimit
+
+	if !hard && c.policy.Quiet != nil && c.policy.Quiet(time.Now()) {
+		return
+	}
+
+	mode := WalCheckpointPassive
+	if hard || (c.policy.MaxPinned > 0 && c.pinned[request.db] >= c.policy.MaxPinned) {
+		mode = c.policy.EscalationMode
+	}
+
+	result := CheckpointResult{Mode: mode}
+	conn, err := c.connect(request.filename)
+	if err == nil {
+		result, err = conn.WalCheckpoint("main", mode)
+	}
+
+	if err == nil && result.Checkpointed >= result.Log {
+		c.pinned[request.db] = 0
+	} else if mode == WalCheckpointPassive {
+		c.pinned[request.db]++
+	}
+
+	if c.policy.OnCheckpoint != nil {
+		c.policy.OnCheckpoint(WalCheckpointMetrics{
+			CheckpointResult: result,
+			Database:         request.db,
+			Frames:           request.frames,
+			Err:              err,
+		})
+	}
+}
+
+// Return the dedicated connection to the given database file, opening it
+// if needed.
+func (c *WalCheckpointer) connect(filename string) (*SQLiteConn, error) {
+	if conn, ok := c.conns[filename]; ok {
+		return conn, nil
+	}
+
+	cfg := NewConfig(filename)
+	cfg.VFS = c.vfs
+	cfg.BusyTimeout = c.busyTimeout
+	cfg.NoCreate = true
+
+	conn, err := openConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// A connection opens the WAL only when it first reads the database,
+	// and can't checkpoint it before.
+	if _, err := conn.pragma("schema_version"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conns[filename] = conn
+
+	return conn, nil
+}
@@ -0,0 +1,204 @@
+package sqlite3
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWalCheckpointer(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openCheckpointerConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	metrics := make(chan WalCheckpointMetrics, 10)
+	checkpointer := NewWalCheckpointer(conn, "main", WalCheckpointPolicy{
+		Threshold:    5,
+		OnCheckpoint: func(m WalCheckpointMetrics) { metrics <- m },
+	})
+	defer checkpointer.Stop()
+
+	var m WalCheckpointMetrics
+	for i := 0; ; i++ {
+		insertTestTableRow(t, conn, i)
+		if m = receiveCheckpointMetrics(metrics); m.Log > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no checkpoint was run")
+		}
+	}
+
+	if m.Err != nil {
+		t.Fatal("checkpoint failed", m.Err)
+	}
+	if m.Database != "main" || m.Mode != WalCheckpointPassive {
+		t.Errorf("expected passive checkpoint of main database, got %+v", m)
+	}
+	if m.Frames < 5 || m.Checkpointed != m.Log {
+		t.Errorf("expected all frames above the threshold to be checkpointed, got %+v", m)
+	}
+}
+
+// The hard limit escalates the checkpoint mode even during quiet hours.
+func TestWalCheckpointer_HardLimit(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openCheckpointerConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	metrics := make(chan WalCheckpointMetrics, 10)
+	checkpointer := NewWalCheckpointer(conn, "", WalCheckpointPolicy{
+		Threshold:      1,
+		HardLimit:      20,
+		EscalationMode: WalCheckpointTruncate,
+		Quiet:          func(time.Time) bool { return true },
+		OnCheckpoint:   func(m WalCheckpointMetrics) { metrics <- m },
+	})
+	defer checkpointer.Stop()
+
+	for i := 0; i < 100; i++ {
+		insertTestTableRow(t, conn, i)
+		m := receiveCheckpointMetrics(metrics)
+		if m.Log == 0 && m.Mode == 0 && m.Database == "" {
+			continue // Skipped because of quiet hours.
+		}
+		if m.Mode != WalCheckpointTruncate || m.Frames < 20 || m.Err != nil {
+			t.Fatalf("expected truncate checkpoint above the hard limit, got %+v", m)
+		}
+		size, err := fs.FileSize("test.db-wal")
+		if err != nil {
+			t.Fatal("failed to get WAL size", err)
+		}
+		if size != 0 {
+			t.Errorf("expected WAL to be truncated, got size %d", size)
+		}
+		return
+	}
+	t.Fatal("no checkpoint was run")
+}
+
+// Readers pinning the WAL cause escalation after the given number of
+// passive checkpoints.
+func TestWalCheckpointer_Pinned(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	conn := openCheckpointerConn(t, tempFilename+"?_busy_timeout=10")
+	defer conn.Close()
+	reader := openCheckpointerConn(t, tempFilename)
+	defer reader.Close()
+
+	insertTestTableRow(t, conn, 0)
+	if _, err := reader.Exec("BEGIN; SELECT count(*) FROM test", nil); err != nil {
+		t.Fatal("failed to begin read transaction", err)
+	}
+	defer reader.Exec("ROLLBACK", nil)
+
+	metrics := make(chan WalCheckpointMetrics, 10)
+	checkpointer := NewWalCheckpointer(conn, "main", WalCheckpointPolicy{
+		Threshold:    1,
+		MaxPinned:    2,
+		OnCheckpoint: func(m WalCheckpointMetrics) { metrics <- m },
+	})
+	defer checkpointer.Stop()
+
+	modes := []WalCheckpointMode{}
+	for i := 1; i <= 3; i++ {
+		insertTestTableRow(t, conn, i)
+		m := receiveCheckpointMetrics(metrics)
+		modes = append(modes, m.Mode)
+		if m.Mode == WalCheckpointPassive && m.Checkpointed >= m.Log {
+			t.Fatalf("expected passive checkpoint to be pinned by reader, got %+v", m)
+		}
+	}
+
+	expected := []WalCheckpointMode{WalCheckpointPassive, WalCheckpointPassive, WalCheckpointRestart}
+	for i := range expected {
+		if modes[i] != expected[i] {
+			t.Fatalf("expected checkpoint modes %v, got %v", expected, modes)
+		}
+	}
+}
+
+// Checkpoints run on a dedicated connection, so they work while the
+// checkpointed one is in the middle of a transaction.
+func TestWalCheckpointer_DedicatedConnection(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	conn := openCheckpointerConn(t, "file:test.db?vfs=volatile")
+	defer conn.Close()
+
+	// Hold the checkpoint until the connection has started a transaction.
+	began := make(chan struct{})
+	metrics := make(chan WalCheckpointMetrics, 10)
+	checkpointer := NewWalCheckpointer(conn, "main", WalCheckpointPolicy{
+		Threshold:    1,
+		Quiet:        func(time.Time) bool { <-began; return false },
+		OnCheckpoint: func(m WalCheckpointMetrics) { metrics <- m },
+	})
+	defer checkpointer.Stop()
+
+	insertTestTableRow(t, conn, 0)
+	if _, err := conn.Exec("BEGIN; SELECT count(*) FROM test", nil); err != nil {
+		t.Fatal("failed to begin read transaction", err)
+	}
+	defer conn.Exec("ROLLBACK", nil)
+	close(began)
+
+	m := receiveCheckpointMetrics(metrics)
+	if m.Err != nil {
+		t.Fatal("checkpoint failed", m.Err)
+	}
+	if m.Log == 0 || m.Checkpointed != m.Log {
+		t.Errorf("expected all frames to be checkpointed, got %+v", m)
+	}
+}
+
+func TestWalQuietHours(t *testing.T) {
+	cases := []struct {
+		start, end, hour int
+		quiet            bool
+	}{
+		{1, 5, 0, false},
+		{1, 5, 1, true},
+		{1, 5, 4, true},
+		{1, 5, 5, false},
+		{22, 6, 23, true},
+		{22, 6, 3, true},
+		{22, 6, 6, false},
+		{22, 6, 12, false},
+	}
+	for _, c := range cases {
+		now := time.Date(2018, 1, 1, c.hour, 30, 0, 0, time.Local)
+		if quiet := WalQuietHours(c.start, c.end)(now); quiet != c.quiet {
+			t.Errorf("quiet hours %d-%d at %d: expected %v, got %v", c.start, c.end, c.hour, c.quiet, quiet)
+		}
+	}
+}
+
+func openCheckpointerConn(t *testing.T, dsn string) *SQLiteConn {
+	conn := openTestConn(t, dsn)
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE IF NOT EXISTS test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	return conn
+}
+
+// Wait briefly for a checkpoint, returning zero metrics if none was run.
+func receiveCheckpointMetrics(metrics chan WalCheckpointMetrics) WalCheckpointMetrics {
+	select {
+	case m := <-metrics:
+		return m
+	case <-time.After(50 * time.Millisecond):
+		return WalCheckpointMetrics{}
+	}
+}
@@ -0,0 +1,165 @@
+package sqlite3
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Sizes of the WAL file header and of each frame header, and the magic
+// number identifying a WAL file. The least significant bit of the magic
+// number tells whether checksums use big-endian words.
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682
+)
+
+// WalHeader holds the fields of the 32-byte header of a WAL file.
+type WalHeader struct {
+	Magic              uint32 // Either 0x377f0682 or 0x377f0683.
+	Version            uint32 // File format version, currently 3007000.
+	PageSize           int    // Database page size.
+	CheckpointSequence uint32 // Checkpoint sequence number.
+	Salt1              uint32 // Incremented by every checkpoint that resets the WAL.
+	Salt2              uint32 // A different random number for every reset.
+	Checksum1          uint32 // First part of the checksum of the header.
+	Checksum2          uint32 // Second part of the checksum of the header.
+}
+
+// WalFrame holds a single frame of a WAL file, consisting of a 24-byte
+// header followed by the content of a page.
+type WalFrame struct {
+	PageNumber uint32 // Number of the database page held by the frame.
+	CommitSize uint32 // Size of the database in pages, for commit frames, or zero.
+	Salt1      uint32 // Copy of the salts of the WAL header.
+	Salt2      uint32
+	Checksum1  uint32 // Cumulative checksum of all frames up to this one.
+	Checksum2  uint32
+	Data       []byte // Content of the page.
+}
+
+// IsCommit returns true if the frame is the last one of a transaction.
+func (f *WalFrame) IsCommit() bool {
+	return f.CommitSize != 0
+}
+
+// WalFile holds the decoded content of a WAL file.
+type WalFile struct {
+	Header WalHeader
+
+	// Frames whose salts and checksums are valid. SQLite stops at the
+	// first invalid frame when recovering the WAL, and ignores all frames
+	// after it.
+	Frames []WalFrame
+
+	// Number of trailing bytes after the last valid frame.
+	Trailing int
+}
+
+// Committed returns the valid frames up to and including the last commit
+// frame. The frames after it belong to a transaction that was never
+// committed, and are ignored by SQLite.
+func (w *WalFile) Committed() []WalFrame {
+	for i := len(w.Frames) - 1; i >= 0; i-- {
+		if w.Frames[i].IsCommit() {
+			return w.Frames[:i+1]
+		}
+	}
+	return nil
+}
+
+// ReadWalFile reads and decodes the WAL file at the given path.
+func ReadWalFile(path string) (*WalFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read WAL file")
+	}
+
+	return DecodeWal(data)
+}
+
+// DecodeWal decodes the given content of a WAL file, for example as
+// returned by VolatileFileSystem.ReadFile, verifying the checksum chain of
+// its frames.
+//
+// An error is returned only if the header is invalid. Frames that fail
+// verification are not returned, and are accounted in WalFile.Trailing.
+func DecodeWal(data []byte) (*WalFile, error) {
+	if len(data) < walHeaderSize {
+		return nil, errors.Errorf("WAL file too short: %d bytes", len(data))
+	}
+
+	magic := binary.BigEndian.Uint32(data[0:])
+	if magic&^1 != walMagic {
+		return nil, errors.Errorf("invalid WAL magic number %#x", magic)
+	}
+
+	header := WalHeader{
+		Magic:              magic,
+		Version:            binary.BigEndian.Uint32(data[4:]),
+		PageSize:           int(binary.BigEndian.Uint32(data[8:])),
+		CheckpointSequence: binary.BigEndian.Uint32(data[12:]),
+		Salt1:              binary.BigEndian.Uint32(data[16:]),
+		Salt2:              binary.BigEndian.Uint32(data[20:]),
+		Checksum1:          binary.BigEndian.Uint32(data[24:]),
+		Checksum2:          binary.BigEndian.Uint32(data[28:]),
+	}
+
+	if size := header.PageSize; size < 512 || size > 65536 || size&(size-1) != 0 {
+		return nil, errors.Errorf("invalid WAL page size %d", size)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic&1 != 0 {
+		order = binary.BigEndian
+	}
+
+	s1, s2 := walChecksum(order, data[:24], 0, 0)
+	if s1 != header.Checksum1 || s2 != header.Checksum2 {
+		return nil, errors.New("WAL header checksum mismatch")
+	}
+
+	wal := &WalFile{Header: header, Frames: []WalFrame{}}
+
+	offset := walHeaderSize
+	frameSize := walFrameHeaderSize + header.PageSize
+	for ; offset+frameSize <= len(data); offset += frameSize {
+		frame := data[offset : offset+frameSize]
+		f := WalFrame{
+			PageNumber: binary.BigEndian.Uint32(frame[0:]),
+			CommitSize: binary.BigEndian.Uint32(frame[4:]),
+			Salt1:      binary.BigEndian.Uint32(frame[8:]),
+			Salt2:      binary.BigEndian.Uint32(frame[12:]),
+			Checksum1:  binary.BigEndian.Uint32(frame[16:]),
+			Checksum2:  binary.BigEndian.Uint32(frame[20:]),
+			Data:       frame[walFrameHeaderSize:],
+		}
+
+		if f.PageNumber == 0 || f.Salt1 != header.Salt1 || f.Salt2 != header.Salt2 {
+			break
+		}
+		s1, s2 = walChecksum(order, frame[:8], s1, s2)
+		s1, s2 = walChecksum(order, f.Data, s1, s2)
+		if s1 != f.Checksum1 || s2 != f.Checksum2 {
+			break
+		}
+
+		wal.Frames = append(wal.Frames, f)
+	}
+	wal.Trailing = len(data) - offset
+
+	return wal, nil
+}
+
+// Compute the checksum of the given data, which must be a multiple of 8
+// bytes, starting from the given initial values, as described in the WAL
+// file format documentation.
+func walChecksum(order binary.ByteOrder, data []byte, s1, s2 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(data); i += 8 {
+		s1 += order.Uint32(data[i:]) + s2
+		s2 += order.Uint32(data[i+4:]) + s1
+	}
+	return s1, s2
+}
@@ -0,0 +1,124 @@
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDecodeWal(t *testing.T) {
+	fs := RegisterVolatileFileSystem("volatile")
+	defer UnregisterVolatileFileSystem(fs)
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open("file:test.db?vfs=volatile")
+	if err != nil {
+		t.Fatal("failed to open connection with volatile VFS", err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	if _, err := conn.Exec("PRAGMA page_size=1024; PRAGMA wal_autocheckpoint=0", nil); err != nil {
+		t.Fatal("failed to set pragmas", err)
+	}
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Exec("INSERT INTO test(n) VALUES(?)", []driver.Value{int64(i)}); err != nil {
+			t.Fatal("failed to insert value", err)
+		}
+	}
+
+	data, err := fs.ReadFile("test.db-wal")
+	if err != nil {
+		t.Fatal("failed to read WAL file", err)
+	}
+	wal, err := DecodeWal(data)
+	if err != nil {
+		t.Fatal("failed to decode WAL file", err)
+	}
+
+	if wal.Header.PageSize != 1024 || wal.Header.Version != 3007000 {
+		t.Errorf("unexpected WAL header %+v", wal.Header)
+	}
+	if wal.Trailing != 0 {
+		t.Errorf("expected no trailing bytes, got %d", wal.Trailing)
+	}
+	if n := (len(data) - walHeaderSize) / (walFrameHeaderSize + 1024); len(wal.Frames) != n {
+		t.Errorf("expected %d valid frames, got %d", n, len(wal.Frames))
+	}
+	if n := len(wal.Committed()); n != len(wal.Frames) {
+		t.Errorf("expected all %d frames to be committed, got %d", len(wal.Frames), n)
+	}
+	last := wal.Frames[len(wal.Frames)-1]
+	if last.PageNumber != 2 || last.CommitSize != 2 {
+		t.Errorf("expected last frame to commit page 2 of 2, got %+v", last)
+	}
+
+	// Damaging a frame breaks the checksum chain from that frame on.
+	damaged := make([]byte, len(data))
+	copy(damaged, data)
+	damaged[walHeaderSize+walFrameHeaderSize+1024+walFrameHeaderSize+100]++
+	wal, err = DecodeWal(damaged)
+	if err != nil {
+		t.Fatal("failed to decode damaged WAL file", err)
+	}
+	if len(wal.Frames) != 1 || wal.Trailing != len(data)-walHeaderSize-walFrameHeaderSize-1024 {
+		t.Errorf("expected only the first frame to be valid, got %d frames", len(wal.Frames))
+	}
+
+	if _, err := DecodeWal(data[:walHeaderSize-1]); err == nil {
+		t.Error("expected decoding of truncated WAL header to fail")
+	}
+	damaged[0]++
+	if _, err := DecodeWal(damaged); err == nil {
+		t.Error("expected decoding of WAL with bad magic to fail")
+	}
+}
+
+func TestReadWalFile(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+
+	drv := &SQLiteDriver{}
+	conni, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	conn := conni.(*SQLiteConn)
+	defer conn.Close()
+
+	pragmaWAL(t, conn)
+	if _, err := conn.Exec("CREATE TABLE test (n INT)", nil); err != nil {
+		t.Fatal("failed to create table", err)
+	}
+
+	wal, err := ReadWalFile(tempFilename + "-wal")
+	if err != nil {
+		t.Fatal("failed to read WAL file", err)
+	}
+	if len(wal.Committed()) == 0 {
+		t.Fatal("expected committed frames")
+	}
+
+	// The frame holding page 1 matches the database header.
+	data, err := ioutil.ReadFile(tempFilename)
+	if err != nil {
+		t.Fatal("failed to read database file", err)
+	}
+	for _, frame := range wal.Frames {
+		if frame.PageNumber == 1 && !bytes.Equal(frame.Data[:16], data[:16]) {
+			t.Error("expected page 1 to start with the database header")
+		}
+	}
+
+	if _, err := ReadWalFile(tempFilename + "-missing"); err == nil {
+		t.Error("expected reading missing WAL file to fail")
+	}
+}
@@ -1,9 +1,11 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql/driver"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestWalHook(t *testing.T) {
@@ -68,7 +70,7 @@ func TestWalCheckpoint(t *testing.T) {
 	}
 
 	// Trying to use an invalid checkpoint mode results in an error
-	_, _, err = conni.WalCheckpoint("main", WalCheckpointMode(-1))
+	_, err = conni.WalCheckpoint("main", WalCheckpointMode(-1))
 	if err == nil {
 		t.Error("expected error when trying to set an invalid checkpoint mode")
 	}
@@ -79,17 +81,220 @@ func TestWalCheckpoint(t *testing.T) {
 	}
 
 	// Run the checkpoint.
-	size, ckpt, err := conni.WalCheckpoint("main", WalCheckpointTruncate)
+	result, err := conni.WalCheckpoint("main", WalCheckpointTruncate)
 	if err != nil {
 		t.Fatal("failed to checkpoint WAL:", err)
 	}
 
 	// Check that all frames were transferred to the database file.
-	if size != 0 {
-		t.Fatalf("%d frames still in the WAL", size)
+	if result.Log != 0 {
+		t.Fatalf("%d frames still in the WAL", result.Log)
 	}
-	if ckpt != 0 {
-		t.Fatalf("only %d frames were checkpointed", ckpt)
+	if result.Checkpointed != 0 {
+		t.Fatalf("only %d frames were checkpointed", result.Checkpointed)
+	}
+	if result.Mode != WalCheckpointTruncate || result.Blocked {
+		t.Fatalf("unexpected checkpoint result %+v", result)
+	}
+}
+
+// A blocked checkpoint is retried until the context is done.
+func TestWalCheckpointContext(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+	drv := &SQLiteDriver{}
+	conn, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer conn.Close()
+	reader, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer reader.Close()
+
+	conni := conn.(*SQLiteConn)
+	readeri := reader.(*SQLiteConn)
+	pragmaWAL(t, conni)
+
+	if _, err := conni.Exec("CREATE TABLE a (n INT)", nil); err != nil {
+		t.Fatal("failed to execute CREATE TABLE:", err)
+	}
+	if _, err := readeri.Exec("BEGIN; SELECT * FROM a", nil); err != nil {
+		t.Fatal("failed to begin read transaction:", err)
+	}
+
+	// The reader blocks the checkpoint until the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := conni.WalCheckpointContext(ctx, "main", WalCheckpointRestart)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+	if !result.Blocked || result.Duration < 50*time.Millisecond {
+		t.Fatalf("expected checkpoint to be blocked until the deadline, got %+v", result)
+	}
+
+	// Once the reader is done, the checkpoint succeeds.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		readeri.Exec("COMMIT", nil)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err = conni.WalCheckpointContext(ctx, "main", WalCheckpointRestart)
+	if err != nil {
+		t.Fatal("failed to checkpoint WAL:", err)
+	}
+	if result.Blocked || result.Checkpointed != result.Log {
+		t.Fatalf("expected all frames to be checkpointed, got %+v", result)
+	}
+}
+
+// A PASSIVE checkpoint leaving frames behind a reader is blocked, and is
+// retried until the context is done.
+func TestWalCheckpointContext_Passive(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+	drv := &SQLiteDriver{}
+	conn, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer conn.Close()
+	reader, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer reader.Close()
+
+	conni := conn.(*SQLiteConn)
+	readeri := reader.(*SQLiteConn)
+	pragmaWAL(t, conni)
+
+	if _, err := conni.Exec("CREATE TABLE a (n INT)", nil); err != nil {
+		t.Fatal("failed to execute CREATE TABLE:", err)
+	}
+	if _, err := readeri.Exec("BEGIN; SELECT * FROM a", nil); err != nil {
+		t.Fatal("failed to begin read transaction:", err)
+	}
+	if _, err := conni.Exec("INSERT INTO a(n) VALUES(1)", nil); err != nil {
+		t.Fatal("failed to execute INSERT:", err)
+	}
+
+	// The frames written after the reader started can't be checkpointed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := conni.WalCheckpointContext(ctx, "main", WalCheckpointPassive)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+	if !result.Blocked || result.Checkpointed >= result.Log {
+		t.Fatalf("expected checkpoint to leave frames behind, got %+v", result)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		readeri.Exec("COMMIT", nil)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err = conni.WalCheckpointContext(ctx, "main", WalCheckpointPassive)
+	if err != nil {
+		t.Fatal("failed to checkpoint WAL:", err)
+	}
+	if result.Blocked || result.Checkpointed != result.Log {
+		t.Fatalf("expected all frames to be checkpointed, got %+v", result)
+	}
+}
+
+// The busy timeout in effect before the checkpoint is restored, even if it
+// was changed after opening the connection.
+func TestWalCheckpointContext_BusyTimeout(t *testing.T) {
+	tempFilename := TempFilename(t)
+	defer os.Remove(tempFilename)
+	defer os.Remove(tempFilename + "-wal")
+	defer os.Remove(tempFilename + "-shm")
+	drv := &SQLiteDriver{}
+	conn, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer conn.Close()
+
+	conni := conn.(*SQLiteConn)
+	pragmaWAL(t, conni)
+	if _, err := conni.Exec("PRAGMA busy_timeout = 1234", nil); err != nil {
+		t.Fatal("failed to set busy timeout:", err)
+	}
+
+	if _, err := conni.WalCheckpointContext(context.Background(), "main", WalCheckpointPassive); err != nil {
+		t.Fatal("failed to checkpoint WAL:", err)
+	}
+
+	value, err := conni.pragma("busy_timeout")
+	if err != nil {
+		t.Fatal("failed to read busy timeout:", err)
+	}
+	if value != "1234" {
+		t.Errorf("expected busy timeout to be restored to 1234, got %s", value)
+	}
+}
+
+func TestWalCheckpointAll(t *testing.T) {
+	tempFilename := TempFilename(t)
+	otherFilename := TempFilename(t)
+	for _, name := range []string{tempFilename, otherFilename} {
+		defer os.Remove(name)
+		defer os.Remove(name + "-wal")
+		defer os.Remove(name + "-shm")
+	}
+	drv := &SQLiteDriver{}
+	conn, err := drv.Open(tempFilename)
+	if err != nil {
+		t.Fatalf("can't open connection to %s: %v", tempFilename, err)
+	}
+	defer conn.Close()
+
+	conni := conn.(*SQLiteConn)
+	pragmaWAL(t, conni)
+	if _, err := conni.Exec("ATTACH DATABASE ? AS other", []driver.Value{otherFilename}); err != nil {
+		t.Fatal("failed to attach database:", err)
+	}
+	if _, err := conni.Exec("PRAGMA other.journal_mode=WAL", nil); err != nil {
+		t.Fatal("failed to set journal mode of attached database:", err)
+	}
+	if _, err := conni.Exec("CREATE TABLE a (n INT); CREATE TABLE other.b (n INT)", nil); err != nil {
+		t.Fatal("failed to execute CREATE TABLE:", err)
+	}
+
+	results, err := conni.WalCheckpointAll(WalCheckpointTruncate)
+	if err != nil {
+		t.Fatal("failed to checkpoint all databases:", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected results for main and other, got %+v", results)
+	}
+	for _, schema := range []string{"main", "other"} {
+		result, ok := results[schema]
+		if !ok || result.Log != 0 || result.Checkpointed != 0 {
+			t.Errorf("expected WAL of %s to be reset, got %+v", schema, result)
+		}
+	}
+
+	for _, name := range []string{tempFilename, otherFilename} {
+		info, err := os.Stat(name + "-wal")
+		if err != nil {
+			t.Fatal("failed to stat WAL file:", err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("expected WAL of %s to be truncated, got size %d", name, info.Size())
+		}
 	}
 }
 